@@ -4,18 +4,23 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/bradleyfalzon/gopherci-web/internal/githubapp"
+	"github.com/bradleyfalzon/gopherci-web/internal/gopherci"
+	"github.com/bradleyfalzon/gopherci-web/internal/payments"
 	"github.com/bradleyfalzon/gopherci-web/internal/session"
 	"github.com/bradleyfalzon/gopherci-web/internal/users"
 	"github.com/google/go-github/github"
+	"github.com/pkg/errors"
 	"github.com/pressly/chi"
 	stripe "github.com/stripe/stripe-go"
-	"github.com/stripe/stripe-go/event"
 )
 
 func SessionMiddleware(next http.Handler) http.Handler {
@@ -35,6 +40,13 @@ func SessionMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// stripeMaxPayloadBytes is the maximum size of a stripe webhook's body.
+const stripeMaxPayloadBytes = 65536
+
+// githubMaxPayloadBytes is the maximum size of a GitHub webhook's body, GitHub
+// caps payloads at 25MB but installation events are much smaller.
+const githubMaxPayloadBytes = 1 << 20
+
 type userCtxKey struct{}
 
 func MustBeUserMiddleware(next http.Handler) http.Handler {
@@ -62,14 +74,30 @@ func MustBeUserMiddleware(next http.Handler) http.Handler {
 // homeHandler displays the home page
 func homeHandler(w http.ResponseWriter, r *http.Request) {
 	page := struct {
-		Title string
-	}{"GopherCI"}
+		Title     string
+		Interval  string          // Interval is the billing interval of Plans.
+		Intervals []string        // Intervals is all billing intervals with offered plans.
+		Plans     []payments.Plan // Plans is the offered plans billed every Interval.
+	}{Title: "GopherCI", Interval: pricingInterval(r), Intervals: catalogue.Intervals()}
+	page.Plans = catalogue.Offered(page.Interval)
 
 	if err := templates.ExecuteTemplate(w, "home.tmpl", page); err != nil {
 		logger.WithError(err).Error("error parsing home template")
 	}
 }
 
+// pricingInterval returns the billing interval of the plans to display from
+// the interval query parameter, defaulting to monthly plans.
+func pricingInterval(r *http.Request) string {
+	interval := r.URL.Query().Get("interval")
+	for _, offered := range catalogue.Intervals() {
+		if offered == interval {
+			return interval
+		}
+	}
+	return "month"
+}
+
 // notFoundHandler displays a 404 not found error
 func notFoundHandler(w http.ResponseWriter, r *http.Request) {
 	errorHandler(w, r, http.StatusNotFound, fmt.Sprintf("%q not found", r.URL))
@@ -99,52 +127,396 @@ func errorHandler(w http.ResponseWriter, r *http.Request, code int, desc string)
 
 // stripeEventHandler handles stripe webhooks/events.
 func stripeEventHandler(w http.ResponseWriter, r *http.Request) {
-	dec := json.NewDecoder(r.Body)
-	var hookEvent stripe.Event
-	if err := dec.Decode(&hookEvent); err != nil {
+	payload, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, stripeMaxPayloadBytes))
+	if err != nil {
+		errorHandler(w, r, http.StatusBadRequest, "could not read stripe event")
+		return
+	}
+
+	// Check authenticity using the webhook's signature
+	if err := stripeWebhook.Verify(payload, r.Header.Get(payments.SignatureHeader)); err != nil {
+		logger.WithError(err).Warn("could not verify stripe event")
+		errorHandler(w, r, http.StatusForbidden, "")
+		return
+	}
+
+	var checkedEvent stripe.Event
+	if err := json.Unmarshal(payload, &checkedEvent); err != nil {
 		errorHandler(w, r, http.StatusBadRequest, "could not decode stripe event")
 		return
 	}
 
-	// Check authenticity with stripe
-	checkedEvent, err := event.Get(hookEvent.ID, nil)
+	log := logger.WithField("StripeEventID", checkedEvent.ID)
+
+	// Stripe retries events, only process events not already processed
+	process, err := stripeEvents.Record(checkedEvent.ID, checkedEvent.Type, payload)
 	if err != nil {
-		// client error or event doesn't exist
-		if serr, ok := err.(*stripe.Error); ok && serr.HTTPStatusCode == http.StatusNotFound {
-			errorHandler(w, r, http.StatusForbidden, "")
-			return
-		}
-		logger.WithError(err).WithField("StripeEventID", hookEvent.ID).Warn("could not get stripe event")
+		log.WithError(err).Error("could not record stripe event")
 		errorHandler(w, r, http.StatusInternalServerError, "")
 		return
 	}
-	if checkedEvent == nil {
-		// I don't think this should occur
-		logger.WithField("StripeEventID", hookEvent.ID).Error("could not verify stripe event, checked event is nil")
-		errorHandler(w, r, http.StatusForbidden, "")
+	if !process {
+		log.Info("ignoring duplicate stripe event")
+		return
+	}
+
+	err = processStripeEvent(&checkedEvent)
+	if merr := stripeEvents.MarkProcessed(checkedEvent.ID, err); merr != nil {
+		log.WithError(merr).Error("could not mark stripe event as processed")
+	}
+	if err != nil {
+		// Stripe will retry the event
+		log.WithError(err).Error("could not process stripe event")
+		errorHandler(w, r, http.StatusInternalServerError, "")
 		return
 	}
+}
 
+// processStripeEvent handles a verified stripe event, it's used by both the
+// webhook handler and when replaying stored events, so must be idempotent.
+func processStripeEvent(event *stripe.Event) error {
 	log := logger.WithFields(logrus.Fields{
-		"StripeEventType":   checkedEvent.Type,
-		"StripeEventID":     checkedEvent.ID,
-		"StripeEventLive":   checkedEvent.Live,
-		"StripeEventReq":    checkedEvent.Req,
-		"StripeEventUserID": checkedEvent.UserID,
+		"StripeEventType":   event.Type,
+		"StripeEventID":     event.ID,
+		"StripeEventLive":   event.Live,
+		"StripeEventReq":    event.Req,
+		"StripeEventUserID": event.UserID,
 	})
 
-	switch checkedEvent.Type {
+	switch event.Type {
 	case "customer.subscription.deleted":
 		var sub stripe.Sub
-		err := json.Unmarshal(checkedEvent.Data.Raw, &sub)
+		err := json.Unmarshal(event.Data.Raw, &sub)
+		if err != nil {
+			return errors.Wrap(err, "could not unmarshal subscription event")
+		}
+		log = log.WithField("StripeSubID", sub.ID).WithField("StripeCustomerID", sub.Customer.ID)
+		log.Infof("subscription cancelled at %v", time.Unix(sub.PeriodEnd, 0))
+
+		return errors.Wrap(endSubscription(log, sub.Customer.ID), "could not end subscription")
+	case "customer.subscription.updated":
+		var sub stripe.Sub
+		err := json.Unmarshal(event.Data.Raw, &sub)
+		if err != nil {
+			return errors.Wrap(err, "could not unmarshal subscription event")
+		}
+		log = log.WithField("StripeSubID", sub.ID).WithField("StripeCustomerID", sub.Customer.ID)
+
+		switch sub.Status {
+		case stripe.PastDue, stripe.Unpaid:
+			log.Infof("subscription status changed to %v", sub.Status)
+			return errors.Wrap(updateDunning(log, sub.Customer.ID, true), "could not start dunning")
+		case stripe.Active, stripe.Trialing:
+			return errors.Wrap(updateDunning(log, sub.Customer.ID, false), "could not end dunning")
+		}
+	case "customer.subscription.trial_will_end":
+		var sub stripe.Sub
+		err := json.Unmarshal(event.Data.Raw, &sub)
+		if err != nil {
+			return errors.Wrap(err, "could not unmarshal subscription event")
+		}
+		log = log.WithField("StripeSubID", sub.ID).WithField("StripeCustomerID", sub.Customer.ID)
+		log.Infof("subscription trial ends at %v", time.Unix(sub.TrialEnd, 0))
+
+		return errors.Wrap(trialWillEnd(log, &sub), "could not send trial reminder")
+	case "invoice.payment_failed", "invoice.payment_succeeded":
+		var invoice stripe.Invoice
+		err := json.Unmarshal(event.Data.Raw, &invoice)
+		if err != nil {
+			return errors.Wrap(err, "could not unmarshal invoice event")
+		}
+		log = log.WithField("StripeInvoiceID", invoice.ID).WithField("StripeCustomerID", invoice.Customer.ID)
+
+		failed := event.Type == "invoice.payment_failed"
+		log.Infof("invoice payment attempted, failed: %v", failed)
+		return errors.Wrap(updateDunning(log, invoice.Customer.ID, failed), "could not update dunning")
+	default:
+		log.Info(event.Data.Obj)
+	}
+	return nil
+}
+
+// endSubscription disables all installations for the user or billing account
+// with the stripe customerID, unless they still have another active
+// subscription.
+func endSubscription(log *logrus.Entry, customerID string) error {
+	user, err := um.GetUserByStripeCustomerID(customerID)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return endAccountSubscription(log, customerID)
+	}
+	log = log.WithField("userID", user.UserID)
+	log.Info("found user for ended subscription")
+
+	active, err := user.HasActiveSubscription()
+	if err != nil {
+		return err
+	}
+	if active {
+		log.Info("user has another active subscription, not disabling any installations")
+		return nil
+	}
+
+	if err := user.DisableAllInstallations(); err != nil {
+		return err
+	}
+	wakeInstallationChanges()
+	log.Info("disabled all installations for ended subscription")
+	return nil
+}
+
+// endAccountSubscription disables all installations for the billing account
+// with the stripe customerID, unless it still has another active
+// subscription.
+func endAccountSubscription(log *logrus.Entry, customerID string) error {
+	account, err := um.GetAccountByStripeCustomerID(customerID)
+	if err != nil {
+		return err
+	}
+	if account == nil {
+		log.Warn("no user or billing account found for stripe customer, not disabling any installations")
+		return nil
+	}
+	log = log.WithField("billingAccountID", account.AccountID)
+	log.Info("found billing account for ended subscription")
+
+	active, err := account.HasActiveSubscription()
+	if err != nil {
+		return err
+	}
+	if active {
+		log.Info("billing account has another active subscription, not disabling any installations")
+		return nil
+	}
+
+	if err := account.DisableAllInstallations(); err != nil {
+		return err
+	}
+	wakeInstallationChanges()
+	log.Info("disabled all installations for ended subscription")
+	return nil
+}
+
+// trialWillEnd records the trial of subscription sub, in case it was changed,
+// and reminds the user or billing account the trial ends soon.
+func trialWillEnd(log *logrus.Entry, sub *stripe.Sub) error {
+	user, err := um.GetUserByStripeCustomerID(sub.Customer.ID)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return accountTrialWillEnd(log, sub)
+	}
+	if err := user.RecordStripeTrial(sub); err != nil {
+		return err
+	}
+	if err := user.SendTrialReminder(notifier, sub); err != nil {
+		return err
+	}
+	log.WithField("userID", user.UserID).Info("sent trial reminder")
+	return nil
+}
+
+// accountTrialWillEnd reminds the billing account of subscription sub the
+// trial ends soon.
+func accountTrialWillEnd(log *logrus.Entry, sub *stripe.Sub) error {
+	account, err := um.GetAccountByStripeCustomerID(sub.Customer.ID)
+	if err != nil {
+		return err
+	}
+	if account == nil {
+		log.Warn("no user or billing account found for stripe customer, not sending trial reminder")
+		return nil
+	}
+	if err := account.SendTrialReminder(notifier, sub); err != nil {
+		return err
+	}
+	log.WithField("billingAccountID", account.AccountID).Info("sent trial reminder")
+	return nil
+}
+
+// updateDunning starts the failed payment workflow for the customer's user or
+// billing account if pastDue is true, else ends the workflow.
+func updateDunning(log *logrus.Entry, customerID string, pastDue bool) error {
+	user, err := um.GetUserByStripeCustomerID(customerID)
+	if err != nil {
+		return err
+	}
+	if user != nil {
+		if pastDue {
+			return user.StartDunning(time.Now())
+		}
+		return user.EndDunning()
+	}
+
+	account, err := um.GetAccountByStripeCustomerID(customerID)
+	if err != nil {
+		return err
+	}
+	if account == nil {
+		log.Warn("no user or billing account found for stripe customer, not updating dunning")
+		return nil
+	}
+	if pastDue {
+		return account.StartDunning(time.Now())
+	}
+	return account.EndDunning()
+}
+
+// githubEventHandler handles GitHub App webhooks/events.
+func githubEventHandler(w http.ResponseWriter, r *http.Request) {
+	payload, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, githubMaxPayloadBytes))
+	if err != nil {
+		errorHandler(w, r, http.StatusBadRequest, "could not read github event")
+		return
+	}
+
+	// Check authenticity using the webhook's signature
+	signature := r.Header.Get(githubapp.SignatureHeader)
+	if signature == "" {
+		signature = r.Header.Get(githubapp.LegacySignatureHeader)
+	}
+	if err := githubWebhook.Verify(payload, signature); err != nil {
+		logger.WithError(err).Warn("could not verify github event")
+		errorHandler(w, r, http.StatusForbidden, "")
+		return
+	}
+
+	log := logger.WithFields(logrus.Fields{
+		"GitHubEventType":  r.Header.Get(githubapp.EventHeader),
+		"GitHubDeliveryID": r.Header.Get(githubapp.DeliveryHeader),
+	})
+
+	switch r.Header.Get(githubapp.EventHeader) {
+	case "installation":
+		event, err := githubapp.ParseInstallationEvent(payload)
+		if err != nil {
+			errorHandler(w, r, http.StatusBadRequest, "could not decode github event")
+			return
+		}
+		err = processInstallationEvent(log, event)
 		if err != nil {
-			errorHandler(w, r, http.StatusBadRequest, "could not unmarshal subscription event")
+			// GitHub records the failed delivery so it can be redelivered
+			log.WithError(err).Error("could not process installation event")
+			errorHandler(w, r, http.StatusInternalServerError, "")
 			return
 		}
-		log.WithField("StripeSubID", sub.ID).WithField("StripeCustomerID", sub.Customer.ID).Infof("subscription cancelled at %v", time.Unix(sub.PeriodEnd, 0))
+	case "installation_repositories":
+		event, err := githubapp.ParseInstallationRepositoriesEvent(payload)
+		if err != nil {
+			errorHandler(w, r, http.StatusBadRequest, "could not decode github event")
+			return
+		}
+		err = processInstallationRepositoriesEvent(log, event)
+		if err != nil {
+			log.WithError(err).Error("could not process installation_repositories event")
+			errorHandler(w, r, http.StatusInternalServerError, "")
+			return
+		}
+	default:
+		log.Info("ignoring github event")
+	}
+}
+
+// processInstallationRepositoriesEvent removes the exclusions of repositories
+// removed from an installation, so a repository removed and added again is
+// analysed like any other added repository, which are analysed until the user
+// excludes them.
+func processInstallationRepositoriesEvent(log *logrus.Entry, event *githubapp.InstallationRepositoriesEvent) error {
+	log = log.WithFields(logrus.Fields{
+		"installationID": event.Installation.ID,
+		"sender":         event.Sender,
+	})
+	for _, repo := range event.Added {
+		log.Infof("repository %v added to installation", repo.FullName)
+	}
+
+	var removed []int
+	for _, repo := range event.Removed {
+		removed = append(removed, repo.ID)
+		log.Infof("repository %v removed from installation", repo.FullName)
+	}
+	if err := gciClient.RemoveExcludedRepositories(event.Installation.ID, removed...); err != nil {
+		return errors.Wrap(err, "could not remove exclusions of removed repositories")
+	}
+	return nil
+}
+
+// processInstallationEvent keeps installations in sync with GitHub after the
+// App is installed, uninstalled, suspended or unsuspended.
+func processInstallationEvent(log *logrus.Entry, event *githubapp.InstallationEvent) error {
+	inst := event.Installation
+	log = log.WithFields(logrus.Fields{
+		"installationID": inst.ID,
+		"action":         event.Action,
+		"account":        inst.AccountLogin,
+		"sender":         event.Sender,
+	})
+
+	owner, err := um.GetInstallationOwner(inst.ID)
+	if err != nil {
+		return errors.Wrap(err, "could not get installation's owner")
+	}
+	account, err := um.GetInstallationAccount(inst.ID)
+	if err != nil {
+		return errors.Wrap(err, "could not get installation's billing account")
+	}
+	enabled := owner != nil || account != nil
+
+	switch event.Action {
+	case githubapp.ActionCreated:
+		log.Info("installation created")
+	case githubapp.ActionDeleted:
+		if !enabled {
+			log.Info("installation deleted, but was not enabled")
+			return nil
+		}
+		if err := um.RemoveInstallation(inst.ID); err != nil {
+			return err
+		}
+		wakeInstallationChanges()
+		log.Info("installation deleted, removed enabled installation")
+		if owner != nil {
+			return owner.SendUninstallNotice(notifier, inst.AccountLogin)
+		}
+		log.WithField("billingAccountID", account.AccountID).Info("installation was enabled by billing account, not sending uninstall notice")
+	case githubapp.ActionSuspend:
+		if !enabled {
+			log.Info("installation suspended, but was not enabled")
+			return nil
+		}
+		if err := um.QueueInstallationChange(inst.ID, false); err != nil {
+			return errors.Wrap(err, "could not queue suspended installation to be disabled")
+		}
+		wakeInstallationChanges()
+		log.Info("installation suspended, queued to be disabled in gopherci")
+	case githubapp.ActionUnsuspend:
+		if !enabled {
+			log.Info("installation unsuspended, but was not enabled")
+			return nil
+		}
+		// Only enabled if its user or billing account could enable it now,
+		// suspended installations may have since been disabled by billing.
+		resumed, err := um.ResumeInstallation(gciClient, time.Now(), inst.ID, inst.AccountID)
+		if qerr, ok := err.(*users.QuotaError); ok {
+			log.WithError(qerr).Info("installation unsuspended, but remains disabled")
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "could not resume unsuspended installation")
+		}
+		wakeInstallationChanges()
+		if !resumed {
+			log.Info("installation unsuspended, but throttled until the daily build limit resets")
+			return nil
+		}
+		log.Info("installation unsuspended, queued to be enabled in gopherci")
 	default:
-		log.Info(checkedEvent.Data.Obj)
+		log.Info("ignoring installation event")
 	}
+	return nil
 }
 
 // logoutHandler logs a user out, if logged in, and redirects to the home page.
@@ -167,6 +539,25 @@ func consoleIndexHandler(w http.ResponseWriter, r *http.Request) {
 		Name           string
 		CanDisable     bool // allows the user to disable the installation
 		State          string
+		BuildsToday    int // number of builds today, only set on enabled installations
+		// BillingAccount is true if the installation is enabled by the
+		// organisation's billing account, rather than a user.
+		BillingAccount bool
+		// BillingURL is the organisation's billing page, only set if the user
+		// is an admin of the organisation.
+		BillingURL string
+		// CanTransfer allows the user to transfer the installation to another
+		// user, as the user enabled it or is an admin of the organisation.
+		CanTransfer bool
+		// Owner is the email of the user who enabled the installation, if not
+		// this user.
+		Owner string
+		// Suspended is true if the installation is suspended on GitHub, only
+		// set on orphaned installations.
+		Suspended bool
+		// Pending is true if the installation has been enabled or disabled
+		// but the change has not yet been applied in GopherCI.
+		Pending bool
 	}
 	page := struct {
 		Title           string
@@ -174,7 +565,15 @@ func consoleIndexHandler(w http.ResponseWriter, r *http.Request) {
 		Installs        []install
 		HasSubscription bool
 		NewCustomer     bool
-	}{Title: "Console"}
+		BuildUsage      *users.BuildUsage
+		BuildsResetAt   time.Time
+		Dunning         *users.Dunning
+		TrialEndsAt     time.Time // TrialEndsAt is when the active subscription's trial ends, zero if not in trial.
+		Transfers       []users.Transfer
+		// RepoSelection is true if users can choose which repositories of
+		// their installations are analysed, which requires the GitHub App.
+		RepoSelection bool
+	}{Title: "Console", RepoSelection: githubApp != nil}
 
 	// Check if logged in
 	// TODO this should be a part of middleware
@@ -236,6 +635,9 @@ func consoleIndexHandler(w http.ResponseWriter, r *http.Request) {
 			Type:      "Organisation",
 			Name:      *m.Organization.Login,
 		}
+		if m.Role != nil && *m.Role == "admin" {
+			install.BillingURL = "/console/org/" + *m.Organization.Login + "/billing"
+		}
 
 		page.Installs = append(page.Installs, install)
 	}
@@ -249,6 +651,8 @@ func consoleIndexHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Compare User's installations with installations in GopherCI DB
+	accounts := make(map[int]*users.Account) // installationID => billing account
+	accountIDsByInstall := make(map[int]int) // installationID => github accountID
 	for i := range page.Installs {
 		page.Installs[i].State = "New"
 		for _, gciInstall := range gciInstalls {
@@ -260,29 +664,133 @@ func consoleIndexHandler(w http.ResponseWriter, r *http.Request) {
 			page.Installs[i].State = "Disabled"
 			if _, ok := enabledInstallations[gciInstall.InstallationID]; ok {
 				page.Installs[i].State = "Enabled"
+				page.Installs[i].CanDisable = true
+				page.Installs[i].CanTransfer = page.Installs[i].Type == "Organisation"
+				accountIDsByInstall[gciInstall.InstallationID] = gciInstall.AccountID
 
 				// remove installation to track which instalaltions are orphaned
 				delete(enabledInstallations, gciInstall.InstallationID)
+				continue
+			}
+
+			owner, err := um.GetInstallationOwner(gciInstall.InstallationID)
+			if err != nil {
+				logger.WithError(err).Error("could not get installation's owner")
+				errorHandler(w, r, http.StatusInternalServerError, "")
+				return
+			}
+			if owner != nil {
+				// Enabled by another user, organisation admins can transfer
+				// it to themselves or another user.
+				page.Installs[i].State = "Enabled"
+				page.Installs[i].Owner = owner.Email
+				page.Installs[i].CanTransfer = page.Installs[i].BillingURL != ""
+				continue
+			}
+
+			account, err := um.GetInstallationAccount(gciInstall.InstallationID)
+			if err != nil {
+				logger.WithError(err).Error("could not get installation's billing account")
+				errorHandler(w, r, http.StatusInternalServerError, "")
+				return
+			}
+			if account != nil {
+				accounts[gciInstall.InstallationID] = account
+				page.Installs[i].State = "Enabled"
+				page.Installs[i].BillingAccount = true
+				page.Installs[i].CanDisable = page.Installs[i].BillingURL != ""
 			}
 		}
 	}
 
-	// We also need to track if a user has cancelled a subscription, to disable
-	// all installations.
-
-	// Also need a script to check when an installation has been uninstalled
-	// the installation is disabled for the user.
+	// Installations enabled before their account was recorded are counted
+	// towards the plan's organisations until it's recorded.
+	if err := user.RecordInstallationAccounts(accountIDsByInstall); err != nil {
+		// Not critical, the accounts are recorded on the next visit
+		user.Logger.WithError(err).Error("could not record installation accounts")
+	}
 
 	// Installs enabled, but user no long has access to (i.e. removed from org)
 	for installationID := range enabledInstallations {
-		// Ideally GitHub would provide an API to get information about an installation
-		// without us having to track it ourselves.
-		page.Installs = append(page.Installs, install{
+		orphan := install{
 			InstallationID: installationID,
 			Type:           "Orphaned",
 			Name:           fmt.Sprintf("Unknown, Installation ID %v", installationID),
 			State:          "Enabled",
-		})
+			CanDisable:     true,
+		}
+		if githubApp != nil {
+			inst, err := githubApp.Installation(r.Context(), installationID)
+			switch {
+			case err != nil:
+				// Not critical, show the installation as unknown
+				logger.WithError(err).WithField("installationID", installationID).Error("could not get github app installation")
+			case inst == nil:
+				orphan.Name = fmt.Sprintf("Uninstalled, Installation ID %v", installationID)
+			default:
+				orphan.AccountID = inst.AccountID
+				orphan.Name = inst.AccountLogin
+				orphan.Suspended = inst.Suspended()
+			}
+		}
+		page.Installs = append(page.Installs, orphan)
+	}
+
+	var installationIDs []int
+	for _, install := range page.Installs {
+		if install.InstallationID != 0 {
+			installationIDs = append(installationIDs, install.InstallationID)
+		}
+	}
+	pending, err := um.PendingInstallationChanges(installationIDs...)
+	if err != nil {
+		logger.WithError(err).Error("could not get pending installation changes")
+		errorHandler(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	for i := range page.Installs {
+		page.Installs[i].Pending = pending[page.Installs[i].InstallationID]
+	}
+
+	// Builds used today, installations are disabled in GopherCI when the limit
+	// is reached, see builds:enforce command.
+	now := time.Now()
+	page.BuildUsage, err = user.BuildUsage(gciClient, now)
+	if err != nil {
+		user.Logger.WithError(err).Error("could not get build usage")
+		errorHandler(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	page.BuildsResetAt = gopherci.StartOfDay(now).AddDate(0, 0, 1)
+	for i := range page.Installs {
+		page.Installs[i].BuildsToday = page.BuildUsage.Installations[page.Installs[i].InstallationID]
+	}
+	for installationID, account := range accounts {
+		usage, err := account.BuildUsage(gciClient, now)
+		if err != nil {
+			account.Logger.WithError(err).Error("could not get build usage")
+			errorHandler(w, r, http.StatusInternalServerError, "")
+			return
+		}
+		for i := range page.Installs {
+			if page.Installs[i].InstallationID == installationID {
+				page.Installs[i].BuildsToday = usage.Installations[installationID]
+			}
+		}
+	}
+
+	page.Dunning, err = user.Dunning()
+	if err != nil {
+		user.Logger.WithError(err).Error("could not get dunning")
+		errorHandler(w, r, http.StatusInternalServerError, "")
+		return
+	}
+
+	page.Transfers, err = user.Transfers()
+	if err != nil {
+		user.Logger.WithError(err).Error("could not get installation transfers")
+		errorHandler(w, r, http.StatusInternalServerError, "")
+		return
 	}
 
 	customer, err := user.StripeCustomer()
@@ -296,6 +804,9 @@ func consoleIndexHandler(w http.ResponseWriter, r *http.Request) {
 		for _, sub := range subs {
 			if sub.CancelledAt.IsZero() {
 				page.HasSubscription = true
+				if sub.InTrial {
+					page.TrialEndsAt = sub.TrialEndsAt
+				}
 			}
 		}
 	}
@@ -318,18 +829,70 @@ func consoleInstallStateHandler(w http.ResponseWriter, r *http.Request) {
 
 	switch r.FormValue("state") {
 	case "enable":
-		err = user.EnableInstallation(installationID)
-		if err == nil {
-			err = gciClient.EnableInstallation(installationID)
+		var installation *gopherci.Installation
+		installation, err = gciClient.GetInstallation(installationID)
+		if err != nil {
+			logger.WithError(err).Error("could not get installation")
+			errorHandler(w, r, http.StatusInternalServerError, "")
+			return
 		}
-	case "disable":
-		if !user.InstallationEnabled(installationID) {
-			errorHandler(w, r, http.StatusForbidden, "Installation not enabled for this user")
+		if installation == nil {
+			errorHandler(w, r, http.StatusBadRequest, "Invalid installationID")
+			return
+		}
+		var owner *users.User
+		owner, err = um.GetInstallationOwner(installationID)
+		if err != nil {
+			logger.WithError(err).Error("could not get installation's owner")
+			errorHandler(w, r, http.StatusInternalServerError, "")
+			return
+		}
+		if owner != nil && owner.UserID != user.UserID {
+			errorHandler(w, r, http.StatusBadRequest, "Installation is already enabled by another user, it can be transferred to you by them or an organisation admin")
+			return
+		}
+		// Organisations with an active billing account are billed to the
+		// organisation, else the user's own subscription.
+		var account *users.Account
+		if installation.AccountID != user.GitHubID {
+			account, err = subscribedAccount(installation.AccountID)
+			if err != nil {
+				logger.WithError(err).Error("could not get billing account")
+				errorHandler(w, r, http.StatusInternalServerError, "")
+				return
+			}
+		}
+		if account != nil {
+			if !orgAdmin(w, r, user, account) {
+				return
+			}
+			err = account.EnableInstallation(installationID, user)
+		} else {
+			err = user.EnableInstallation(installationID, installation.AccountID)
+		}
+		if qerr, ok := err.(*users.QuotaError); ok {
+			errorHandler(w, r, http.StatusForbidden, qerr.Error())
 			return
 		}
-		err = user.DisableInstallation(installationID)
-		if err == nil {
-			err = gciClient.DisableInstallation(installationID)
+	case "disable":
+		if user.InstallationEnabled(installationID) {
+			err = user.DisableInstallation(installationID)
+		} else {
+			var account *users.Account
+			account, err = um.GetInstallationAccount(installationID)
+			if err != nil {
+				logger.WithError(err).Error("could not get installation's billing account")
+				errorHandler(w, r, http.StatusInternalServerError, "")
+				return
+			}
+			if account == nil {
+				errorHandler(w, r, http.StatusForbidden, "Installation not enabled for this user")
+				return
+			}
+			if !orgAdmin(w, r, user, account) {
+				return
+			}
+			err = account.DisableInstallation(installationID)
 		}
 	default:
 		errorHandler(w, r, http.StatusBadRequest, "Invalid state")
@@ -341,61 +904,421 @@ func consoleInstallStateHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	wakeInstallationChanges()
 	http.Redirect(w, r, "/console", http.StatusFound)
 }
 
-// consoleBillingHandler manages plans.
-func consoleBillingHandler(w http.ResponseWriter, r *http.Request) {
-	page := struct {
-		Title            string
-		Email            string
-		StripePublishKey string
-		Subscriptions    []users.Subscription
-		HasSubscription  bool
-		IsStripeCustomer bool
-		UpcomingInvoice  *users.Invoice
-		Discount         *users.Discount
-	}{Title: "Billing", StripePublishKey: os.Getenv("STRIPE_PUBLISH_KEY")}
-
+// consoleInstallTransferHandler transfers an installation enabled by a user to
+// the user with the GitHub login, who must be a member of the installation's
+// organisation org. Only the user who enabled the installation, or an admin of
+// the organisation, can transfer it.
+func consoleInstallTransferHandler(w http.ResponseWriter, r *http.Request) {
 	user := r.Context().Value(userCtxKey{}).(*users.User)
-	page.Email = user.Email
 
-	customer, err := user.StripeCustomer()
-	switch {
-	case err != nil:
-		user.Logger.WithError(err).Error("could not get stripe customer")
-		errorHandler(w, r, http.StatusInternalServerError, "")
+	i, err := strconv.ParseInt(r.FormValue("installationID"), 10, 64)
+	if err != nil {
+		errorHandler(w, r, http.StatusBadRequest, "Invalid installationID")
 		return
-	case customer != nil:
-		page.IsStripeCustomer = true
-		page.Discount = user.StripeDiscount(customer)
-		page.Subscriptions = user.StripeSubscriptions(customer)
-		for _, sub := range page.Subscriptions {
-			if sub.CancelledAt.IsZero() {
-				page.HasSubscription = true
-			}
-		}
 	}
+	installationID := int(i)
 
-	page.UpcomingInvoice, err = user.StripeUpcomingInvoice()
+	installation, err := gciClient.GetInstallation(installationID)
 	if err != nil {
-		user.Logger.WithError(err).Error("could not get upcoming invoice for customer")
+		logger.WithError(err).Error("could not get installation")
 		errorHandler(w, r, http.StatusInternalServerError, "")
 		return
 	}
-
-	if err := templates.ExecuteTemplate(w, "console-billing.tmpl", page); err != nil {
-		logger.WithError(err).Error("error parsing console-billing template")
+	if installation == nil {
+		errorHandler(w, r, http.StatusBadRequest, "Invalid installationID")
+		return
 	}
-}
-
-// consoleBillingProcessHandler processes the results of a payment (not the
-// payment itself).
-func consoleBillingProcessHandler(w http.ResponseWriter, r *http.Request) {
-	var (
-		planID = chi.URLParam(r, "planID")
-		user   = r.Context().Value(userCtxKey{}).(*users.User)
-	)
+
+	owner, err := um.GetInstallationOwner(installationID)
+	if err != nil {
+		logger.WithError(err).Error("could not get installation's owner")
+		errorHandler(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	if owner == nil {
+		errorHandler(w, r, http.StatusBadRequest, "Installation is not enabled by a user")
+		return
+	}
+	org := r.FormValue("org")
+	if owner.UserID != user.UserID {
+		admin, err := user.GitHubOrgAdmin(r.Context(), org)
+		if err != nil {
+			user.Logger.WithError(err).Error("could not get organisation membership")
+			errorHandler(w, r, http.StatusInternalServerError, "")
+			return
+		}
+		if admin == nil || admin.ID == nil || *admin.ID != installation.AccountID {
+			errorHandler(w, r, http.StatusForbidden, "Only the person who enabled the installation or organisation admins can transfer it")
+			return
+		}
+	}
+
+	login := r.FormValue("login")
+	ghUser, resp, err := user.GHClient.Users.Get(r.Context(), login)
+	switch {
+	case login == "" || resp != nil && resp.StatusCode == http.StatusNotFound:
+		errorHandler(w, r, http.StatusBadRequest, "Unknown GitHub user")
+		return
+	case err != nil:
+		user.Logger.WithError(err).Error("could not get github user")
+		errorHandler(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	to, err := um.GetUserByGitHubID(*ghUser.ID)
+	if err != nil {
+		logger.WithError(err).Error("could not get user by github id")
+		errorHandler(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	if to == nil {
+		errorHandler(w, r, http.StatusBadRequest, fmt.Sprintf("%s has not signed in to GopherCI", login))
+		return
+	}
+
+	err = owner.TransferInstallation(r.Context(), installationID, installation.AccountID, org, to, *ghUser.Login, user)
+	switch err := err.(type) {
+	case nil:
+	case *users.TransferError:
+		errorHandler(w, r, http.StatusBadRequest, err.Error())
+		return
+	case *users.QuotaError:
+		errorHandler(w, r, http.StatusBadRequest, fmt.Sprintf("%s cannot enable the installation: %s", login, err.Error()))
+		return
+	default:
+		logger.WithError(err).Error("could not transfer installation")
+		errorHandler(w, r, http.StatusInternalServerError, "")
+		return
+	}
+
+	http.Redirect(w, r, "/console", http.StatusFound)
+}
+
+// installationManager returns the installationID from the URL if the user
+// enabled it, or it's enabled by a billing account the user is an admin of,
+// else writes an error and returns false.
+func installationManager(w http.ResponseWriter, r *http.Request, user *users.User) (installationID int, ok bool) {
+	i, err := strconv.ParseInt(chi.URLParam(r, "installationID"), 10, 64)
+	if err != nil {
+		errorHandler(w, r, http.StatusBadRequest, "Invalid installationID")
+		return 0, false
+	}
+	installationID = int(i)
+	if user.InstallationEnabled(installationID) {
+		return installationID, true
+	}
+
+	account, err := um.GetInstallationAccount(installationID)
+	if err != nil {
+		logger.WithError(err).Error("could not get installation's billing account")
+		errorHandler(w, r, http.StatusInternalServerError, "")
+		return 0, false
+	}
+	if account == nil {
+		errorHandler(w, r, http.StatusForbidden, "Installation not enabled for this user")
+		return 0, false
+	}
+	return installationID, orgAdmin(w, r, user, account)
+}
+
+// consoleInstallReposHandler lists the repositories of an installation, and
+// whether GopherCI analyses each repository.
+func consoleInstallReposHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userCtxKey{}).(*users.User)
+
+	installationID, ok := installationManager(w, r, user)
+	if !ok {
+		return
+	}
+	if githubApp == nil {
+		errorHandler(w, r, http.StatusNotFound, "Repository selection requires the GitHub App to be configured")
+		return
+	}
+
+	type repo struct {
+		ID       int
+		FullName string
+		Included bool // Included is true if GopherCI analyses the repository.
+	}
+	page := struct {
+		Title          string
+		Email          string
+		InstallationID int
+		Repos          []repo
+	}{Title: "Repositories", Email: user.Email, InstallationID: installationID}
+
+	repos, err := githubApp.Repositories(r.Context(), installationID)
+	if err != nil {
+		logger.WithError(err).Error("could not list installation's repositories")
+		errorHandler(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	ids, err := gciClient.ExcludedRepositories(installationID)
+	if err != nil {
+		logger.WithError(err).Error("could not get excluded repositories")
+		errorHandler(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	excluded := make(map[int]bool)
+	for _, repositoryID := range ids {
+		excluded[repositoryID] = true
+	}
+	for _, ghRepo := range repos {
+		page.Repos = append(page.Repos, repo{ID: ghRepo.ID, FullName: ghRepo.FullName, Included: !excluded[ghRepo.ID]})
+	}
+
+	if err := templates.ExecuteTemplate(w, "console-install-repos.tmpl", page); err != nil {
+		logger.WithError(err).Error("error parsing console-install-repos template")
+	}
+}
+
+// consoleInstallReposProcessHandler records which repositories of an
+// installation GopherCI analyses, repositories of the installation not
+// included in the form are excluded.
+func consoleInstallReposProcessHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userCtxKey{}).(*users.User)
+
+	installationID, ok := installationManager(w, r, user)
+	if !ok {
+		return
+	}
+	if githubApp == nil {
+		errorHandler(w, r, http.StatusNotFound, "Repository selection requires the GitHub App to be configured")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		errorHandler(w, r, http.StatusBadRequest, "Invalid form")
+		return
+	}
+	included := make(map[int]bool)
+	for _, value := range r.PostForm["repositoryID"] {
+		repositoryID, err := strconv.Atoi(value)
+		if err != nil {
+			errorHandler(w, r, http.StatusBadRequest, "Invalid repositoryID")
+			return
+		}
+		included[repositoryID] = true
+	}
+
+	// Only repositories the installation has access to are excluded, so a
+	// user cannot exclude another installation's repositories.
+	repos, err := githubApp.Repositories(r.Context(), installationID)
+	if err != nil {
+		logger.WithError(err).Error("could not list installation's repositories")
+		errorHandler(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	var excluded []int
+	for _, repo := range repos {
+		if !included[repo.ID] {
+			excluded = append(excluded, repo.ID)
+		}
+	}
+	if err := gciClient.SetExcludedRepositories(installationID, excluded); err != nil {
+		logger.WithError(err).Error("could not set excluded repositories")
+		errorHandler(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	user.Logger.WithField("installationID", installationID).Infof("excluded %d of %d repositories", len(excluded), len(repos))
+
+	http.Redirect(w, r, fmt.Sprintf("/console/install/%d/repositories", installationID), http.StatusFound)
+}
+
+// installationRepository returns the repository with the repositoryID from
+// the URL if installationID has access to it, else writes an error and
+// returns false.
+func installationRepository(w http.ResponseWriter, r *http.Request, installationID int) (repo githubapp.Repository, ok bool) {
+	if githubApp == nil {
+		errorHandler(w, r, http.StatusNotFound, "Repository configuration requires the GitHub App to be configured")
+		return repo, false
+	}
+	repositoryID, err := strconv.Atoi(chi.URLParam(r, "repositoryID"))
+	if err != nil {
+		errorHandler(w, r, http.StatusBadRequest, "Invalid repositoryID")
+		return repo, false
+	}
+	repos, err := githubApp.Repositories(r.Context(), installationID)
+	if err != nil {
+		logger.WithError(err).Error("could not list installation's repositories")
+		errorHandler(w, r, http.StatusInternalServerError, "")
+		return repo, false
+	}
+	for _, repo := range repos {
+		if repo.ID == repositoryID {
+			return repo, true
+		}
+	}
+	errorHandler(w, r, http.StatusNotFound, "Repository not found in this installation")
+	return repo, false
+}
+
+// consoleRepoToolsHandler shows the configuration of each tool for a
+// repository.
+func consoleRepoToolsHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userCtxKey{}).(*users.User)
+
+	installationID, ok := installationManager(w, r, user)
+	if !ok {
+		return
+	}
+	repo, ok := installationRepository(w, r, installationID)
+	if !ok {
+		return
+	}
+
+	type tool struct {
+		ToolID  int
+		Name    string
+		URL     string
+		Enabled bool
+		Args    string // Args are the configured arguments, or the tool's default arguments.
+	}
+	page := struct {
+		Title          string
+		Email          string
+		InstallationID int
+		Repo           githubapp.Repository
+		Tools          []tool
+	}{Title: "Tools", Email: user.Email, InstallationID: installationID, Repo: repo}
+
+	tools, err := gciClient.ListTools()
+	if err != nil {
+		logger.WithError(err).Error("could not list tools")
+		errorHandler(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	configs, err := gciClient.RepositoryTools(repo.ID)
+	if err != nil {
+		logger.WithError(err).Error("could not get repository tools")
+		errorHandler(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	configured := make(map[int]gopherci.RepositoryTool)
+	for _, config := range configs {
+		configured[config.ToolID] = config
+	}
+	for _, t := range tools {
+		pt := tool{ToolID: t.ToolID, Name: t.Name, URL: t.URL, Enabled: true, Args: t.Args}
+		if config, ok := configured[t.ToolID]; ok {
+			pt.Enabled, pt.Args = config.Enabled, config.Args
+		}
+		page.Tools = append(page.Tools, pt)
+	}
+
+	if err := templates.ExecuteTemplate(w, "console-repo-tools.tmpl", page); err != nil {
+		logger.WithError(err).Error("error parsing console-repo-tools template")
+	}
+}
+
+// consoleRepoToolsProcessHandler saves the configuration of each tool for a
+// repository.
+func consoleRepoToolsProcessHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userCtxKey{}).(*users.User)
+
+	installationID, ok := installationManager(w, r, user)
+	if !ok {
+		return
+	}
+	repo, ok := installationRepository(w, r, installationID)
+	if !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		errorHandler(w, r, http.StatusBadRequest, "Invalid form")
+		return
+	}
+
+	var configs []gopherci.RepositoryTool
+	for _, value := range r.PostForm["toolID"] {
+		toolID, err := strconv.Atoi(value)
+		if err != nil {
+			errorHandler(w, r, http.StatusBadRequest, "Invalid toolID")
+			return
+		}
+		configs = append(configs, gopherci.RepositoryTool{
+			ToolID:  toolID,
+			Enabled: r.PostFormValue(fmt.Sprintf("enabled-%d", toolID)) != "",
+			Args:    strings.TrimSpace(r.PostFormValue(fmt.Sprintf("args-%d", toolID))),
+		})
+	}
+
+	err := gciClient.SetRepositoryTools(repo.ID, configs)
+	if cerr, ok := err.(*gopherci.ConfigError); ok {
+		errorHandler(w, r, http.StatusBadRequest, cerr.Error())
+		return
+	}
+	if err != nil {
+		logger.WithError(err).Error("could not set repository tools")
+		errorHandler(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	user.Logger.WithField("repositoryID", repo.ID).Infof("configured %d tools", len(configs))
+
+	http.Redirect(w, r, fmt.Sprintf("/console/install/%d/repositories/%d/tools", installationID, repo.ID), http.StatusFound)
+}
+
+// subscribedAccount returns the billing account of the GitHub organisation
+// with githubID, or nil if the organisation has no billing account with an
+// active subscription.
+func subscribedAccount(githubID int) (*users.Account, error) {
+	account, err := um.GetAccount(githubID)
+	if err != nil || account == nil {
+		return nil, err
+	}
+	active, err := account.HasActiveSubscription()
+	if err != nil || !active {
+		return nil, err
+	}
+	return account, nil
+}
+
+// orgAdmin returns true if user is an admin of account's organisation, else
+// an error page is written and false is returned.
+func orgAdmin(w http.ResponseWriter, r *http.Request, user *users.User, account *users.Account) bool {
+	org, err := user.GitHubOrgAdmin(r.Context(), account.Login)
+	if err != nil {
+		user.Logger.WithError(err).Error("could not get organisation membership")
+		errorHandler(w, r, http.StatusInternalServerError, "")
+		return false
+	}
+	if org == nil {
+		errorHandler(w, r, http.StatusForbidden, "Only organisation admins can manage installations billed to the organisation")
+		return false
+	}
+	return true
+}
+
+// consoleBillingHandler manages plans.
+func consoleBillingHandler(w http.ResponseWriter, r *http.Request) {
+	page := struct {
+		Title            string
+		Email            string
+		StripePublishKey string
+		Subscriptions    []users.Subscription
+		HasSubscription  bool
+		IsStripeCustomer bool
+		UpcomingInvoice  *users.Invoice
+		Invoices         []users.Invoice
+		InvoicesAfter    string // InvoicesAfter is the invoice ID the page of invoices starts after.
+		// OlderInvoicesAfter is the invoice ID the next page of older
+		// invoices starts after, blank if there are no older invoices.
+		OlderInvoicesAfter string
+		Discount           *users.Discount
+		CurrentPlanID      string
+		Card               *users.Card
+		CardExpiring       bool
+		Dunning            *users.Dunning
+		Interval           string          // Interval is the billing interval of Plans.
+		Intervals          []string        // Intervals is all billing intervals with offered plans.
+		Plans              []payments.Plan // Plans is the offered plans billed every Interval.
+	}{Title: "Billing", StripePublishKey: os.Getenv("STRIPE_PUBLISH_KEY"), Interval: pricingInterval(r), Intervals: catalogue.Intervals()}
+	page.Plans = catalogue.Offered(page.Interval)
+
+	user := r.Context().Value(userCtxKey{}).(*users.User)
+	page.Email = user.Email
 
 	customer, err := user.StripeCustomer()
 	switch {
@@ -404,19 +1327,111 @@ func consoleBillingProcessHandler(w http.ResponseWriter, r *http.Request) {
 		errorHandler(w, r, http.StatusInternalServerError, "")
 		return
 	case customer != nil:
-		// Ensure customer does not have any current subscriptions until we have the
-		// ability to prorata subscriptions.
-		subs := user.StripeSubscriptions(customer)
-		for _, sub := range subs {
-			if sub.CancelledAt.IsZero() {
-				// TODO flash message
-				errorHandler(w, r, http.StatusBadRequest, "active subscription already exists")
+		page.IsStripeCustomer = true
+		page.Discount = user.StripeDiscount(customer)
+		page.Subscriptions = user.StripeSubscriptions(customer)
+		if sub := user.ActiveStripeSubscription(customer); sub != nil {
+			page.HasSubscription = true
+			page.CurrentPlanID = sub.PlanID
+		}
+		if page.Card = user.StripeDefaultCard(customer); page.Card != nil {
+			page.CardExpiring = page.Card.ExpiresWithin(time.Now(), cardExpiryWarning)
+		}
+	}
+
+	page.Dunning, err = user.Dunning()
+	if err != nil {
+		user.Logger.WithError(err).Error("could not get dunning")
+		errorHandler(w, r, http.StatusInternalServerError, "")
+		return
+	}
+
+	page.UpcomingInvoice, err = user.StripeUpcomingInvoice()
+	if err != nil {
+		user.Logger.WithError(err).Error("could not get upcoming invoice for customer")
+		errorHandler(w, r, http.StatusInternalServerError, "")
+		return
+	}
+
+	page.InvoicesAfter = r.URL.Query().Get("invoicesAfter")
+	invoices, more, err := user.StripeInvoices(page.InvoicesAfter, invoicesPerPage)
+	if err != nil {
+		user.Logger.WithError(err).Error("could not get invoices for customer")
+		errorHandler(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	page.Invoices = invoices
+	if more && len(invoices) > 0 {
+		page.OlderInvoicesAfter = invoices[len(invoices)-1].ID
+	}
+
+	if err := templates.ExecuteTemplate(w, "console-billing.tmpl", page); err != nil {
+		logger.WithError(err).Error("error parsing console-billing template")
+	}
+}
+
+// invoicesPerPage is the number of previous invoices shown on each page of
+// the billing console.
+const invoicesPerPage = 10
+
+// consoleBillingInvoicesCSVHandler exports all the user's previous invoices
+// in CSV format.
+func consoleBillingInvoicesCSVHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userCtxKey{}).(*users.User)
+
+	invoices, err := user.AllStripeInvoices()
+	if err != nil {
+		user.Logger.WithError(err).Error("could not get all invoices for customer")
+		errorHandler(w, r, http.StatusInternalServerError, "")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="gopherci-invoices.csv"`)
+	if err := users.WriteInvoicesCSV(w, invoices); err != nil {
+		user.Logger.WithError(err).Error("could not write invoices csv")
+	}
+}
+
+// consoleBillingProcessHandler processes the results of a payment (not the
+// payment itself).
+func consoleBillingProcessHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		planID = chi.URLParam(r, "planID")
+		user   = r.Context().Value(userCtxKey{}).(*users.User)
+	)
+
+	if plan, ok := catalogue.Plan(planID); !ok || !plan.Offered {
+		errorHandler(w, r, http.StatusBadRequest, "Unknown plan")
+		return
+	}
+
+	customer, err := user.StripeCustomer()
+	switch {
+	case err != nil:
+		user.Logger.WithError(err).Error("could not get stripe customer")
+		errorHandler(w, r, http.StatusInternalServerError, "")
+		return
+	case customer != nil:
+		// Customers with an active subscription must change their plan, which
+		// prorates the existing subscription. A cancelled subscription remains
+		// active until it ends, so a new subscription would overlap it.
+		if users.HasActiveSubscription(customer) {
+			// TODO flash message
+			if user.ActiveStripeSubscription(customer) == nil {
+				errorHandler(w, r, http.StatusBadRequest, "cancelled subscription has not yet ended, subscribe again after it ends")
 				return
 			}
+			errorHandler(w, r, http.StatusBadRequest, "active subscription already exists, change plans instead")
+			return
 		}
 	}
 
-	err = user.ProcessStripePayment(r.FormValue("stripeToken"), planID)
+	err = user.ProcessStripePayment(r.FormValue("stripeToken"), planID, r.FormValue("couponID"))
+	if cerr, ok := errors.Cause(err).(*users.CouponError); ok {
+		errorHandler(w, r, http.StatusBadRequest, cerr.Error())
+		return
+	}
 	if err != nil {
 		logger.WithError(err).Error("could not process stripe payment")
 		errorHandler(w, r, http.StatusInternalServerError, "")
@@ -428,6 +1443,126 @@ func consoleBillingProcessHandler(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/console?success=1", http.StatusFound)
 }
 
+// consoleBillingChangeHandler previews changing the active subscription to a
+// different plan, the user must confirm the change.
+func consoleBillingChangeHandler(w http.ResponseWriter, r *http.Request) {
+	page := struct {
+		Title   string
+		Email   string
+		Current *users.Subscription
+		Plan    payments.Plan
+		Preview *users.ProrationPreview
+	}{Title: "Change Plan"}
+
+	user := r.Context().Value(userCtxKey{}).(*users.User)
+	page.Email = user.Email
+
+	plan, current, ok := planChange(w, r, user)
+	if !ok {
+		return
+	}
+	page.Plan, page.Current = plan, current
+
+	var err error
+	page.Preview, err = user.PreviewStripePlanChange(current.ID, plan.ID, time.Now())
+	if err != nil {
+		user.Logger.WithError(err).Error("could not preview plan change")
+		errorHandler(w, r, http.StatusInternalServerError, "")
+		return
+	}
+
+	if err := templates.ExecuteTemplate(w, "console-billing-change.tmpl", page); err != nil {
+		logger.WithError(err).Error("error parsing console-billing-change template")
+	}
+}
+
+// consoleBillingChangeProcessHandler changes the active subscription to a
+// different plan, prorating the difference as previewed.
+func consoleBillingChangeProcessHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userCtxKey{}).(*users.User)
+
+	plan, current, ok := planChange(w, r, user)
+	if !ok {
+		return
+	}
+
+	if current.ID != r.FormValue("subscriptionID") {
+		errorHandler(w, r, http.StatusBadRequest, "Subscription has changed since the preview, please try again")
+		return
+	}
+
+	// Use the same proration date as the preview so the user is charged the
+	// previewed amount, but don't accept stale previews.
+	unix, err := strconv.ParseInt(r.FormValue("prorationDate"), 10, 64)
+	if err != nil {
+		errorHandler(w, r, http.StatusBadRequest, "Invalid prorationDate")
+		return
+	}
+	prorationDate := time.Unix(unix, 0)
+	if age := time.Since(prorationDate); age < 0 || age > time.Hour {
+		http.Redirect(w, r, "/console/billing/change/"+plan.ID, http.StatusFound)
+		return
+	}
+
+	err = user.ChangeStripePlan(current.ID, plan.ID, prorationDate)
+	if err != nil {
+		user.Logger.WithError(err).Error("could not change stripe plan")
+		errorHandler(w, r, http.StatusInternalServerError, "")
+		return
+	}
+
+	user.Logger.Infof("changed stripe subscription %q from plan %q to %q", current.ID, current.PlanID, plan.ID)
+
+	http.Redirect(w, r, "/console/billing", http.StatusFound)
+}
+
+// planChange validates the user can change their active subscription to the
+// plan in the planID URL parameter, if ok is false an error has already been
+// written to w.
+func planChange(w http.ResponseWriter, r *http.Request, user *users.User) (plan payments.Plan, current *users.Subscription, ok bool) {
+	plan, ok = catalogue.Plan(chi.URLParam(r, "planID"))
+	if !ok || !plan.Offered {
+		errorHandler(w, r, http.StatusBadRequest, "Unknown plan")
+		return plan, nil, false
+	}
+
+	customer, err := user.StripeCustomer()
+	switch {
+	case err != nil:
+		user.Logger.WithError(err).Error("could not get stripe customer")
+		errorHandler(w, r, http.StatusInternalServerError, "")
+		return plan, nil, false
+	case customer == nil:
+		errorHandler(w, r, http.StatusBadRequest, "Not a stripe customer")
+		return plan, nil, false
+	}
+
+	current = user.ActiveStripeSubscription(customer)
+	switch {
+	case current == nil:
+		errorHandler(w, r, http.StatusBadRequest, "No active subscription to change")
+		return plan, nil, false
+	case current.PlanID == plan.ID:
+		errorHandler(w, r, http.StatusBadRequest, "Already subscribed to this plan")
+		return plan, nil, false
+	}
+
+	// Enabled installations must fit within the new plan's limits
+	if plan.Organisations != payments.Unlimited {
+		organisations, err := user.EnabledOrganisations()
+		if err != nil {
+			user.Logger.WithError(err).Error("could not count enabled organisations")
+			errorHandler(w, r, http.StatusInternalServerError, "")
+			return plan, nil, false
+		}
+		if organisations > plan.Organisations {
+			errorHandler(w, r, http.StatusBadRequest, fmt.Sprintf("The %s plan is limited to %d organisations, disable %d organisations before changing plans", plan.Name, plan.Organisations, organisations-plan.Organisations))
+			return plan, nil, false
+		}
+	}
+	return plan, current, true
+}
+
 // consoleBillingCancelHandler cancels a subscription.
 func consoleBillingCancelHandler(w http.ResponseWriter, r *http.Request) {
 	user := r.Context().Value(userCtxKey{}).(*users.User)
@@ -464,13 +1599,130 @@ func consoleBillingCancelHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// TODO disable all integrations at sub.PeriodEnd #7
+	// Installations are disabled when stripe sends the
+	// customer.subscription.deleted event at the end of the period, see
+	// stripeEventHandler.
 
 	user.Logger.Infof("cancelled stripe subscription subscriptionID %q", r.Form.Get("subscriptionID"))
 
 	http.Redirect(w, r, "/console/billing", http.StatusFound)
 }
 
+// cardExpiryWarning is how long before a card expires the user is warned to
+// update their payment method.
+const cardExpiryWarning = 30 * 24 * time.Hour
+
+// consoleBillingPaymentMethodHandler shows the default card and allows the
+// user to replace it.
+func consoleBillingPaymentMethodHandler(w http.ResponseWriter, r *http.Request) {
+	page := struct {
+		Title            string
+		Email            string
+		StripePublishKey string
+		Card             *users.Card
+		CardExpiring     bool
+	}{Title: "Payment Method", StripePublishKey: os.Getenv("STRIPE_PUBLISH_KEY")}
+
+	user := r.Context().Value(userCtxKey{}).(*users.User)
+	page.Email = user.Email
+
+	customer, err := user.StripeCustomer()
+	switch {
+	case err != nil:
+		user.Logger.WithError(err).Error("could not get stripe customer")
+		errorHandler(w, r, http.StatusInternalServerError, "")
+		return
+	case customer == nil:
+		errorHandler(w, r, http.StatusBadRequest, "Not a stripe customer")
+		return
+	}
+
+	if page.Card = user.StripeDefaultCard(customer); page.Card != nil {
+		page.CardExpiring = page.Card.ExpiresWithin(time.Now(), cardExpiryWarning)
+	}
+
+	if err := templates.ExecuteTemplate(w, "console-billing-payment-method.tmpl", page); err != nil {
+		logger.WithError(err).Error("error parsing console-billing-payment-method template")
+	}
+}
+
+// consoleBillingPaymentMethodProcessHandler replaces the default card with
+// the card from stripe checkout, without changing any subscriptions.
+func consoleBillingPaymentMethodProcessHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userCtxKey{}).(*users.User)
+
+	if user.StripeCustomerID == "" {
+		errorHandler(w, r, http.StatusBadRequest, "Not a stripe customer")
+		return
+	}
+
+	err := user.UpdateStripeCard(r.FormValue("stripeToken"))
+	if err != nil {
+		user.Logger.WithError(err).Error("could not update stripe card")
+		errorHandler(w, r, http.StatusBadRequest, "Cannot update card, please try again")
+		return
+	}
+
+	user.Logger.Info("updated stripe default card")
+
+	http.Redirect(w, r, "/console/billing/payment-method", http.StatusFound)
+}
+
+// consoleBillingCouponPreviewHandler validates a coupon and previews the
+// price of a plan after the coupon's discount. Customers with an active
+// subscription preview their current plan and confirm applying the coupon,
+// other users preview the planID plan and redeem the coupon at checkout.
+func consoleBillingCouponPreviewHandler(w http.ResponseWriter, r *http.Request) {
+	page := struct {
+		Title            string
+		Email            string
+		StripePublishKey string
+		HasSubscription  bool
+		Preview          *users.CouponPreview
+	}{Title: "Coupon", StripePublishKey: os.Getenv("STRIPE_PUBLISH_KEY")}
+
+	user := r.Context().Value(userCtxKey{}).(*users.User)
+	page.Email = user.Email
+
+	customer, err := user.StripeCustomer()
+	if err != nil {
+		user.Logger.WithError(err).Error("could not get stripe customer")
+		errorHandler(w, r, http.StatusInternalServerError, "")
+		return
+	}
+
+	planID := r.FormValue("planID")
+	if customer != nil {
+		if user.StripeDiscount(customer) != nil {
+			errorHandler(w, r, http.StatusBadRequest, "Existing discount already exists")
+			return
+		}
+		if sub := user.ActiveStripeSubscription(customer); sub != nil {
+			page.HasSubscription = true
+			planID = sub.PlanID
+		}
+	}
+	if _, ok := catalogue.Plan(planID); !ok {
+		errorHandler(w, r, http.StatusBadRequest, "Unknown plan")
+		return
+	}
+
+	page.Preview, err = user.PreviewStripeCoupon(r.FormValue("couponID"), planID)
+	if cerr, ok := errors.Cause(err).(*users.CouponError); ok {
+		errorHandler(w, r, http.StatusBadRequest, cerr.Error())
+		return
+	}
+	if err != nil {
+		user.Logger.WithError(err).Error("could not preview stripe coupon")
+		errorHandler(w, r, http.StatusInternalServerError, "")
+		return
+	}
+
+	if err := templates.ExecuteTemplate(w, "console-billing-coupon.tmpl", page); err != nil {
+		logger.WithError(err).Error("error parsing console-billing-coupon template")
+	}
+}
+
 // consoleBillingCouponHandler adds coupons to an account.
 func consoleBillingCouponHandler(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
@@ -495,7 +1747,18 @@ func consoleBillingCouponHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = user.ProcessStripeCoupon(couponID)
+	// Coupons for users without a subscription are redeemed at checkout
+	sub := user.ActiveStripeSubscription(customer)
+	if sub == nil {
+		errorHandler(w, r, http.StatusBadRequest, "No active subscription to apply coupon to")
+		return
+	}
+
+	err = user.ProcessStripeCoupon(couponID, sub.PlanID)
+	if cerr, ok := errors.Cause(err).(*users.CouponError); ok {
+		errorHandler(w, r, http.StatusBadRequest, cerr.Error())
+		return
+	}
 	if err != nil {
 		user.Logger.WithError(err).Error("could not process/apply stripe coupon")
 		errorHandler(w, r, http.StatusBadRequest, "Cannot apply coupon")
@@ -506,3 +1769,168 @@ func consoleBillingCouponHandler(w http.ResponseWriter, r *http.Request) {
 
 	http.Redirect(w, r, "/console/billing", http.StatusFound)
 }
+
+// orgAccount returns the billing account of the GitHub organisation in the
+// URL, creating the account if it does not exist. If the user is not an admin
+// of the organisation an error page is written and ok is false.
+func orgAccount(w http.ResponseWriter, r *http.Request, user *users.User) (account *users.Account, ok bool) {
+	org, err := user.GitHubOrgAdmin(r.Context(), chi.URLParam(r, "login"))
+	if err != nil {
+		user.Logger.WithError(err).Error("could not get organisation membership")
+		errorHandler(w, r, http.StatusInternalServerError, "")
+		return nil, false
+	}
+	if org == nil {
+		errorHandler(w, r, http.StatusForbidden, "Only organisation admins can manage the organisation's billing")
+		return nil, false
+	}
+	account, err = um.GetOrCreateAccount(*org.ID, *org.Login)
+	if err != nil {
+		user.Logger.WithError(err).Error("could not get billing account")
+		errorHandler(w, r, http.StatusInternalServerError, "")
+		return nil, false
+	}
+	return account, true
+}
+
+// consoleOrgBillingHandler manages the plans of an organisation's billing
+// account.
+func consoleOrgBillingHandler(w http.ResponseWriter, r *http.Request) {
+	page := struct {
+		Title            string
+		Email            string
+		StripePublishKey string
+		Login            string // Login is the organisation's GitHub login.
+		Subscriptions    []users.Subscription
+		HasSubscription  bool
+		CurrentPlanID    string
+		Interval         string          // Interval is the billing interval of Plans.
+		Intervals        []string        // Intervals is all billing intervals with offered plans.
+		Plans            []payments.Plan // Plans is the offered plans billed every Interval.
+		// MemberInstallations are the organisation's installations billed to
+		// the members who enabled them, they're taken over if enabled for the
+		// organisation.
+		MemberInstallations []users.MemberInstallation
+	}{Title: "Organisation Billing", StripePublishKey: os.Getenv("STRIPE_PUBLISH_KEY"), Interval: pricingInterval(r), Intervals: catalogue.Intervals()}
+	page.Plans = catalogue.Offered(page.Interval)
+
+	user := r.Context().Value(userCtxKey{}).(*users.User)
+	page.Email = user.Email
+
+	account, ok := orgAccount(w, r, user)
+	if !ok {
+		return
+	}
+	page.Login = account.Login
+
+	customer, err := account.StripeCustomer()
+	switch {
+	case err != nil:
+		account.Logger.WithError(err).Error("could not get stripe customer")
+		errorHandler(w, r, http.StatusInternalServerError, "")
+		return
+	case customer != nil:
+		page.Subscriptions = account.StripeSubscriptions(customer)
+		if sub := account.ActiveStripeSubscription(customer); sub != nil {
+			page.HasSubscription = true
+			page.CurrentPlanID = sub.PlanID
+		}
+	}
+
+	page.MemberInstallations, err = account.MemberInstallations()
+	if err != nil {
+		account.Logger.WithError(err).Error("could not get installations enabled by members")
+		errorHandler(w, r, http.StatusInternalServerError, "")
+		return
+	}
+
+	if err := templates.ExecuteTemplate(w, "console-org-billing.tmpl", page); err != nil {
+		logger.WithError(err).Error("error parsing console-org-billing template")
+	}
+}
+
+// consoleOrgBillingProcessHandler processes the results of a payment for an
+// organisation's billing account.
+func consoleOrgBillingProcessHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		planID = chi.URLParam(r, "planID")
+		user   = r.Context().Value(userCtxKey{}).(*users.User)
+	)
+
+	if plan, ok := catalogue.Plan(planID); !ok || !plan.Offered {
+		errorHandler(w, r, http.StatusBadRequest, "Unknown plan")
+		return
+	}
+
+	account, ok := orgAccount(w, r, user)
+	if !ok {
+		return
+	}
+
+	active, err := account.HasActiveSubscription()
+	switch {
+	case err != nil:
+		account.Logger.WithError(err).Error("could not get subscription")
+		errorHandler(w, r, http.StatusInternalServerError, "")
+		return
+	case active:
+		errorHandler(w, r, http.StatusBadRequest, "active subscription already exists")
+		return
+	}
+
+	if err := account.ProcessStripePayment(r.FormValue("stripeToken"), planID, user.Email); err != nil {
+		account.Logger.WithError(err).Error("could not process stripe payment")
+		errorHandler(w, r, http.StatusInternalServerError, "")
+		return
+	}
+
+	account.Logger.WithField("userID", user.UserID).Infof("processed stripe subscription on plan %q", planID)
+
+	http.Redirect(w, r, "/console", http.StatusFound)
+}
+
+// consoleOrgBillingCancelHandler cancels a subscription of an organisation's
+// billing account.
+func consoleOrgBillingCancelHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userCtxKey{}).(*users.User)
+
+	account, ok := orgAccount(w, r, user)
+	if !ok {
+		return
+	}
+
+	customer, err := account.StripeCustomer()
+	switch {
+	case err != nil:
+		account.Logger.WithError(err).Error("could not get stripe customer")
+		errorHandler(w, r, http.StatusInternalServerError, "")
+		return
+	case customer == nil:
+		errorHandler(w, r, http.StatusBadRequest, "Not a stripe customer")
+		return
+	}
+
+	subscriptionID := r.FormValue("subscriptionID")
+	var found bool
+	for _, sub := range account.StripeSubscriptions(customer) {
+		found = found || sub.ID == subscriptionID
+	}
+	if !found {
+		errorHandler(w, r, http.StatusBadRequest, "could not find subscription ID")
+		return
+	}
+
+	if err := account.CancelStripeSubscription(subscriptionID); err != nil {
+		account.Logger.WithError(err).Error("could not cancel stripe subscription")
+		errorHandler(w, r, http.StatusInternalServerError, "")
+		return
+	}
+
+	// Installations are disabled when stripe sends the
+	// customer.subscription.deleted event at the end of the period, see
+	// stripeEventHandler.
+
+	account.Logger.WithField("userID", user.UserID).Infof("cancelled stripe subscription subscriptionID %q", subscriptionID)
+
+	http.Redirect(w, r, "/console/org/"+account.Login+"/billing", http.StatusFound)
+}
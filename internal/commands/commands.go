@@ -2,25 +2,37 @@ package commands
 
 import (
 	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/bradleyfalzon/gopherci-web/internal/gopherci"
+	"github.com/bradleyfalzon/gopherci-web/internal/notify"
+	"github.com/bradleyfalzon/gopherci-web/internal/payments"
+	"github.com/bradleyfalzon/gopherci-web/internal/users"
 	"github.com/pkg/errors"
 	migrate "github.com/rubenv/sql-migrate"
 	stripe "github.com/stripe/stripe-go"
-	"github.com/stripe/stripe-go/customer"
+	"github.com/stripe/stripe-go/client"
 )
 
 // Command represents a single command to be executed and then for the process
 // to end.
 type Command struct {
 	logger *logrus.Logger
+	out    io.Writer // out is where reports are written
+	stripe *client.API
 }
 
-// NewCommand returns a Command with db and logger attached.
-func NewCommand() *Command {
+// NewCommand returns a Command with logger and stripe client attached.
+func NewCommand(stripeClient *client.API) *Command {
 	logger := logrus.New()
 	logger.Level = logrus.WarnLevel
-	return &Command{logger: logger}
+	return &Command{logger: logger, out: os.Stdout, stripe: stripeClient}
 }
 
 // Migrate migrates the database using migrations in migrations/ directory. If
@@ -40,61 +52,465 @@ func (c *Command) Migrate(db *sql.DB, driver string, direction migrate.Migration
 	}
 }
 
-// BillingCheck checks stripe billing for descrepencies.
-func (c *Command) BillingCheck(stripeSecretKey string) {
-	stripe.Key = stripeSecretKey
-	stripe.LogLevel = 1
+// BillingCheck checks stripe customers against users and billing accounts for
+// discrepancies and writes a report to stdout. args may contain --format=json
+// for a JSON report instead of text, and --fix to fix discrepancies which are
+// safe to fix automatically, such as disabling installations of users and
+// billing accounts without an active subscription.
+func (c *Command) BillingCheck(um *users.UserManager, gci *gopherci.Client, args []string) {
+	format, fix := c.reportFlags("billing:check", "fix", "fix discrepancies which are safe to fix", args)
 
-	// Find single stripe customers with multiple subscriptions
-	{
-		customers := customer.List(nil)
-		for customers.Next() {
-			customer := customers.Customer()
+	var customers []*stripe.Customer
+	i := c.stripe.Customers.List(nil)
+	for i.Next() {
+		customers = append(customers, i.Customer())
+	}
+	if err := i.Err(); err != nil {
+		c.logger.WithError(err).Fatal("could not get stripe customer list")
+	}
 
-			var hasValidSubscription bool
-			for _, sub := range customer.Subs.Values {
-				if sub.EndCancel {
-					// not active
-					continue
-				}
-				// active
-				if hasValidSubscription {
-					c.logger.Warnf("customer %q has multiple valid subscriptions", customer.ID)
-					break
-				}
-				hasValidSubscription = true
-			}
+	// Users with a stripe customer or enabled installations
+	withCustomer, err := um.UsersWithStripeCustomer()
+	if err != nil {
+		c.logger.WithError(err).Fatal("could not get users with stripe customers")
+	}
+	withInstallations, err := um.UsersWithEnabledInstallations()
+	if err != nil {
+		c.logger.WithError(err).Fatal("could not get users with enabled installations")
+	}
+	usersByID := make(map[int]*users.User)
+	var owners []billingOwner
+	for _, user := range append(withCustomer, withInstallations...) {
+		if _, ok := usersByID[user.UserID]; ok {
+			continue
 		}
-		if err := customers.Err(); err != nil {
-			c.logger.WithError(err).Fatal("could not get customer list for multiple subscribers check")
+		usersByID[user.UserID] = user
+
+		installationIDs, err := user.EnabledInstallations()
+		if err != nil {
+			c.logger.WithError(err).WithField("userID", user.UserID).Fatal("could not get enabled installations")
 		}
+		owners = append(owners, billingOwner{
+			UserID:               user.UserID,
+			StripeCustomerID:     user.StripeCustomerID,
+			EnabledInstallations: len(installationIDs),
+		})
 	}
 
-	// Find different stripe customers with same userID which also have active subscriptions
-	{
-		seenUserIDs := make(map[string]string) // userID => stripeCustomerID
+	// Billing accounts with a stripe customer or enabled installations
+	accountsWithCustomer, err := um.AccountsWithStripeCustomer()
+	if err != nil {
+		c.logger.WithError(err).Fatal("could not get billing accounts with stripe customers")
+	}
+	accountsWithInstallations, err := um.AccountsWithEnabledInstallations()
+	if err != nil {
+		c.logger.WithError(err).Fatal("could not get billing accounts with enabled installations")
+	}
+	accountsByID := make(map[int]*users.Account)
+	for _, account := range append(accountsWithCustomer, accountsWithInstallations...) {
+		if _, ok := accountsByID[account.AccountID]; ok {
+			continue
+		}
+		accountsByID[account.AccountID] = account
+
+		installationIDs, err := account.EnabledInstallations()
+		if err != nil {
+			c.logger.WithError(err).WithField("billingAccountID", account.AccountID).Fatal("could not get enabled installations")
+		}
+		owners = append(owners, billingOwner{
+			BillingAccountID:     account.AccountID,
+			StripeCustomerID:     account.StripeCustomerID,
+			EnabledInstallations: len(installationIDs),
+		})
+	}
 
-		customers := customer.List(nil)
-		for customers.Next() {
-			customer := customers.Customer()
+	report := newBillingReport(time.Now(), customers, owners)
 
-			var hasValidSubscription bool
-			for _, sub := range customer.Subs.Values {
-				if !sub.EndCancel {
-					hasValidSubscription = true
+	if fix {
+		for i, issue := range report.Issues {
+			if !issue.Fixable {
+				continue
+			}
+			switch issue.Check {
+			case CheckInstallationsWithoutSubscription:
+				if issue.BillingAccountID != 0 {
+					err = accountsByID[issue.BillingAccountID].DisableAllInstallations()
+				} else {
+					err = usersByID[issue.UserID].DisableAllInstallations()
 				}
+			default:
+				continue
+			}
+			if err != nil {
+				report.Issues[i].FixError = err.Error()
+				continue
 			}
-			if !hasValidSubscription {
+			report.Issues[i].Fixed = true
+		}
+		c.applyInstallationChanges(um, gci)
+	}
+
+	c.writeReport(format, report)
+}
+
+// BillingCurrency records the currency of each user's stripe customer and
+// writes the users whose customer currency is not currency to stdout. Those
+// users get a new stripe customer in currency on their next subscription, as
+// stripe customers can only be charged in a single currency.
+func (c *Command) BillingCurrency(um *users.UserManager, currency string) {
+	customers := make(map[string]*stripe.Customer)
+	i := c.stripe.Customers.List(nil)
+	for i.Next() {
+		customers[i.Customer().ID] = i.Customer()
+	}
+	if err := i.Err(); err != nil {
+		c.logger.WithError(err).Fatal("could not get stripe customer list")
+	}
+
+	withCustomer, err := um.UsersWithStripeCustomer()
+	if err != nil {
+		c.logger.WithError(err).Fatal("could not get users with stripe customers")
+	}
+
+	var mismatched int
+	for _, user := range withCustomer {
+		logger := c.logger.WithField("userID", user.UserID)
+
+		customer, ok := customers[user.StripeCustomerID]
+		if !ok {
+			logger.Errorf("stripe customer %q does not exist", user.StripeCustomerID)
+			continue
+		}
+		if string(customer.Currency) != user.StripeCurrency {
+			if err := user.RecordStripeCurrency(string(customer.Currency)); err != nil {
+				logger.WithError(err).Error("could not record stripe currency")
 				continue
 			}
+		}
+		if customer.Currency != "" && string(customer.Currency) != currency {
+			mismatched++
+			fmt.Fprintf(c.out, "userID %v stripe customer %v currency %v is not %v\n", user.UserID, customer.ID, customer.Currency, currency)
+		}
+	}
+	fmt.Fprintf(c.out, "%d of %d stripe customers are not in %v\n", mismatched, len(withCustomer), currency)
+}
+
+// WebhooksReplay re-runs handler for stored stripe events. args must contain
+// either a single stripe event ID, or --failed to replay all events that have
+// not been successfully processed. The result of each replay is recorded.
+// Events not successfully processed are claimed first, and skipped if they're
+// being processed by a webhook delivery.
+func (c *Command) WebhooksReplay(store *payments.EventStore, handler func(*stripe.Event) error, args []string) {
+	if len(args) != 1 {
+		c.logger.Fatal("usage: webhooks:replay <eventID|--failed>")
+	}
+
+	var events []payments.StoredEvent
+	switch args[0] {
+	case "--failed":
+		var err error
+		events, err = store.ListFailed()
+		if err != nil {
+			c.logger.WithError(err).Fatal("could not list failed events")
+		}
+	default:
+		event, err := store.Get(args[0])
+		if err != nil {
+			c.logger.WithError(err).Fatal("could not get event")
+		}
+		if event == nil {
+			c.logger.Fatalf("event %q not found", args[0])
+		}
+		events = append(events, *event)
+	}
+
+	var failed int
+	for _, stored := range events {
+		logger := c.logger.WithField("StripeEventID", stored.ID).WithField("StripeEventType", stored.Type)
 
-			if seenCustomerID := seenUserIDs[customer.Meta["userID"]]; seenCustomerID != "" {
-				c.logger.Warnf("userID %q has customerID %q and %q", customer.Meta["userID"], seenCustomerID, customer.ID)
+		if stored.ProcessedAt == nil {
+			claimed, err := store.Claim(stored.ID)
+			if err != nil {
+				c.logger.WithError(err).Fatal("could not claim event")
+			}
+			if !claimed {
+				logger.Warn("skipping event being processed")
+				continue
 			}
-			seenUserIDs[customer.Meta["userID"]] = customer.ID
 		}
-		if err := customers.Err(); err != nil {
-			c.logger.WithError(err).Fatal("could not get customer list for multiple customers same userID check")
+
+		var event stripe.Event
+		err := json.Unmarshal(stored.Payload, &event)
+		if err == nil {
+			err = handler(&event)
+		}
+		if merr := store.MarkProcessed(stored.ID, err); merr != nil {
+			logger.WithError(merr).Error("could not mark event as processed")
+		}
+		if err != nil {
+			failed++
+			logger.WithError(err).Error("could not replay event")
+			continue
+		}
+		logger.Warn("replayed event")
+	}
+
+	if failed > 0 {
+		c.logger.Fatalf("%d of %d events failed to replay", failed, len(events))
+	}
+}
+
+// BuildsEnforce enforces each plan's daily build limit. Installations of users
+// and billing accounts who have reached their limit are throttled, disabling
+// them in GopherCI until midnight UTC, throttled installations are enabled
+// again once the limit resets. Installations remain enabled for the user or
+// billing account in GopherCI-web. This should be executed regularly, such as
+// every 5 minutes.
+func (c *Command) BuildsEnforce(um *users.UserManager, gci *gopherci.Client) {
+	users, err := um.UsersWithEnabledInstallations()
+	if err != nil {
+		c.logger.WithError(err).Fatal("could not get users with enabled installations")
+	}
+	accounts, err := um.AccountsWithEnabledInstallations()
+	if err != nil {
+		c.logger.WithError(err).Fatal("could not get billing accounts with enabled installations")
+	}
+
+	now := time.Now()
+	for _, user := range users {
+		logger := c.logger.WithField("userID", user.UserID)
+
+		usage, err := user.BuildUsage(gci, now)
+		if err != nil {
+			logger.WithError(err).Error("could not get build usage")
+			continue
+		}
+		c.enforceBuilds(logger, um, usage, now)
+	}
+	for _, account := range accounts {
+		logger := c.logger.WithField("billingAccountID", account.AccountID)
+
+		usage, err := account.BuildUsage(gci, now)
+		if err != nil {
+			logger.WithError(err).Error("could not get build usage")
+			continue
+		}
+		c.enforceBuilds(logger, um, usage, now)
+	}
+	c.applyInstallationChanges(um, gci)
+}
+
+// enforceBuilds throttles the installations in usage if the daily build limit
+// has been reached, else unthrottles any installations previously throttled.
+func (c *Command) enforceBuilds(logger *logrus.Entry, um *users.UserManager, usage *users.BuildUsage, now time.Time) {
+	if usage.LimitReached() {
+		throttled, err := um.ThrottleInstallations(now, installationIDs(usage)...)
+		if err != nil {
+			logger.WithError(err).Error("could not throttle installations")
+			return
 		}
+		if len(throttled) > 0 {
+			logger.Warnf("daily build limit of %d reached with %d builds, disabled installations %v until %v", usage.Limit, usage.Total, throttled, gopherci.StartOfDay(now).AddDate(0, 0, 1))
+		}
+		return
+	}
+
+	unthrottled, err := um.UnthrottleInstallations(installationIDs(usage)...)
+	if err != nil {
+		logger.WithError(err).Error("could not unthrottle installations")
+		return
+	}
+	for _, installationID := range unthrottled {
+		logger.Warnf("daily build limit reset, enabled installationID %v", installationID)
+	}
+}
+
+// DunningProcess progresses the failed payment workflow of all past due
+// users and billing accounts according to policy, sending reminders using
+// notifier and disabling installations once the grace period ends. This
+// should be executed regularly, such as every hour.
+func (c *Command) DunningProcess(um *users.UserManager, gci *gopherci.Client, notifier notify.Notifier, policy users.DunningPolicy) {
+	users, err := um.UsersPastDue()
+	if err != nil {
+		c.logger.WithError(err).Fatal("could not get past due users")
+	}
+	accounts, err := um.AccountsPastDue()
+	if err != nil {
+		c.logger.WithError(err).Fatal("could not get past due billing accounts")
+	}
+
+	now := time.Now()
+	for _, user := range users {
+		if err := user.ProcessDunning(policy, now, notifier); err != nil {
+			c.logger.WithError(err).WithField("userID", user.UserID).Error("could not process dunning")
+		}
+	}
+	for _, account := range accounts {
+		if err := account.ProcessDunning(policy, now, notifier); err != nil {
+			c.logger.WithError(err).WithField("billingAccountID", account.AccountID).Error("could not process dunning")
+		}
+	}
+	c.applyInstallationChanges(um, gci)
+}
+
+// InstallationsReconcile checks the installations enabled in GopherCI-web
+// against those enabled in GopherCI for discrepancies and writes a report to
+// stdout. args may contain --format=json for a JSON report instead of text,
+// and --apply to fix all discrepancies found.
+func (c *Command) InstallationsReconcile(um *users.UserManager, gci *gopherci.Client, args []string) {
+	format, apply := c.reportFlags("installations:reconcile", "apply", "fix all discrepancies", args)
+
+	users, err := um.UsersWithEnabledInstallations()
+	if err != nil {
+		c.logger.WithError(err).Fatal("could not get users with enabled installations")
+	}
+	accounts, err := um.AccountsWithEnabledInstallations()
+	if err != nil {
+		c.logger.WithError(err).Fatal("could not get billing accounts with enabled installations")
+	}
+
+	// owners is the user or billing account which enabled each installation
+	owners := make(map[int]installationOwner)
+	var installs []reconcileInstallation
+	for _, user := range users {
+		logger := c.logger.WithField("userID", user.UserID)
+
+		installationIDs, err := user.EnabledInstallations()
+		if err != nil {
+			logger.WithError(err).Fatal("could not get enabled installations")
+		}
+		subscribed, err := user.HasActiveSubscription()
+		if err != nil {
+			logger.WithError(err).Fatal("could not check for an active subscription")
+		}
+		for _, installationID := range installationIDs {
+			owners[installationID] = user
+			installs = append(installs, reconcileInstallation{InstallationID: installationID, UserID: user.UserID, Subscribed: subscribed})
+		}
+	}
+	for _, account := range accounts {
+		logger := c.logger.WithField("billingAccountID", account.AccountID)
+
+		installationIDs, err := account.EnabledInstallations()
+		if err != nil {
+			logger.WithError(err).Fatal("could not get enabled installations")
+		}
+		subscribed, err := account.HasActiveSubscription()
+		if err != nil {
+			logger.WithError(err).Fatal("could not check for an active subscription")
+		}
+		for _, installationID := range installationIDs {
+			owners[installationID] = account
+			installs = append(installs, reconcileInstallation{InstallationID: installationID, BillingAccountID: account.AccountID, Subscribed: subscribed})
+		}
+	}
+
+	var ids []int
+	for _, install := range installs {
+		ids = append(ids, install.InstallationID)
+	}
+	existing, err := gci.ExistingInstallations(ids...)
+	if err != nil {
+		c.logger.WithError(err).Fatal("could not get existing gopherci installations")
+	}
+	exists := make(map[int]bool)
+	for _, installationID := range existing {
+		exists[installationID] = true
+	}
+	for i := range installs {
+		installs[i].Exists = exists[installs[i].InstallationID]
+	}
+
+	enabled, err := gci.EnabledInstallations()
+	if err != nil {
+		c.logger.WithError(err).Fatal("could not get enabled gopherci installations")
+	}
+
+	report := newReconcileReport(time.Now(), enabled, installs)
+
+	if apply {
+		report.Applied = true
+		for i, issue := range report.Issues {
+			switch issue.Check {
+			case CheckEnabledWithoutOwner:
+				err = um.QueueInstallationChange(issue.InstallationID, false)
+			case CheckMissingInstallation:
+				err = um.RemoveInstallation(issue.InstallationID)
+			case CheckUnsubscribedInstallation:
+				err = owners[issue.InstallationID].DisableInstallation(issue.InstallationID)
+			default:
+				continue
+			}
+			if err != nil {
+				report.Issues[i].FixError = err.Error()
+				continue
+			}
+			report.Issues[i].Fixed = true
+		}
+		c.applyInstallationChanges(um, gci)
+	}
+
+	c.writeReport(format, report)
+}
+
+// installationOwner is a user or billing account which enabled an
+// installation, disabling the installation also queues it to be disabled in
+// GopherCI.
+type installationOwner interface {
+	DisableInstallation(installationID int) error
+}
+
+// reportFlags parses args of the command name, which writes a report, for
+// --format, text or json, and the boolean flag fixFlag, which fixes the issues
+// found.
+func (c *Command) reportFlags(name, fixFlag, fixUsage string, args []string) (format string, fix bool) {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.StringVar(&format, "format", "text", "report format, text or json")
+	flags.BoolVar(&fix, fixFlag, false, fixUsage)
+	_ = flags.Parse(args)
+	if format != "text" && format != "json" {
+		c.logger.Fatalf("unknown format %q, must be text or json", format)
+	}
+	return format, fix
+}
+
+// textReport is a report which can be written in a human readable format.
+type textReport interface {
+	WriteText(w io.Writer) error
+}
+
+// writeReport writes report to stdout in format, text or json.
+func (c *Command) writeReport(format string, report textReport) {
+	var err error
+	switch format {
+	case "json":
+		enc := json.NewEncoder(c.out)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(report)
+	default:
+		err = report.WriteText(c.out)
+	}
+	if err != nil {
+		c.logger.WithError(err).Fatal("could not write report")
+	}
+}
+
+// applyInstallationChanges applies the installation changes queued by a
+// command, rather than waiting for the web server to apply them.
+func (c *Command) applyInstallationChanges(um *users.UserManager, gci *gopherci.Client) {
+	applied, err := um.ApplyInstallationChanges(gci, time.Now())
+	if err != nil {
+		c.logger.WithError(err).Error("could not apply installation changes")
+		return
+	}
+	c.logger.Infof("applied %d installation changes", applied)
+}
+
+// installationIDs returns the installationIDs in usage.
+func installationIDs(usage *users.BuildUsage) []int {
+	var ids []int
+	for installationID := range usage.Installations {
+		ids = append(ids, installationID)
 	}
+	return ids
 }
@@ -0,0 +1,118 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// Installation checks performed by installations:reconcile.
+const (
+	// CheckEnabledWithoutOwner finds installations enabled in GopherCI but
+	// not by any user or billing account. This is fixed by disabling the
+	// installation in GopherCI.
+	CheckEnabledWithoutOwner = "enabled_without_owner"
+	// CheckMissingInstallation finds installations enabled by a user or
+	// billing account which no longer exist in GopherCI, such as after the
+	// App was uninstalled. This is fixed by removing the installation.
+	CheckMissingInstallation = "missing_installation"
+	// CheckUnsubscribedInstallation finds installations enabled by a user or
+	// billing account without an active subscription. This is fixed by
+	// disabling the installation in both GopherCI and GopherCI-web.
+	CheckUnsubscribedInstallation = "unsubscribed_installation"
+)
+
+// ReconcileIssue is a single discrepancy found by installations:reconcile.
+type ReconcileIssue struct {
+	Check            string `json:"check"`
+	InstallationID   int    `json:"installationID"`
+	UserID           int    `json:"userID,omitempty"`
+	BillingAccountID int    `json:"billingAccountID,omitempty"`
+	Detail           string `json:"detail"`
+	Fixed            bool   `json:"fixed"`              // Fixed is true if the issue was fixed.
+	FixError         string `json:"fixError,omitempty"` // FixError is the error from attempting to fix the issue.
+}
+
+// ReconcileReport is the result of installations:reconcile.
+type ReconcileReport struct {
+	CheckedAt     time.Time        `json:"checkedAt"`
+	Installations int              `json:"installations"` // Installations is the number of installations enabled in GopherCI-web.
+	Enabled       int              `json:"enabled"`       // Enabled is the number of installations enabled in GopherCI.
+	Applied       bool             `json:"applied"`       // Applied is true if fixes were attempted.
+	Issues        []ReconcileIssue `json:"issues"`
+}
+
+// reconcileInstallation is the state of an installation enabled in
+// GopherCI-web.
+type reconcileInstallation struct {
+	InstallationID   int
+	UserID           int  // UserID is the user which enabled the installation, if any.
+	BillingAccountID int  // BillingAccountID is the billing account which enabled the installation, if any.
+	Exists           bool // Exists is true if the installation exists in GopherCI.
+	Subscribed       bool // Subscribed is true if the owner has an active subscription.
+}
+
+// newReconcileReport checks the installations enabled in GopherCI-web
+// against the installationIDs enabled in GopherCI and returns a report of
+// all discrepancies found.
+func newReconcileReport(now time.Time, enabled []int, installs []reconcileInstallation) *ReconcileReport {
+	report := &ReconcileReport{
+		CheckedAt:     now,
+		Installations: len(installs),
+		Enabled:       len(enabled),
+		Issues:        []ReconcileIssue{},
+	}
+
+	owned := make(map[int]bool)
+	for _, install := range installs {
+		owned[install.InstallationID] = true
+
+		issue := ReconcileIssue{
+			InstallationID:   install.InstallationID,
+			UserID:           install.UserID,
+			BillingAccountID: install.BillingAccountID,
+		}
+		switch {
+		case !install.Exists:
+			issue.Check = CheckMissingInstallation
+			issue.Detail = "installation does not exist in gopherci"
+		case !install.Subscribed:
+			issue.Check = CheckUnsubscribedInstallation
+			issue.Detail = "installation enabled without an active subscription"
+		default:
+			continue
+		}
+		report.Issues = append(report.Issues, issue)
+	}
+
+	for _, installationID := range enabled {
+		if owned[installationID] {
+			continue
+		}
+		report.Issues = append(report.Issues, ReconcileIssue{
+			Check:          CheckEnabledWithoutOwner,
+			InstallationID: installationID,
+			Detail:         "installation enabled in gopherci without a user or billing account",
+		})
+	}
+	return report
+}
+
+// WriteText writes the report in a human readable format to w.
+func (r *ReconcileReport) WriteText(w io.Writer) error {
+	summary := fmt.Sprintf("Checked %d installations and %d gopherci installations at %v, found %d issues",
+		r.Installations, r.Enabled, r.CheckedAt.Format(time.RFC3339), len(r.Issues))
+
+	var issues []textIssue
+	for _, issue := range r.Issues {
+		issues = append(issues, textIssue{
+			check:    issue.Check,
+			subject:  fmt.Sprintf("installationID: %d userID: %d billingAccountID: %d", issue.InstallationID, issue.UserID, issue.BillingAccountID),
+			detail:   issue.Detail,
+			fixable:  !r.Applied,
+			fixed:    issue.Fixed,
+			fixError: issue.FixError,
+		})
+	}
+	return writeText(w, summary, "--apply", issues)
+}
@@ -0,0 +1,86 @@
+package commands
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNewReconcileReport(t *testing.T) {
+	installs := []reconcileInstallation{
+		{InstallationID: 1, UserID: 1, Exists: true, Subscribed: true},
+		{InstallationID: 2, UserID: 1, Subscribed: true},
+		{InstallationID: 3, UserID: 2, Exists: true},
+		{InstallationID: 4, BillingAccountID: 1, Exists: true},
+		{InstallationID: 5, BillingAccountID: 2, Exists: true, Subscribed: true},
+		{InstallationID: 6, UserID: 2},
+	}
+	enabled := []int{1, 3, 5, 7}
+
+	now := time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC)
+	report := newReconcileReport(now, enabled, installs)
+
+	want := &ReconcileReport{
+		CheckedAt:     now,
+		Installations: 6,
+		Enabled:       4,
+		Issues: []ReconcileIssue{
+			{Check: CheckMissingInstallation, InstallationID: 2, UserID: 1, Detail: "installation does not exist in gopherci"},
+			{Check: CheckUnsubscribedInstallation, InstallationID: 3, UserID: 2, Detail: "installation enabled without an active subscription"},
+			{Check: CheckUnsubscribedInstallation, InstallationID: 4, BillingAccountID: 1, Detail: "installation enabled without an active subscription"},
+			{Check: CheckMissingInstallation, InstallationID: 6, UserID: 2, Detail: "installation does not exist in gopherci"},
+			{Check: CheckEnabledWithoutOwner, InstallationID: 7, Detail: "installation enabled in gopherci without a user or billing account"},
+		},
+	}
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("\nhave %+v\nwant %+v", report, want)
+	}
+}
+
+func TestReconcileReport_WriteText(t *testing.T) {
+	report := &ReconcileReport{
+		CheckedAt:     time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC),
+		Installations: 2,
+		Enabled:       2,
+		Issues: []ReconcileIssue{
+			{Check: CheckMissingInstallation, InstallationID: 2, UserID: 1, Detail: "installation does not exist in gopherci"},
+			{Check: CheckEnabledWithoutOwner, InstallationID: 7, Detail: "installation enabled in gopherci without a user or billing account"},
+		},
+	}
+
+	tests := []struct {
+		apply func(*ReconcileReport)
+		want  string
+	}{
+		{
+			func(*ReconcileReport) {},
+			`Checked 2 installations and 2 gopherci installations at 2017-03-01T00:00:00Z, found 2 issues
+[enabled_without_owner] installationID: 7 userID: 0 billingAccountID: 0: installation enabled in gopherci without a user or billing account (fixable with --apply)
+[missing_installation] installationID: 2 userID: 1 billingAccountID: 0: installation does not exist in gopherci (fixable with --apply)
+`,
+		},
+		{
+			func(r *ReconcileReport) {
+				r.Applied = true
+				r.Issues[0].Fixed = true
+				r.Issues[1].FixError = "db error"
+			},
+			`Checked 2 installations and 2 gopherci installations at 2017-03-01T00:00:00Z, found 2 issues
+[enabled_without_owner] installationID: 7 userID: 0 billingAccountID: 0: installation enabled in gopherci without a user or billing account (fix failed: db error)
+[missing_installation] installationID: 2 userID: 1 billingAccountID: 0: installation does not exist in gopherci (fixed)
+`,
+		},
+	}
+	for _, test := range tests {
+		test.apply(report)
+
+		var buf bytes.Buffer
+		if err := report.WriteText(&buf); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if have := buf.String(); have != test.want {
+			t.Errorf("\nhave %q\nwant %q", have, test.want)
+		}
+	}
+}
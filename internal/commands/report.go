@@ -0,0 +1,241 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/bradleyfalzon/gopherci-web/internal/payments"
+	"github.com/bradleyfalzon/gopherci-web/internal/users"
+	stripe "github.com/stripe/stripe-go"
+)
+
+// Billing checks performed by billing:check.
+const (
+	// CheckMultipleSubscriptions finds stripe customers with multiple valid
+	// subscriptions.
+	CheckMultipleSubscriptions = "multiple_subscriptions"
+	// CheckDuplicateUserID finds different stripe customers with valid
+	// subscriptions for the same userID.
+	CheckDuplicateUserID = "duplicate_user_id"
+	// CheckDuplicateAccountID finds different stripe customers with valid
+	// subscriptions for the same billing account.
+	CheckDuplicateAccountID = "duplicate_account_id"
+	// CheckMissingCustomer finds users and billing accounts whose
+	// stripe_customer_id does not exist in stripe.
+	CheckMissingCustomer = "missing_customer"
+	// CheckCustomerMismatch finds users and billing accounts whose stripe
+	// customer belongs to a different user or billing account.
+	CheckCustomerMismatch = "customer_mismatch"
+	// CheckInstallationsWithoutSubscription finds users and billing accounts
+	// with enabled installations but no active subscription. This is fixed by
+	// disabling their installations.
+	CheckInstallationsWithoutSubscription = "installations_without_subscription"
+)
+
+// BillingIssue is a single discrepancy found by billing:check.
+type BillingIssue struct {
+	Check            string `json:"check"`
+	UserID           int    `json:"userID,omitempty"`
+	BillingAccountID int    `json:"billingAccountID,omitempty"`
+	CustomerID       string `json:"customerID,omitempty"`
+	Detail           string `json:"detail"`
+	Fixable          bool   `json:"fixable"`            // Fixable is true if the issue is safe to fix automatically.
+	Fixed            bool   `json:"fixed"`              // Fixed is true if the issue was fixed.
+	FixError         string `json:"fixError,omitempty"` // FixError is the error from attempting to fix the issue.
+}
+
+// BillingReport is the result of billing:check.
+type BillingReport struct {
+	CheckedAt time.Time      `json:"checkedAt"`
+	Customers int            `json:"customers"` // Customers is the number of stripe customers checked.
+	Users     int            `json:"users"`     // Users is the number of users checked.
+	Accounts  int            `json:"accounts"`  // Accounts is the number of billing accounts checked.
+	Issues    []BillingIssue `json:"issues"`
+}
+
+// billingOwner is the billing state of a single user or billing account,
+// only one of UserID and BillingAccountID is set.
+type billingOwner struct {
+	UserID               int
+	BillingAccountID     int
+	StripeCustomerID     string
+	EnabledInstallations int
+}
+
+// meta returns the stripe customer metadata key and value of the owner.
+func (o billingOwner) meta() (key, value string) {
+	if o.BillingAccountID != 0 {
+		return payments.AccountIDMeta, strconv.Itoa(o.BillingAccountID)
+	}
+	return payments.UserIDMeta, strconv.Itoa(o.UserID)
+}
+
+// newBillingReport checks stripe customers against users and billing
+// accounts and returns a report of all discrepancies found.
+func newBillingReport(now time.Time, customers []*stripe.Customer, owners []billingOwner) *BillingReport {
+	report := &BillingReport{
+		CheckedAt: now,
+		Customers: len(customers),
+		Issues:    []BillingIssue{},
+	}
+	for _, owner := range owners {
+		if owner.BillingAccountID != 0 {
+			report.Accounts++
+		} else {
+			report.Users++
+		}
+	}
+
+	customersByID := make(map[string]*stripe.Customer)
+	seenUserIDs := make(map[string]string)    // userID => stripeCustomerID
+	seenAccountIDs := make(map[string]string) // billingAccountID => stripeCustomerID
+	for _, customer := range customers {
+		customersByID[customer.ID] = customer
+
+		var valid int
+		if customer.Subs != nil {
+			for _, sub := range customer.Subs.Values {
+				if !sub.EndCancel {
+					valid++
+				}
+			}
+		}
+		if valid > 1 {
+			report.add(BillingIssue{
+				Check:      CheckMultipleSubscriptions,
+				CustomerID: customer.ID,
+				Detail:     fmt.Sprintf("customer has %d valid subscriptions", valid),
+			})
+		}
+		if valid == 0 {
+			continue
+		}
+
+		check, key, seen := CheckDuplicateUserID, payments.UserIDMeta, seenUserIDs
+		if customer.Meta[payments.UserIDMeta] == "" {
+			check, key, seen = CheckDuplicateAccountID, payments.AccountIDMeta, seenAccountIDs
+		}
+		id := customer.Meta[key]
+		if id == "" {
+			continue
+		}
+		if seenCustomerID := seen[id]; seenCustomerID != "" {
+			report.add(BillingIssue{
+				Check:      check,
+				CustomerID: customer.ID,
+				Detail:     fmt.Sprintf("%s %q also has customer %q with a valid subscription", key, id, seenCustomerID),
+			})
+		}
+		seen[id] = customer.ID
+	}
+
+	for _, owner := range owners {
+		var customer *stripe.Customer
+		if owner.StripeCustomerID != "" {
+			customer = customersByID[owner.StripeCustomerID]
+			key, value := owner.meta()
+			switch {
+			case customer == nil || customer.Deleted:
+				report.add(BillingIssue{
+					Check:            CheckMissingCustomer,
+					UserID:           owner.UserID,
+					BillingAccountID: owner.BillingAccountID,
+					CustomerID:       owner.StripeCustomerID,
+					Detail:           "stripe customer does not exist",
+				})
+				customer = nil
+			case customer.Meta[key] != value:
+				report.add(BillingIssue{
+					Check:            CheckCustomerMismatch,
+					UserID:           owner.UserID,
+					BillingAccountID: owner.BillingAccountID,
+					CustomerID:       customer.ID,
+					Detail:           fmt.Sprintf("stripe customer belongs to %s %q", key, customer.Meta[key]),
+				})
+			}
+		}
+
+		if owner.EnabledInstallations > 0 && !users.HasActiveSubscription(customer) {
+			report.add(BillingIssue{
+				Check:            CheckInstallationsWithoutSubscription,
+				UserID:           owner.UserID,
+				BillingAccountID: owner.BillingAccountID,
+				CustomerID:       owner.StripeCustomerID,
+				Detail:           fmt.Sprintf("%d installations enabled without an active subscription", owner.EnabledInstallations),
+				Fixable:          true,
+			})
+		}
+	}
+	return report
+}
+
+// add adds issue to the report.
+func (r *BillingReport) add(issue BillingIssue) {
+	r.Issues = append(r.Issues, issue)
+}
+
+// WriteText writes the report in a human readable format to w.
+func (r *BillingReport) WriteText(w io.Writer) error {
+	summary := fmt.Sprintf("Checked %d stripe customers, %d users and %d billing accounts at %v, found %d issues",
+		r.Customers, r.Users, r.Accounts, r.CheckedAt.Format(time.RFC3339), len(r.Issues))
+
+	var issues []textIssue
+	for _, issue := range r.Issues {
+		subject := fmt.Sprintf("userID: %d customerID: %q", issue.UserID, issue.CustomerID)
+		if issue.BillingAccountID != 0 {
+			subject = fmt.Sprintf("billingAccountID: %d customerID: %q", issue.BillingAccountID, issue.CustomerID)
+		}
+		issues = append(issues, textIssue{
+			check:    issue.Check,
+			subject:  subject,
+			detail:   issue.Detail,
+			fixable:  issue.Fixable,
+			fixed:    issue.Fixed,
+			fixError: issue.FixError,
+		})
+	}
+	return writeText(w, summary, "--fix", issues)
+}
+
+// textIssue is an issue of any report, as written by writeText.
+type textIssue struct {
+	check    string
+	subject  string // subject identifies what the issue was found in.
+	detail   string
+	fixable  bool
+	fixed    bool
+	fixError string
+}
+
+// writeText writes summary, then issues sorted by check, in a human readable
+// format to w. Fixable issues which have not been fixed show fixFlag, the
+// command's flag to fix them.
+func writeText(w io.Writer, summary, fixFlag string, issues []textIssue) error {
+	if _, err := fmt.Fprintln(w, summary); err != nil {
+		return err
+	}
+
+	sorted := make([]textIssue, len(issues))
+	copy(sorted, issues)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].check < sorted[j].check })
+
+	for _, issue := range sorted {
+		var status string
+		switch {
+		case issue.fixed:
+			status = " (fixed)"
+		case issue.fixError != "":
+			status = fmt.Sprintf(" (fix failed: %s)", issue.fixError)
+		case issue.fixable:
+			status = fmt.Sprintf(" (fixable with %s)", fixFlag)
+		}
+		_, err := fmt.Fprintf(w, "[%s] %s: %s%s\n", issue.check, issue.subject, issue.detail, status)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
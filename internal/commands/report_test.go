@@ -0,0 +1,101 @@
+package commands
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	stripe "github.com/stripe/stripe-go"
+)
+
+func TestNewBillingReport(t *testing.T) {
+	customer := func(id, userID string, subs ...*stripe.Sub) *stripe.Customer {
+		return &stripe.Customer{
+			ID:   id,
+			Meta: map[string]string{"userID": userID},
+			Subs: &stripe.SubList{Values: subs},
+		}
+	}
+	accountCustomer := func(id, accountID string, subs ...*stripe.Sub) *stripe.Customer {
+		return &stripe.Customer{
+			ID:   id,
+			Meta: map[string]string{"accountID": accountID},
+			Subs: &stripe.SubList{Values: subs},
+		}
+	}
+	customers := []*stripe.Customer{
+		customer("cus_1", "1", &stripe.Sub{ID: "sub_1"}),
+		customer("cus_2", "2", &stripe.Sub{ID: "sub_2"}, &stripe.Sub{ID: "sub_3"}),
+		customer("cus_3", "2", &stripe.Sub{ID: "sub_4"}),
+		customer("cus_4", "3"),
+		customer("cus_5", "99"),
+		customer("cus_6", "", &stripe.Sub{ID: "sub_5"}),
+		customer("cus_7", "", &stripe.Sub{ID: "sub_6"}),
+		accountCustomer("cus_8", "7", &stripe.Sub{ID: "sub_7"}),
+		accountCustomer("cus_9", "8"),
+		accountCustomer("cus_10", "7", &stripe.Sub{ID: "sub_8"}),
+	}
+	owners := []billingOwner{
+		{UserID: 1, StripeCustomerID: "cus_1", EnabledInstallations: 2},
+		{UserID: 2, StripeCustomerID: "cus_2", EnabledInstallations: 1},
+		{UserID: 3, StripeCustomerID: "cus_4", EnabledInstallations: 1},
+		{UserID: 4, StripeCustomerID: "cus_missing"},
+		{UserID: 5, StripeCustomerID: "cus_5"},
+		{UserID: 6, EnabledInstallations: 3},
+		{BillingAccountID: 7, StripeCustomerID: "cus_8", EnabledInstallations: 2},
+		{BillingAccountID: 8, StripeCustomerID: "cus_9", EnabledInstallations: 1},
+		{BillingAccountID: 9, StripeCustomerID: "cus_1"},
+	}
+
+	now := time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC)
+	report := newBillingReport(now, customers, owners)
+
+	want := &BillingReport{
+		CheckedAt: now,
+		Customers: 10,
+		Users:     6,
+		Accounts:  3,
+		Issues: []BillingIssue{
+			{Check: CheckMultipleSubscriptions, CustomerID: "cus_2", Detail: "customer has 2 valid subscriptions"},
+			{Check: CheckDuplicateUserID, CustomerID: "cus_3", Detail: `userID "2" also has customer "cus_2" with a valid subscription`},
+			{Check: CheckDuplicateAccountID, CustomerID: "cus_10", Detail: `accountID "7" also has customer "cus_8" with a valid subscription`},
+			{Check: CheckInstallationsWithoutSubscription, UserID: 3, CustomerID: "cus_4", Detail: "1 installations enabled without an active subscription", Fixable: true},
+			{Check: CheckMissingCustomer, UserID: 4, CustomerID: "cus_missing", Detail: "stripe customer does not exist"},
+			{Check: CheckCustomerMismatch, UserID: 5, CustomerID: "cus_5", Detail: `stripe customer belongs to userID "99"`},
+			{Check: CheckInstallationsWithoutSubscription, UserID: 6, Detail: "3 installations enabled without an active subscription", Fixable: true},
+			{Check: CheckInstallationsWithoutSubscription, BillingAccountID: 8, CustomerID: "cus_9", Detail: "1 installations enabled without an active subscription", Fixable: true},
+			{Check: CheckCustomerMismatch, BillingAccountID: 9, CustomerID: "cus_1", Detail: `stripe customer belongs to accountID ""`},
+		},
+	}
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("\nhave %+v\nwant %+v", report, want)
+	}
+}
+
+func TestBillingReport_WriteText(t *testing.T) {
+	report := &BillingReport{
+		CheckedAt: time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC),
+		Customers: 3,
+		Users:     2,
+		Accounts:  1,
+		Issues: []BillingIssue{
+			{Check: CheckMissingCustomer, UserID: 4, CustomerID: "cus_missing", Detail: "stripe customer does not exist"},
+			{Check: CheckMissingCustomer, BillingAccountID: 7, CustomerID: "cus_gone", Detail: "stripe customer does not exist"},
+			{Check: CheckInstallationsWithoutSubscription, UserID: 6, Detail: "3 installations enabled without an active subscription", Fixable: true, Fixed: true},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := report.WriteText(&buf); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	want := `Checked 3 stripe customers, 2 users and 1 billing accounts at 2017-03-01T00:00:00Z, found 3 issues
+[installations_without_subscription] userID: 6 customerID: "": 3 installations enabled without an active subscription (fixed)
+[missing_customer] userID: 4 customerID: "cus_missing": stripe customer does not exist
+[missing_customer] billingAccountID: 7 customerID: "cus_gone": stripe customer does not exist
+`
+	if have := buf.String(); have != want {
+		t.Errorf("\nhave %q\nwant %q", have, want)
+	}
+}
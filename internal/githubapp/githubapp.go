@@ -0,0 +1,248 @@
+// Package githubapp authenticates as the GopherCI GitHub App to access
+// information about the App's installations.
+package githubapp
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultBaseURL is the base URL of the GitHub API.
+const DefaultBaseURL = "https://api.github.com/"
+
+// mediaType is the preview media type required by the GitHub App API.
+const mediaType = "application/vnd.github.machine-man-preview+json"
+
+// jwtExpiry is how long each JWT is valid, GitHub permits at most 10 minutes.
+const jwtExpiry = 9 * time.Minute
+
+// tokenExpiryMargin is how long before an installation access token expires
+// that it's replaced, so it does not expire while it's used.
+const tokenExpiryMargin = 5 * time.Minute
+
+// App authenticates as a GitHub App using a JWT signed by the App's private
+// key.
+type App struct {
+	id      int
+	key     *rsa.PrivateKey
+	client  *http.Client
+	baseURL string
+	now     func() time.Time
+
+	mu     sync.Mutex
+	tokens map[int]accessToken // installationID => cached access token
+}
+
+// accessToken is an access token authenticating as an installation.
+type accessToken struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// New returns an App for the GitHub App with appID, authenticated with the
+// PEM encoded privateKey, as downloaded from the App's settings.
+func New(appID int, privateKey []byte) (*App, error) {
+	block, _ := pem.Decode(privateKey)
+	if block == nil {
+		return nil, errors.New("could not decode PEM private key")
+	}
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		pkcs8, err8 := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err8 != nil {
+			return nil, errors.Wrap(err, "could not parse private key")
+		}
+		var ok bool
+		if key, ok = pkcs8.(*rsa.PrivateKey); !ok {
+			return nil, errors.New("private key is not an RSA key")
+		}
+	}
+	return &App{
+		id:      appID,
+		key:     key,
+		client:  http.DefaultClient,
+		baseURL: DefaultBaseURL,
+		now:     time.Now,
+		tokens:  make(map[int]accessToken),
+	}, nil
+}
+
+// SetBaseURL sets the base URL of the GitHub API, such as for GitHub
+// Enterprise or in tests.
+func (a *App) SetBaseURL(baseURL string) {
+	a.baseURL = strings.TrimSuffix(baseURL, "/") + "/"
+}
+
+// JWT returns a JSON Web Token signed with RS256 authenticating as the App.
+func (a *App) JWT() (string, error) {
+	now := a.now()
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]int64{
+		// Issued in the past to allow for clock drift
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(jwtExpiry).Unix(),
+		"iss": int64(a.id),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	hash := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, a.key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", errors.Wrap(err, "could not sign JWT")
+	}
+	return unsigned + "." + enc.EncodeToString(sig), nil
+}
+
+// Account types of an installation.
+const (
+	TypeUser         = "User"
+	TypeOrganization = "Organization"
+)
+
+// Installation is a GitHub App installation.
+type Installation struct {
+	ID           int
+	AccountID    int    // AccountID is the GitHub ID of the account the App is installed on.
+	AccountLogin string // AccountLogin is the login of the account the App is installed on.
+	AccountType  string // AccountType is TypeUser or TypeOrganization.
+	// SuspendedAt is when the installation was suspended, zero if the
+	// installation is not suspended.
+	SuspendedAt time.Time
+}
+
+// Suspended returns true if the installation is suspended.
+func (i *Installation) Suspended() bool {
+	return !i.SuspendedAt.IsZero()
+}
+
+// installation is the GitHub API response for an installation.
+type installation struct {
+	ID      int `json:"id"`
+	Account struct {
+		ID    int    `json:"id"`
+		Login string `json:"login"`
+		Type  string `json:"type"`
+	} `json:"account"`
+	SuspendedAt *time.Time `json:"suspended_at"`
+}
+
+// Installation returns the App's installation with installationID, or nil if
+// the installation does not exist, such as when it has been uninstalled.
+func (a *App) Installation(ctx context.Context, installationID int) (*Installation, error) {
+	token, err := a.JWT()
+	if err != nil {
+		return nil, err
+	}
+	var i installation
+	found, err := a.do(ctx, "GET", fmt.Sprintf("app/installations/%d", installationID), "Bearer "+token, &i)
+	if err != nil || !found {
+		return nil, errors.Wrapf(err, "could not get installationID %v", installationID)
+	}
+	inst := i.toInstallation()
+	return &inst, nil
+}
+
+// AccessToken returns a token authenticating as installationID. Tokens are
+// valid for one hour, and cached until shortly before they expire.
+func (a *App) AccessToken(ctx context.Context, installationID int) (string, error) {
+	a.mu.Lock()
+	cached, ok := a.tokens[installationID]
+	a.mu.Unlock()
+	if ok && a.now().Add(tokenExpiryMargin).Before(cached.ExpiresAt) {
+		return cached.Token, nil
+	}
+
+	jwt, err := a.JWT()
+	if err != nil {
+		return "", err
+	}
+	var token accessToken
+	found, err := a.do(ctx, "POST", fmt.Sprintf("installations/%d/access_tokens", installationID), "Bearer "+jwt, &token)
+	switch {
+	case err != nil:
+		return "", errors.Wrapf(err, "could not create access token for installationID %v", installationID)
+	case !found:
+		return "", fmt.Errorf("installationID %v not found", installationID)
+	}
+
+	a.mu.Lock()
+	a.tokens[installationID] = token
+	a.mu.Unlock()
+	return token.Token, nil
+}
+
+// reposPerPage is the number of repositories requested per page, the maximum
+// permitted by GitHub.
+const reposPerPage = 100
+
+// Repositories returns all repositories installationID has access to.
+func (a *App) Repositories(ctx context.Context, installationID int) ([]Repository, error) {
+	token, err := a.AccessToken(ctx, installationID)
+	if err != nil {
+		return nil, err
+	}
+	var repos []Repository
+	for page := 1; ; page++ {
+		var resp struct {
+			Repositories []Repository `json:"repositories"`
+		}
+		path := fmt.Sprintf("installation/repositories?per_page=%d&page=%d", reposPerPage, page)
+		if _, err := a.do(ctx, "GET", path, "token "+token, &resp); err != nil {
+			return nil, errors.Wrapf(err, "could not list repositories for installationID %v", installationID)
+		}
+		repos = append(repos, resp.Repositories...)
+		if len(resp.Repositories) < reposPerPage {
+			return repos, nil
+		}
+	}
+}
+
+// do sends a request with the Authorization header auth and decodes the JSON
+// response into v. found is false if GitHub responds with 404 Not Found.
+func (a *App) do(ctx context.Context, method, path, auth string, v interface{}) (found bool, err error) {
+	req, err := http.NewRequest(method, a.baseURL+path, nil)
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", auth)
+	req.Header.Set("Accept", mediaType)
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return false, nil
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return false, fmt.Errorf("unexpected status %v from %v", resp.Status, path)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return false, errors.Wrap(err, "could not decode response")
+	}
+	return true, nil
+}
@@ -0,0 +1,236 @@
+package githubapp
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestApp returns an App for appID with a new private key, and the key.
+func newTestApp(t *testing.T, appID int) (*App, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal("could not generate key:", err)
+	}
+	pemKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	app, err := New(appID, pemKey)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	return app, key
+}
+
+// verifyJWT verifies token is signed by key and returns its claims.
+func verifyJWT(t *testing.T, key *rsa.PrivateKey, token string) map[string]int64 {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("have %d JWT parts want 3", len(parts))
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		t.Fatal("could not decode signature:", err)
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, hash[:], sig); err != nil {
+		t.Fatal("invalid signature:", err)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatal("could not decode claims:", err)
+	}
+	var claims map[string]int64
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		t.Fatal("could not unmarshal claims:", err)
+	}
+	return claims
+}
+
+func TestNew_invalidKey(t *testing.T) {
+	if _, err := New(1, []byte("not a key")); err == nil {
+		t.Error("expected error for invalid key")
+	}
+}
+
+func TestJWT(t *testing.T) {
+	app, key := newTestApp(t, 123)
+	now := time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC)
+	app.now = func() time.Time { return now }
+
+	token, err := app.JWT()
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	claims := verifyJWT(t, key, token)
+	want := map[string]int64{
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(jwtExpiry).Unix(),
+		"iss": 123,
+	}
+	for claim, value := range want {
+		if claims[claim] != value {
+			t.Errorf("claim %v: have %v want %v", claim, claims[claim], value)
+		}
+	}
+}
+
+func TestInstallation(t *testing.T) {
+	app, key := newTestApp(t, 123)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if have := r.Header.Get("Accept"); have != mediaType {
+			t.Errorf("have accept %q want %q", have, mediaType)
+		}
+		if claims := verifyJWT(t, key, strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")); claims["iss"] != 123 {
+			t.Errorf("have iss %v want 123", claims["iss"])
+		}
+		switch r.URL.Path {
+		case "/app/installations/1":
+			fmt.Fprintln(w, `{"id": 1, "account": {"login": "gopherci", "id": 10, "type": "Organization"}, "suspended_at": null}`)
+		case "/app/installations/2":
+			fmt.Fprintln(w, `{"id": 2, "account": {"login": "gopher", "id": 20, "type": "User"}, "suspended_at": "2017-03-01T00:00:00Z"}`)
+		case "/app/installations/3":
+			http.Error(w, `{"message": "Server Error"}`, http.StatusInternalServerError)
+		default:
+			http.Error(w, `{"message": "Not Found"}`, http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+	app.SetBaseURL(ts.URL)
+
+	tests := []struct {
+		installationID int
+		want           *Installation
+		wantErr        bool
+	}{
+		{1, &Installation{ID: 1, AccountID: 10, AccountLogin: "gopherci", AccountType: TypeOrganization}, false},
+		{2, &Installation{ID: 2, AccountID: 20, AccountLogin: "gopher", AccountType: TypeUser, SuspendedAt: time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC)}, false},
+		{3, nil, true},
+		{4, nil, false},
+	}
+	for _, test := range tests {
+		have, err := app.Installation(context.Background(), test.installationID)
+		switch {
+		case test.wantErr && err == nil:
+			t.Errorf("installationID %v: expected error", test.installationID)
+		case !test.wantErr && err != nil:
+			t.Errorf("installationID %v: unexpected error: %v", test.installationID, err)
+		case test.want == nil && have != nil:
+			t.Errorf("installationID %v: have %+v want nil", test.installationID, have)
+		case test.want != nil && (have == nil || *have != *test.want):
+			t.Errorf("installationID %v:\nhave %+v\nwant %+v", test.installationID, have, test.want)
+		}
+	}
+
+	if inst, _ := app.Installation(context.Background(), 2); inst == nil || !inst.Suspended() {
+		t.Error("expected installation 2 to be suspended")
+	}
+}
+
+func TestRepositories(t *testing.T) {
+	app, _ := newTestApp(t, 123)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/installations/1/access_tokens":
+			if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+				t.Errorf("have authorization %q want JWT", r.Header.Get("Authorization"))
+			}
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprintln(w, `{"token": "v1.abc", "expires_at": "2017-03-01T01:00:00Z"}`)
+		case r.Method == "GET" && r.URL.Path == "/installation/repositories":
+			if have := r.Header.Get("Authorization"); have != "token v1.abc" {
+				t.Errorf("have authorization %q want installation token", have)
+			}
+			if r.URL.Query().Get("per_page") != "100" {
+				t.Errorf("have per_page %q want 100", r.URL.Query().Get("per_page"))
+			}
+			// First page is full, second page is the last
+			var repos []string
+			n, first := reposPerPage, 1
+			if r.URL.Query().Get("page") == "2" {
+				n, first = 1, reposPerPage+1
+			}
+			for i := 0; i < n; i++ {
+				repos = append(repos, fmt.Sprintf(`{"id": %d, "full_name": "gopherci/repo%d"}`, first+i, first+i))
+			}
+			fmt.Fprintf(w, `{"total_count": %d, "repositories": [%s]}`, reposPerPage+1, strings.Join(repos, ","))
+		default:
+			http.Error(w, `{"message": "Not Found"}`, http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+	app.SetBaseURL(ts.URL)
+
+	repos, err := app.Repositories(context.Background(), 1)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if len(repos) != reposPerPage+1 {
+		t.Fatalf("have %d repositories want %d", len(repos), reposPerPage+1)
+	}
+	if want := (Repository{ID: 101, FullName: "gopherci/repo101"}); repos[100] != want {
+		t.Errorf("have %+v want %+v", repos[100], want)
+	}
+
+	if _, err := app.Repositories(context.Background(), 2); err == nil {
+		t.Error("expected error for unknown installation")
+	}
+}
+
+func TestAccessToken_cached(t *testing.T) {
+	app, _ := newTestApp(t, 123)
+	now := time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC)
+	app.now = func() time.Time { return now }
+
+	var minted int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/installations/1/access_tokens" {
+			http.Error(w, `{"message": "Not Found"}`, http.StatusNotFound)
+			return
+		}
+		minted++
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"token": "v1.%d", "expires_at": "2017-03-01T01:00:00Z"}`, minted)
+	}))
+	defer ts.Close()
+	app.SetBaseURL(ts.URL)
+
+	tests := []struct {
+		now  time.Time
+		want string
+	}{
+		{now, "v1.1"},                       // minted
+		{now.Add(50 * time.Minute), "v1.1"}, // cached
+		{now.Add(56 * time.Minute), "v1.2"}, // expires within tokenExpiryMargin
+		{now.Add(2 * time.Hour), "v1.3"},    // expired
+	}
+	for _, test := range tests {
+		now = test.now
+		have, err := app.AccessToken(context.Background(), 1)
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if have != test.want {
+			t.Errorf("at %v: have token %q want %q", test.now, have, test.want)
+		}
+	}
+	if minted != 3 {
+		t.Errorf("have %d tokens minted want 3", minted)
+	}
+
+	if _, err := app.AccessToken(context.Background(), 2); err == nil {
+		t.Error("expected error for unknown installation")
+	}
+}
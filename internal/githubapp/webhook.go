@@ -0,0 +1,182 @@
+package githubapp
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"strings"
+
+	"github.com/bradleyfalzon/gopherci-web/internal/signature"
+	"github.com/pkg/errors"
+)
+
+// Webhook HTTP headers sent by GitHub.
+const (
+	// SignatureHeader is the HMAC-SHA256 signature of the payload.
+	SignatureHeader = "X-Hub-Signature-256"
+	// LegacySignatureHeader is the HMAC-SHA1 signature of the payload, only
+	// used if SignatureHeader is not sent.
+	LegacySignatureHeader = "X-Hub-Signature"
+	// EventHeader is the type of event, such as installation.
+	EventHeader = "X-GitHub-Event"
+	// DeliveryHeader is the unique ID of the delivery.
+	DeliveryHeader = "X-GitHub-Delivery"
+)
+
+var (
+	// ErrNotSigned is returned when the webhook has no signature header.
+	ErrNotSigned = errors.New("githubapp: webhook has no signature header")
+	// ErrInvalidHeader is returned when the signature header cannot be parsed.
+	ErrInvalidHeader = errors.New("githubapp: webhook has an invalid signature header")
+	// ErrNoValidSignature is returned when the webhook's signature does not
+	// match any of the configured secrets.
+	ErrNoValidSignature = errors.New("githubapp: webhook has no valid signature")
+)
+
+// WebhookVerifier verifies a webhook was sent by GitHub using the App's
+// webhook secrets.
+type WebhookVerifier struct {
+	secrets signature.Secrets
+}
+
+// NewWebhookVerifier returns a WebhookVerifier for the App's webhook secrets.
+func NewWebhookVerifier(secrets ...string) *WebhookVerifier {
+	return &WebhookVerifier{secrets: signature.NewSecrets(secrets...)}
+}
+
+// Verify checks the payload matches the signature header, in the form of
+// sha256=abc or sha1=abc. Returns nil if the payload is authentic, or
+// ErrNotSigned, ErrInvalidHeader or ErrNoValidSignature.
+func (v *WebhookVerifier) Verify(payload []byte, header string) error {
+	if header == "" {
+		return ErrNotSigned
+	}
+	parts := strings.SplitN(header, "=", 2)
+	if len(parts) != 2 {
+		return ErrInvalidHeader
+	}
+	var h func() hash.Hash
+	switch parts[0] {
+	case "sha256":
+		h = sha256.New
+	case "sha1":
+		h = sha1.New
+	default:
+		return ErrInvalidHeader
+	}
+	sig, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return ErrInvalidHeader
+	}
+	if !v.secrets.Verify(h, payload, sig) {
+		return ErrNoValidSignature
+	}
+	return nil
+}
+
+// SignWebhook returns a SignatureHeader value for payload signed with secret,
+// it behaves like GitHub and is used to send fake webhooks in tests and
+// development.
+func SignWebhook(payload []byte, secret string) string {
+	return "sha256=" + hex.EncodeToString(signature.Sign(sha256.New, secret, payload))
+}
+
+// Installation event actions.
+const (
+	ActionCreated   = "created"
+	ActionDeleted   = "deleted"
+	ActionSuspend   = "suspend"
+	ActionUnsuspend = "unsuspend"
+)
+
+// InstallationEvent is sent when the App is installed, uninstalled,
+// suspended or unsuspended.
+type InstallationEvent struct {
+	Action       string // Action is ActionCreated, ActionDeleted, ActionSuspend or ActionUnsuspend.
+	Installation Installation
+	Sender       string // Sender is the login of the user who triggered the event.
+}
+
+// Repository is a repository an installation has access to.
+type Repository struct {
+	ID       int    `json:"id"`
+	FullName string `json:"full_name"` // FullName is the owner and name, such as gopherci/gopherci-web.
+}
+
+// Installation repositories event actions.
+const (
+	ActionAdded   = "added"
+	ActionRemoved = "removed"
+)
+
+// InstallationRepositoriesEvent is sent when repositories are added to or
+// removed from an installation.
+type InstallationRepositoriesEvent struct {
+	Action       string // Action is ActionAdded or ActionRemoved.
+	Installation Installation
+	// RepositorySelection is "all" if the installation has access to all of
+	// the account's repositories, else "selected".
+	RepositorySelection string
+	Added               []Repository
+	Removed             []Repository
+	Sender              string // Sender is the login of the user who triggered the event.
+}
+
+// event is the fields common to GitHub App webhook payloads.
+type event struct {
+	Action       string       `json:"action"`
+	Installation installation `json:"installation"`
+	Sender       struct {
+		Login string `json:"login"`
+	} `json:"sender"`
+	RepositorySelection string       `json:"repository_selection"`
+	RepositoriesAdded   []Repository `json:"repositories_added"`
+	RepositoriesRemoved []Repository `json:"repositories_removed"`
+}
+
+// ParseInstallationEvent parses the payload of an installation event.
+func ParseInstallationEvent(payload []byte) (*InstallationEvent, error) {
+	var e event
+	if err := json.Unmarshal(payload, &e); err != nil {
+		return nil, errors.Wrap(err, "could not unmarshal installation event")
+	}
+	return &InstallationEvent{
+		Action:       e.Action,
+		Installation: e.Installation.toInstallation(),
+		Sender:       e.Sender.Login,
+	}, nil
+}
+
+// ParseInstallationRepositoriesEvent parses the payload of an
+// installation_repositories event.
+func ParseInstallationRepositoriesEvent(payload []byte) (*InstallationRepositoriesEvent, error) {
+	var e event
+	if err := json.Unmarshal(payload, &e); err != nil {
+		return nil, errors.Wrap(err, "could not unmarshal installation_repositories event")
+	}
+	return &InstallationRepositoriesEvent{
+		Action:              e.Action,
+		Installation:        e.Installation.toInstallation(),
+		RepositorySelection: e.RepositorySelection,
+		Added:               e.RepositoriesAdded,
+		Removed:             e.RepositoriesRemoved,
+		Sender:              e.Sender.Login,
+	}, nil
+}
+
+// toInstallation converts the GitHub API representation of an installation
+// to an Installation.
+func (i installation) toInstallation() Installation {
+	inst := Installation{
+		ID:           i.ID,
+		AccountID:    i.Account.ID,
+		AccountLogin: i.Account.Login,
+		AccountType:  i.Account.Type,
+	}
+	if i.SuspendedAt != nil {
+		inst.SuspendedAt = i.SuspendedAt.UTC()
+	}
+	return inst
+}
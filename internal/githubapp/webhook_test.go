@@ -0,0 +1,99 @@
+package githubapp
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWebhookVerifier_Verify(t *testing.T) {
+	payload := []byte(`{"action":"deleted"}`)
+
+	mac := hmac.New(sha1.New, []byte("secret"))
+	mac.Write(payload)
+	legacy := "sha1=" + hex.EncodeToString(mac.Sum(nil))
+
+	tests := []struct {
+		desc    string
+		secrets []string
+		header  string
+		wantErr error
+	}{
+		{"valid", []string{"secret"}, SignWebhook(payload, "secret"), nil},
+		{"valid sha1", []string{"secret"}, legacy, nil},
+		{"rotated secret", []string{"old", "secret"}, SignWebhook(payload, "secret"), nil},
+		{"wrong secret", []string{"secret"}, SignWebhook(payload, "other"), ErrNoValidSignature},
+		{"no secrets", nil, SignWebhook(payload, "secret"), ErrNoValidSignature},
+		{"not signed", []string{"secret"}, "", ErrNotSigned},
+		{"unknown algorithm", []string{"secret"}, "md5=abc", ErrInvalidHeader},
+		{"malformed", []string{"secret"}, "garbage", ErrInvalidHeader},
+		{"bad hex", []string{"secret"}, "sha256=zz", ErrInvalidHeader},
+	}
+	for _, test := range tests {
+		v := NewWebhookVerifier(test.secrets...)
+		if err := v.Verify(payload, test.header); err != test.wantErr {
+			t.Errorf("%s: have err %v, want %v", test.desc, err, test.wantErr)
+		}
+	}
+
+	v := NewWebhookVerifier("secret")
+	if err := v.Verify([]byte(`{"action":"created"}`), SignWebhook(payload, "secret")); err != ErrNoValidSignature {
+		t.Errorf("tampered payload: have err %v, want %v", err, ErrNoValidSignature)
+	}
+}
+
+func TestParseInstallationEvent(t *testing.T) {
+	payload := []byte(`{
+		"action": "suspend",
+		"installation": {"id": 1, "account": {"login": "gopherci", "id": 10, "type": "Organization"}, "suspended_at": "2017-03-01T00:00:00Z"},
+		"sender": {"login": "gopher"}
+	}`)
+	have, err := ParseInstallationEvent(payload)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	want := &InstallationEvent{
+		Action: ActionSuspend,
+		Installation: Installation{
+			ID: 1, AccountID: 10, AccountLogin: "gopherci", AccountType: TypeOrganization,
+			SuspendedAt: time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC),
+		},
+		Sender: "gopher",
+	}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("\nhave %+v\nwant %+v", have, want)
+	}
+
+	if _, err := ParseInstallationEvent([]byte(`{`)); err == nil {
+		t.Error("expected error for invalid payload")
+	}
+}
+
+func TestParseInstallationRepositoriesEvent(t *testing.T) {
+	payload := []byte(`{
+		"action": "added",
+		"installation": {"id": 1, "account": {"login": "gopherci", "id": 10, "type": "Organization"}},
+		"repository_selection": "selected",
+		"repositories_added": [{"id": 100, "full_name": "gopherci/gopherci"}],
+		"repositories_removed": [],
+		"sender": {"login": "gopher"}
+	}`)
+	have, err := ParseInstallationRepositoriesEvent(payload)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	want := &InstallationRepositoriesEvent{
+		Action:              ActionAdded,
+		Installation:        Installation{ID: 1, AccountID: 10, AccountLogin: "gopherci", AccountType: TypeOrganization},
+		RepositorySelection: "selected",
+		Added:               []Repository{{ID: 100, FullName: "gopherci/gopherci"}},
+		Removed:             []Repository{},
+		Sender:              "gopher",
+	}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("\nhave %+v\nwant %+v", have, want)
+	}
+}
@@ -5,6 +5,10 @@ package gopherci
 
 import (
 	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
 
 	"github.com/jmoiron/sqlx"
 )
@@ -43,6 +47,20 @@ func (c *Client) ListInstallations(accountIDs ...int) ([]Installation, error) {
 	return installations, nil
 }
 
+// GetInstallation returns an installation by its installationID, if no
+// installation was found, installation is nil.
+func (c *Client) GetInstallation(installationID int) (*Installation, error) {
+	var installation Installation
+	err := c.db.Get(&installation, "SELECT installation_id, account_id FROM gh_installations WHERE installation_id = ?", installationID)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	return &installation, nil
+}
+
 // EnableInstallation enables an installationID in GopherCI's DB.
 func (c *Client) EnableInstallation(installationID int) error {
 	_, err := c.db.Exec("UPDATE gh_installations SET enabled_at = NOW() WHERE installation_id = ?", installationID)
@@ -54,3 +72,295 @@ func (c *Client) DisableInstallation(installationID int) error {
 	_, err := c.db.Exec("UPDATE gh_installations SET enabled_at = NULL WHERE installation_id = ?", installationID)
 	return err
 }
+
+// EnabledInstallations returns the installationIDs of all installations
+// currently enabled in GopherCI's DB.
+func (c *Client) EnabledInstallations() ([]int, error) {
+	var enabled []int
+	err := c.db.Select(&enabled, "SELECT installation_id FROM gh_installations WHERE enabled_at IS NOT NULL ORDER BY installation_id")
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	return enabled, nil
+}
+
+// ExistingInstallations returns the subset of installationIDs which exist in
+// GopherCI's DB, installations are removed when the App is uninstalled.
+func (c *Client) ExistingInstallations(installationIDs ...int) ([]int, error) {
+	if len(installationIDs) == 0 {
+		return nil, nil
+	}
+	query, args, err := sqlx.In("SELECT installation_id FROM gh_installations WHERE installation_id IN (?)", installationIDs)
+	if err != nil {
+		return nil, err
+	}
+	var existing []int
+	err = c.db.Select(&existing, query, args...)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	return existing, nil
+}
+
+// ExcludedRepositories returns the repositoryIDs of installationID which
+// GopherCI does not analyse, all other repositories are analysed. Exclusions
+// are stored in the gh_installation_excluded_repositories table, with the
+// columns installation_id and repository_id, created by GopherCI's migration
+// in migrations/gh_installation_excluded_repositories.sql.
+func (c *Client) ExcludedRepositories(installationID int) ([]int, error) {
+	var excluded []int
+	err := c.db.Select(&excluded, "SELECT repository_id FROM gh_installation_excluded_repositories WHERE installation_id = ? ORDER BY repository_id", installationID)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	return excluded, nil
+}
+
+// SetExcludedRepositories replaces the repositories of installationID which
+// GopherCI does not analyse with repositoryIDs.
+func (c *Client) SetExcludedRepositories(installationID int, repositoryIDs []int) error {
+	tx, err := c.db.Beginx()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM gh_installation_excluded_repositories WHERE installation_id = ?", installationID)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	for _, repositoryID := range repositoryIDs {
+		_, err = tx.Exec("INSERT INTO gh_installation_excluded_repositories (installation_id, repository_id) VALUES (?, ?)", installationID, repositoryID)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// RemoveExcludedRepositories removes the exclusions of repositoryIDs from
+// installationID, such as after the repositories are removed from the
+// installation, so they're analysed if they're added again.
+func (c *Client) RemoveExcludedRepositories(installationID int, repositoryIDs ...int) error {
+	if len(repositoryIDs) == 0 {
+		return nil
+	}
+	query, args, err := sqlx.In("DELETE FROM gh_installation_excluded_repositories WHERE installation_id = ? AND repository_id IN (?)", installationID, repositoryIDs)
+	if err != nil {
+		return err
+	}
+	_, err = c.db.Exec(query, args...)
+	return err
+}
+
+// Tool represents a row from the tools table, a static analysis tool
+// GopherCI knows how to run.
+type Tool struct {
+	ToolID int    `db:"id"`
+	Name   string `db:"name"`
+	URL    string `db:"url"`
+	Args   string `db:"args"` // Args are the default arguments.
+}
+
+// ListTools returns all tools known to GopherCI, ordered by name.
+func (c *Client) ListTools() ([]Tool, error) {
+	var tools []Tool
+	err := c.db.Select(&tools, "SELECT id, name, url, args FROM tools ORDER BY name")
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	return tools, nil
+}
+
+// RepositoryTool is the configuration of a tool for a single repository.
+// Configurations are stored in the gh_repository_tools table, with the
+// columns repository_id, tool_id, enabled and args, created by GopherCI's
+// migration in migrations/gh_repository_tools.sql. Tools without a
+// configuration are enabled with their default arguments.
+type RepositoryTool struct {
+	ToolID  int    `db:"tool_id"`
+	Enabled bool   `db:"enabled"`
+	Args    string `db:"args"`
+}
+
+// maxToolArgs is the maximum length of a tool's arguments.
+const maxToolArgs = 255
+
+// toolFlags are the flags, without leading dashes, which users may pass to
+// each tool by name. Tools not listed accept no flags.
+var toolFlags = map[string][]string{
+	"golint":      {"min_confidence", "set_exit_status"},
+	"vet":         vetFlags,
+	"go vet":      vetFlags,
+	"megacheck":   {"tests", "ignore", "go", "simple.enabled", "staticcheck.enabled", "unused.enabled"},
+	"staticcheck": {"tests", "ignore", "go"},
+	"gosimple":    {"tests", "ignore", "go"},
+	"unused":      {"tests", "ignore", "go", "exported"},
+	"errcheck":    {"blank", "asserts", "ignore", "ignoretests"},
+}
+
+// vetFlags are the flags accepted by go vet.
+var vetFlags = []string{
+	"all", "asmdecl", "assign", "atomic", "bool", "buildtags", "composites",
+	"copylocks", "httpresponse", "lostcancel", "methods", "nilfunc", "printf",
+	"printfuncs", "rangeloops", "shadow", "shadowstrict", "shift", "structtags",
+	"tests", "unreachable", "unsafeptr", "unusedresult",
+}
+
+// isToolArgRune returns true if r may be used in a tool's arguments. Shell
+// metacharacters, such as quotes, redirections and substitutions, are not
+// permitted.
+func isToolArgRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == ' ' || strings.ContainsRune("-_.,=:/", r)
+}
+
+// validateToolArgs returns *ConfigError if args for the tool name contains
+// characters other than those permitted by isToolArgRune, or a flag not in the
+// tool's toolFlags.
+func validateToolArgs(name, args string) error {
+	for _, r := range args {
+		if !isToolArgRune(r) {
+			return &ConfigError{Reason: fmt.Sprintf("%s arguments must not contain %q", name, r)}
+		}
+	}
+	for _, arg := range strings.Fields(args) {
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		flag := strings.SplitN(strings.TrimLeft(arg, "-"), "=", 2)[0]
+		if !containsString(toolFlags[name], flag) {
+			return &ConfigError{Reason: fmt.Sprintf("%s does not accept the flag %q", name, arg)}
+		}
+	}
+	return nil
+}
+
+// containsString returns true if s is in list.
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ConfigError is returned when a repository's tool configuration is invalid,
+// the message is suitable to show to the user.
+type ConfigError struct {
+	Reason string
+}
+
+// Error implements the error interface.
+func (e *ConfigError) Error() string {
+	return "Invalid tool configuration, " + e.Reason
+}
+
+// ValidateRepositoryTools returns *ConfigError if configs contains a tool not
+// in tools, the same tool more than once, or invalid arguments. Arguments are
+// limited to the flags in toolFlags and must not contain shell metacharacters.
+func ValidateRepositoryTools(tools []Tool, configs []RepositoryTool) error {
+	known := make(map[int]string)
+	for _, tool := range tools {
+		known[tool.ToolID] = tool.Name
+	}
+	seen := make(map[int]bool)
+	for _, config := range configs {
+		name, ok := known[config.ToolID]
+		switch {
+		case !ok:
+			return &ConfigError{Reason: fmt.Sprintf("unknown toolID %v", config.ToolID)}
+		case seen[config.ToolID]:
+			return &ConfigError{Reason: fmt.Sprintf("%s configured more than once", name)}
+		case len(config.Args) > maxToolArgs:
+			return &ConfigError{Reason: fmt.Sprintf("%s arguments must be at most %d characters", name, maxToolArgs)}
+		case strings.IndexFunc(config.Args, unicode.IsControl) >= 0:
+			return &ConfigError{Reason: fmt.Sprintf("%s arguments must not contain control characters", name)}
+		}
+		if err := validateToolArgs(name, config.Args); err != nil {
+			return err
+		}
+		seen[config.ToolID] = true
+	}
+	return nil
+}
+
+// RepositoryTools returns the tool configurations of repositoryID, tools
+// without a configuration are not included.
+func (c *Client) RepositoryTools(repositoryID int) ([]RepositoryTool, error) {
+	var configs []RepositoryTool
+	err := c.db.Select(&configs, "SELECT tool_id, enabled, args FROM gh_repository_tools WHERE repository_id = ? ORDER BY tool_id", repositoryID)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	return configs, nil
+}
+
+// SetRepositoryTools replaces the tool configurations of repositoryID with
+// configs. Returns *ConfigError if configs are not valid for the tools known
+// to GopherCI.
+func (c *Client) SetRepositoryTools(repositoryID int, configs []RepositoryTool) error {
+	tools, err := c.ListTools()
+	if err != nil {
+		return err
+	}
+	if err := ValidateRepositoryTools(tools, configs); err != nil {
+		return err
+	}
+
+	tx, err := c.db.Beginx()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM gh_repository_tools WHERE repository_id = ?", repositoryID)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	for _, config := range configs {
+		_, err = tx.Exec("INSERT INTO gh_repository_tools (repository_id, tool_id, enabled, args) VALUES (?, ?, ?, ?)", repositoryID, config.ToolID, config.Enabled, config.Args)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// CountDailyAnalyses returns the number of analyses started for each of
+// installationIDs on the UTC day containing day. Installations without any
+// analyses are not included in the returned map.
+func (c *Client) CountDailyAnalyses(day time.Time, installationIDs ...int) (map[int]int, error) {
+	counts := make(map[int]int)
+	if len(installationIDs) == 0 {
+		return counts, nil
+	}
+
+	start := StartOfDay(day)
+	query, args, err := sqlx.In(`SELECT installation_id, COUNT(*) AS analyses FROM analysis
+WHERE installation_id IN (?) AND created_at >= ? AND created_at < ? GROUP BY installation_id`,
+		installationIDs, start, start.AddDate(0, 0, 1))
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []struct {
+		InstallationID int `db:"installation_id"`
+		Analyses       int `db:"analyses"`
+	}
+	err = c.db.Select(&rows, query, args...)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	for _, row := range rows {
+		counts[row.InstallationID] = row.Analyses
+	}
+	return counts, nil
+}
+
+// StartOfDay returns midnight UTC of the day containing t, this is when
+// daily build limits are reset.
+func StartOfDay(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
@@ -4,7 +4,9 @@ import (
 	"database/sql"
 	"errors"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	sqlmock "github.com/bradleyfalzon/go-sqlmock"
 	"github.com/jmoiron/sqlx"
@@ -72,6 +74,52 @@ func TestListInstallations(t *testing.T) {
 	}
 }
 
+func TestGetInstallation(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	const installationID = 1
+
+	mock.ExpectQuery("SELECT installation_id, account_id FROM gh_installations WHERE installation_id = ?").
+		WithArgs(installationID).
+		WillReturnRows(sqlmock.NewRows([]string{"installation_id", "account_id"}).AddRow(installationID, 2))
+
+	client := New(sqlx.NewDb(db, "sqlmock"))
+	installation, err := client.GetInstallation(installationID)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	want := &Installation{InstallationID: installationID, AccountID: 2}
+	if !reflect.DeepEqual(installation, want) {
+		t.Errorf("have %+v want %+v", installation, want)
+	}
+}
+
+func TestGetInstallation_notFound(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT installation_id, account_id FROM gh_installations WHERE installation_id = ?").
+		WithArgs(1).
+		WillReturnError(sql.ErrNoRows)
+
+	client := New(sqlx.NewDb(db, "sqlmock"))
+	installation, err := client.GetInstallation(1)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if installation != nil {
+		t.Errorf("expected nil installation, have %+v", installation)
+	}
+}
+
 func TestEnableInstallation(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
@@ -111,3 +159,275 @@ func TestDisableInstallation(t *testing.T) {
 		t.Fatal("expected error")
 	}
 }
+
+func TestEnabledInstallations(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(`SELECT installation_id FROM gh_installations WHERE enabled_at IS NOT NULL ORDER BY installation_id`).
+		WillReturnRows(sqlmock.NewRows([]string{"installation_id"}).AddRow(1).AddRow(3))
+
+	client := New(sqlx.NewDb(db, "sqlmock"))
+	enabled, err := client.EnabledInstallations()
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if want := []int{1, 3}; !reflect.DeepEqual(enabled, want) {
+		t.Errorf("have %v want %v", enabled, want)
+	}
+}
+
+func TestExistingInstallations(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(`SELECT installation_id FROM gh_installations WHERE installation_id IN \(\?, \?\)`).
+		WithArgs(1, 2).
+		WillReturnRows(sqlmock.NewRows([]string{"installation_id"}).AddRow(1))
+
+	client := New(sqlx.NewDb(db, "sqlmock"))
+	existing, err := client.ExistingInstallations(1, 2)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if want := []int{1}; !reflect.DeepEqual(existing, want) {
+		t.Errorf("have %v want %v", existing, want)
+	}
+}
+
+func TestExcludedRepositories(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(`SELECT repository_id FROM gh_installation_excluded_repositories WHERE installation_id = \? ORDER BY repository_id`).
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"repository_id"}).AddRow(10).AddRow(11))
+
+	client := New(sqlx.NewDb(db, "sqlmock"))
+	excluded, err := client.ExcludedRepositories(1)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if want := []int{10, 11}; !reflect.DeepEqual(excluded, want) {
+		t.Errorf("have %v want %v", excluded, want)
+	}
+}
+
+func TestSetExcludedRepositories(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`DELETE FROM gh_installation_excluded_repositories WHERE installation_id = \?`).
+		WithArgs(1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	for _, repositoryID := range []int{10, 12} {
+		mock.ExpectExec(`INSERT INTO gh_installation_excluded_repositories \(installation_id, repository_id\) VALUES \(\?, \?\)`).
+			WithArgs(1, repositoryID).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+	mock.ExpectCommit()
+
+	client := New(sqlx.NewDb(db, "sqlmock"))
+	if err := client.SetExcludedRepositories(1, []int{10, 12}); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestRemoveExcludedRepositories(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec(`DELETE FROM gh_installation_excluded_repositories WHERE installation_id = \? AND repository_id IN \(\?, \?\)`).
+		WithArgs(1, 10, 12).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	client := New(sqlx.NewDb(db, "sqlmock"))
+	if err := client.RemoveExcludedRepositories(1, 10, 12); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := client.RemoveExcludedRepositories(1); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestValidateRepositoryTools(t *testing.T) {
+	tools := []Tool{{ToolID: 1, Name: "golint"}, {ToolID: 2, Name: "vet"}}
+
+	tests := []struct {
+		configs []RepositoryTool
+		wantErr bool
+	}{
+		{nil, false},
+		{[]RepositoryTool{{ToolID: 1, Enabled: true, Args: "-min_confidence 0.3"}, {ToolID: 2}}, false},
+		{[]RepositoryTool{{ToolID: 3, Enabled: true}}, true},
+		{[]RepositoryTool{{ToolID: 1}, {ToolID: 1, Enabled: true}}, true},
+		{[]RepositoryTool{{ToolID: 1, Args: strings.Repeat("a", maxToolArgs+1)}}, true},
+		{[]RepositoryTool{{ToolID: 1, Args: "-a\n-b"}}, true},
+		{[]RepositoryTool{{ToolID: 1, Args: "--min_confidence=0.3 ./..."}, {ToolID: 2, Args: "-shadow -printfuncs=Logf,Errorf"}}, false},
+		{[]RepositoryTool{{ToolID: 1, Args: "-min_confidence 0.3; rm -rf /"}}, true},  // shell metacharacter
+		{[]RepositoryTool{{ToolID: 1, Args: "$(curl example.com)"}}, true},            // command substitution
+		{[]RepositoryTool{{ToolID: 1, Args: "-min_confidence 0.3 > /tmp/out"}}, true}, // redirection
+		{[]RepositoryTool{{ToolID: 2, Args: "-toolexec=/bin/sh"}}, true},              // flag not allowed
+		{[]RepositoryTool{{ToolID: 1, Args: "-shadow"}}, true},                        // flag of another tool
+	}
+	for _, test := range tests {
+		err := ValidateRepositoryTools(tools, test.configs)
+		switch {
+		case test.wantErr && err == nil:
+			t.Errorf("%+v: expected error", test.configs)
+		case !test.wantErr && err != nil:
+			t.Errorf("%+v: unexpected error: %v", test.configs, err)
+		}
+		if _, ok := err.(*ConfigError); err != nil && !ok {
+			t.Errorf("%+v: have err %T, want *ConfigError", test.configs, err)
+		}
+	}
+}
+
+func TestRepositoryTools(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(`SELECT tool_id, enabled, args FROM gh_repository_tools WHERE repository_id = \? ORDER BY tool_id`).
+		WithArgs(10).
+		WillReturnRows(sqlmock.NewRows([]string{"tool_id", "enabled", "args"}).AddRow(1, false, "").AddRow(2, true, "-shadow"))
+
+	client := New(sqlx.NewDb(db, "sqlmock"))
+	configs, err := client.RepositoryTools(10)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	want := []RepositoryTool{{ToolID: 1}, {ToolID: 2, Enabled: true, Args: "-shadow"}}
+	if !reflect.DeepEqual(configs, want) {
+		t.Errorf("have %+v want %+v", configs, want)
+	}
+}
+
+func TestSetRepositoryTools(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	tools := sqlmock.NewRows([]string{"id", "name", "url", "args"}).
+		AddRow(1, "golint", "https://github.com/golang/lint", "").
+		AddRow(2, "vet", "https://golang.org/cmd/vet/", "")
+	mock.ExpectQuery(`SELECT id, name, url, args FROM tools ORDER BY name`).WillReturnRows(tools)
+	mock.ExpectBegin()
+	mock.ExpectExec(`DELETE FROM gh_repository_tools WHERE repository_id = \?`).
+		WithArgs(10).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(`INSERT INTO gh_repository_tools \(repository_id, tool_id, enabled, args\) VALUES \(\?, \?, \?, \?\)`).
+		WithArgs(10, 1, false, "").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`INSERT INTO gh_repository_tools \(repository_id, tool_id, enabled, args\) VALUES \(\?, \?, \?, \?\)`).
+		WithArgs(10, 2, true, "-shadow").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	client := New(sqlx.NewDb(db, "sqlmock"))
+	err = client.SetRepositoryTools(10, []RepositoryTool{{ToolID: 1}, {ToolID: 2, Enabled: true, Args: "-shadow"}})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestSetRepositoryTools_unknownTool(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	tools := sqlmock.NewRows([]string{"id", "name", "url", "args"}).AddRow(1, "golint", "https://github.com/golang/lint", "")
+	mock.ExpectQuery(`SELECT id, name, url, args FROM tools ORDER BY name`).WillReturnRows(tools)
+
+	// Configurations are not changed if any tool is unknown.
+	client := New(sqlx.NewDb(db, "sqlmock"))
+	err = client.SetRepositoryTools(10, []RepositoryTool{{ToolID: 1, Enabled: true}, {ToolID: 3, Enabled: true}})
+	if _, ok := err.(*ConfigError); !ok {
+		t.Fatalf("have err %v, want *ConfigError", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestCountDailyAnalyses(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	var (
+		day   = time.Date(2017, 5, 1, 13, 14, 15, 0, time.UTC)
+		start = time.Date(2017, 5, 1, 0, 0, 0, 0, time.UTC)
+		end   = time.Date(2017, 5, 2, 0, 0, 0, 0, time.UTC)
+	)
+
+	mock.ExpectQuery(`SELECT installation_id, COUNT\(\*\) AS analyses FROM analysis\s+WHERE installation_id IN \(\?, \?\) AND created_at >= \? AND created_at < \?`).
+		WithArgs(1, 2, start, end).
+		WillReturnRows(sqlmock.NewRows([]string{"installation_id", "analyses"}).AddRow(1, 5))
+
+	client := New(sqlx.NewDb(db, "sqlmock"))
+	counts, err := client.CountDailyAnalyses(day, 1, 2)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if want := map[int]int{1: 5}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("have %v want %v", counts, want)
+	}
+}
+
+func TestStartOfDay(t *testing.T) {
+	aest := time.FixedZone("AEST", 10*60*60)
+	tests := []struct {
+		t    time.Time
+		want time.Time
+	}{
+		{time.Date(2017, 5, 1, 0, 0, 0, 0, time.UTC), time.Date(2017, 5, 1, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2017, 5, 1, 23, 59, 59, 0, time.UTC), time.Date(2017, 5, 1, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2017, 5, 2, 9, 0, 0, 0, aest), time.Date(2017, 5, 1, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, test := range tests {
+		if have := StartOfDay(test.t); !have.Equal(test.want) {
+			t.Errorf("StartOfDay(%v) have %v want %v", test.t, have, test.want)
+		}
+	}
+}
@@ -0,0 +1,10 @@
+-- +migrate Up
+CREATE TABLE gh_installation_excluded_repositories (
+    installation_id INT UNSIGNED NOT NULL,
+    repository_id INT UNSIGNED NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (installation_id, repository_id)
+) ENGINE=innodb;
+
+-- +migrate Down
+DROP TABLE gh_installation_excluded_repositories;
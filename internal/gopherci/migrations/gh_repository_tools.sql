@@ -0,0 +1,13 @@
+-- +migrate Up
+CREATE TABLE gh_repository_tools (
+    repository_id INT UNSIGNED NOT NULL,
+    tool_id INT UNSIGNED NOT NULL,
+    enabled BOOLEAN NOT NULL DEFAULT TRUE,
+    args VARCHAR(255) NOT NULL DEFAULT "",
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (repository_id, tool_id),
+    FOREIGN KEY (tool_id) REFERENCES tools (id) ON DELETE CASCADE
+) ENGINE=innodb;
+
+-- +migrate Down
+DROP TABLE gh_repository_tools;
@@ -0,0 +1,92 @@
+// Package money formats amounts of money for display.
+//
+// Amounts are integers in a currency's smallest unit, as used by stripe, such
+// as cents for USD or yen for JPY.
+package money
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Currency describes how amounts in a currency are displayed.
+type Currency struct {
+	Code     string // Code is the upper case ISO 4217 currency code, such as USD.
+	Symbol   string // Symbol is the currency symbol, such as $, or blank if none.
+	Exponent int    // Exponent is the number of decimal places of the smallest unit.
+}
+
+// currencies contains the currencies with known symbols or exponents other
+// than 2, keyed by upper case code.
+var currencies = map[string]Currency{
+	"AUD": {Code: "AUD", Symbol: "$", Exponent: 2},
+	"BIF": {Code: "BIF", Symbol: "FBu", Exponent: 0},
+	"CAD": {Code: "CAD", Symbol: "$", Exponent: 2},
+	"CLP": {Code: "CLP", Symbol: "$", Exponent: 0},
+	"DJF": {Code: "DJF", Symbol: "Fdj", Exponent: 0},
+	"EUR": {Code: "EUR", Symbol: "€", Exponent: 2},
+	"GBP": {Code: "GBP", Symbol: "£", Exponent: 2},
+	"GNF": {Code: "GNF", Symbol: "FG", Exponent: 0},
+	"JPY": {Code: "JPY", Symbol: "¥", Exponent: 0},
+	"KMF": {Code: "KMF", Symbol: "CF", Exponent: 0},
+	"KRW": {Code: "KRW", Symbol: "₩", Exponent: 0},
+	"MGA": {Code: "MGA", Symbol: "Ar", Exponent: 0},
+	"NZD": {Code: "NZD", Symbol: "$", Exponent: 2},
+	"PYG": {Code: "PYG", Symbol: "₲", Exponent: 0},
+	"RWF": {Code: "RWF", Symbol: "FRw", Exponent: 0},
+	"USD": {Code: "USD", Symbol: "$", Exponent: 2},
+	"VND": {Code: "VND", Symbol: "₫", Exponent: 0},
+	"VUV": {Code: "VUV", Symbol: "VT", Exponent: 0},
+	"XAF": {Code: "XAF", Symbol: "FCFA", Exponent: 0},
+	"XOF": {Code: "XOF", Symbol: "CFA", Exponent: 0},
+	"XPF": {Code: "XPF", Symbol: "F", Exponent: 0},
+}
+
+// Lookup returns the Currency for code, which is case insensitive. Unknown
+// currencies have no symbol and an exponent of 2.
+func Lookup(code string) Currency {
+	code = strings.ToUpper(code)
+	if c, ok := currencies[code]; ok {
+		return c
+	}
+	return Currency{Code: code, Exponent: 2}
+}
+
+// Format returns amount, in the smallest unit of currency, formatted for
+// display, such as "$1,234.50 USD" or "¥500 JPY".
+func Format(currency string, amount int64) string {
+	return Lookup(currency).Format(amount)
+}
+
+// Format returns amount, in the smallest unit of c, formatted for display.
+func (c Currency) Format(amount int64) string {
+	var sign string
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+
+	digits := strconv.FormatInt(amount, 10)
+	if len(digits) <= c.Exponent {
+		digits = strings.Repeat("0", c.Exponent-len(digits)+1) + digits
+	}
+	whole, frac := digits[:len(digits)-c.Exponent], digits[len(digits)-c.Exponent:]
+
+	// Group the whole units by thousands
+	var grouped []byte
+	for i := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			grouped = append(grouped, ',')
+		}
+		grouped = append(grouped, whole[i])
+	}
+
+	s := sign + c.Symbol + string(grouped)
+	if frac != "" {
+		s += "." + frac
+	}
+	if c.Code != "" {
+		s += " " + c.Code
+	}
+	return s
+}
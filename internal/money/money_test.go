@@ -0,0 +1,50 @@
+package money
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLookup(t *testing.T) {
+	tests := []struct {
+		code string
+		want Currency
+	}{
+		{"usd", Currency{Code: "USD", Symbol: "$", Exponent: 2}},
+		{"JPY", Currency{Code: "JPY", Symbol: "¥", Exponent: 0}},
+		{"xyz", Currency{Code: "XYZ", Exponent: 2}},
+	}
+	for _, test := range tests {
+		if have := Lookup(test.code); !reflect.DeepEqual(have, test.want) {
+			t.Errorf("code %q: have %+v want %+v", test.code, have, test.want)
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		currency string
+		amount   int64
+		want     string
+	}{
+		{"usd", 0, "$0.00 USD"},
+		{"usd", 5, "$0.05 USD"},
+		{"usd", 50, "$0.50 USD"},
+		{"usd", 399, "$3.99 USD"},
+		{"usd", 123456789, "$1,234,567.89 USD"},
+		{"usd", -500, "-$5.00 USD"},
+		{"aud", 1000, "$10.00 AUD"},
+		{"eur", 100000, "€1,000.00 EUR"},
+		{"gbp", 250, "£2.50 GBP"},
+		{"jpy", 0, "¥0 JPY"},
+		{"jpy", 500, "¥500 JPY"},
+		{"jpy", 1500, "¥1,500 JPY"},
+		{"krw", -100000, "-₩100,000 KRW"},
+		{"xyz", 1234, "12.34 XYZ"},
+	}
+	for _, test := range tests {
+		if have := Format(test.currency, test.amount); have != test.want {
+			t.Errorf("Format(%q, %v): have %q want %q", test.currency, test.amount, have, test.want)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+// Package notify sends notifications, such as emails, to users.
+package notify
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+// Notifier sends a notification to a recipient.
+type Notifier interface {
+	// Notify sends a plain text message with subject and body to the email
+	// address to.
+	Notify(to, subject, body string) error
+}
+
+// SMTP is a Notifier which sends emails via an SMTP server.
+type SMTP struct {
+	addr     string
+	from     string
+	auth     smtp.Auth
+	sendMail func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+	now      func() time.Time
+}
+
+var _ Notifier = (*SMTP)(nil)
+
+// NewSMTP returns an SMTP notifier sending emails from the address from via
+// the SMTP server at addr, such as smtp.example.com:587. If username is not
+// blank, the server is authenticated with using username and password.
+func NewSMTP(addr, from, username, password string) *SMTP {
+	s := &SMTP{
+		addr:     addr,
+		from:     from,
+		sendMail: smtp.SendMail,
+		now:      time.Now,
+	}
+	if username != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		s.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return s
+}
+
+// Notify implements the Notifier interface.
+func (s *SMTP) Notify(to, subject, body string) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", s.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", s.now().Format(time.RFC1123Z))
+	fmt.Fprint(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprint(&msg, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprint(&msg, "\r\n")
+	fmt.Fprint(&msg, body)
+
+	if err := s.sendMail(s.addr, s.auth, s.from, []string{to}, msg.Bytes()); err != nil {
+		return errors.Wrapf(err, "could not send email to %q", to)
+	}
+	return nil
+}
+
+// Log is a Notifier which logs notifications instead of sending them, such
+// as during development.
+type Log struct {
+	logger *logrus.Entry
+}
+
+var _ Notifier = (*Log)(nil)
+
+// NewLog returns a Log notifier logging to logger.
+func NewLog(logger *logrus.Entry) *Log {
+	return &Log{logger: logger}
+}
+
+// Notify implements the Notifier interface.
+func (l *Log) Notify(to, subject, body string) error {
+	l.logger.WithFields(logrus.Fields{"to": to, "subject": subject}).Info(body)
+	return nil
+}
@@ -0,0 +1,60 @@
+package notify
+
+import (
+	"errors"
+	"net/smtp"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSMTP_Notify(t *testing.T) {
+	var (
+		haveAddr string
+		haveFrom string
+		haveTo   []string
+		haveMsg  string
+	)
+	s := NewSMTP("smtp.example.com:587", "billing@gopherci.io", "", "")
+	s.now = func() time.Time { return time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC) }
+	s.sendMail = func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		haveAddr, haveFrom, haveTo, haveMsg = addr, from, to, string(msg)
+		return nil
+	}
+
+	if err := s.Notify("user@example.com", "Payment failed", "Please update your card."); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if want := "smtp.example.com:587"; haveAddr != want {
+		t.Errorf("have addr %q want %q", haveAddr, want)
+	}
+	if want := "billing@gopherci.io"; haveFrom != want {
+		t.Errorf("have from %q want %q", haveFrom, want)
+	}
+	if want := []string{"user@example.com"}; !reflect.DeepEqual(haveTo, want) {
+		t.Errorf("have to %q want %q", haveTo, want)
+	}
+	want := "From: billing@gopherci.io\r\n" +
+		"To: user@example.com\r\n" +
+		"Subject: Payment failed\r\n" +
+		"Date: Wed, 01 Mar 2017 00:00:00 +0000\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" +
+		"Please update your card."
+	if haveMsg != want {
+		t.Errorf("\nhave %q\nwant %q", haveMsg, want)
+	}
+}
+
+func TestSMTP_Notify_error(t *testing.T) {
+	s := NewSMTP("smtp.example.com:587", "billing@gopherci.io", "user", "pass")
+	s.sendMail = func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		return errors.New("connection refused")
+	}
+
+	if err := s.Notify("user@example.com", "subject", "body"); err == nil {
+		t.Error("expected error")
+	}
+}
@@ -0,0 +1,110 @@
+package payments
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// eventClaimTimeout is how long an event is claimed while it's processed,
+// after which it may be claimed again, such as if the claiming process exited.
+const eventClaimTimeout = 5 * time.Minute
+
+// EventStore stores received stripe webhook events, so duplicate deliveries
+// are ignored and failed events can be replayed.
+type EventStore struct {
+	db  *sqlx.DB
+	now func() time.Time
+}
+
+// NewEventStore returns an EventStore using db.
+func NewEventStore(db *sqlx.DB) *EventStore {
+	return &EventStore{db: db, now: time.Now}
+}
+
+// StoredEvent represents a row from the stripe_events table.
+type StoredEvent struct {
+	ID          string         `db:"id"`
+	Type        string         `db:"type"`
+	Payload     []byte         `db:"payload"`
+	ReceivedAt  time.Time      `db:"received_at"`
+	ProcessedAt *time.Time     `db:"processed_at"` // nil if not successfully processed
+	Error       sql.NullString `db:"error"`        // error from the last processing attempt
+}
+
+// Record stores a received event and claims it for processing. Returns true
+// if the event was claimed and should be processed, that is, it has not been
+// previously received, or it was received but not successfully processed and
+// is not being processed by another delivery. Returns false if the event is a
+// duplicate of an event already processed or being processed.
+func (s *EventStore) Record(id, eventType string, payload []byte) (bool, error) {
+	res, err := s.db.Exec("INSERT IGNORE INTO stripe_events (id, type, payload, claimed_until) VALUES (?, ?, ?, ?)", id, eventType, payload, s.now().Add(eventClaimTimeout))
+	if err != nil {
+		return false, errors.Wrapf(err, "could not insert stripe event %q", id)
+	}
+	inserted, err := res.RowsAffected()
+	if err != nil {
+		return false, errors.Wrapf(err, "could not insert stripe event %q", id)
+	}
+	if inserted == 1 {
+		return true, nil
+	}
+	return s.Claim(id)
+}
+
+// Claim claims a received event which has not been successfully processed,
+// so no other process processes it concurrently. Returns false if the event
+// has been processed or is claimed by another process. The claim is released
+// by MarkProcessed.
+func (s *EventStore) Claim(id string) (bool, error) {
+	now := s.now()
+	res, err := s.db.Exec("UPDATE stripe_events SET claimed_until = ? WHERE id = ? AND processed_at IS NULL AND (claimed_until IS NULL OR claimed_until <= ?)", now.Add(eventClaimTimeout), id, now)
+	if err != nil {
+		return false, errors.Wrapf(err, "could not claim stripe event %q", id)
+	}
+	claimed, err := res.RowsAffected()
+	if err != nil {
+		return false, errors.Wrapf(err, "could not claim stripe event %q", id)
+	}
+	return claimed == 1, nil
+}
+
+// MarkProcessed records the result of processing an event and releases its
+// claim, if procErr is nil the event is marked as successfully processed,
+// else the error is recorded.
+func (s *EventStore) MarkProcessed(id string, procErr error) error {
+	var err error
+	if procErr == nil {
+		_, err = s.db.Exec("UPDATE stripe_events SET processed_at = NOW(), claimed_until = NULL, `error` = NULL WHERE id = ?", id)
+	} else {
+		_, err = s.db.Exec("UPDATE stripe_events SET processed_at = NULL, claimed_until = NULL, `error` = ? WHERE id = ?", procErr.Error(), id)
+	}
+	return errors.Wrapf(err, "could not mark stripe event %q as processed", id)
+}
+
+// Get returns a stored event by its ID, returns nil if the event does not
+// exist.
+func (s *EventStore) Get(id string) (*StoredEvent, error) {
+	var event StoredEvent
+	err := s.db.Get(&event, "SELECT id, type, payload, received_at, processed_at, `error` FROM stripe_events WHERE id = ?", id)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, nil
+	case err != nil:
+		return nil, errors.Wrapf(err, "could not get stripe event %q", id)
+	}
+	return &event, nil
+}
+
+// ListFailed returns all stored events which have not been successfully
+// processed, oldest first.
+func (s *EventStore) ListFailed() ([]StoredEvent, error) {
+	var events []StoredEvent
+	err := s.db.Select(&events, "SELECT id, type, payload, received_at, processed_at, `error` FROM stripe_events WHERE processed_at IS NULL ORDER BY received_at")
+	if err != nil {
+		return nil, errors.Wrap(err, "could not list failed stripe events")
+	}
+	return events, nil
+}
@@ -0,0 +1,101 @@
+package payments
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	sqlmock "github.com/bradleyfalzon/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+)
+
+func TestEventStore_Record(t *testing.T) {
+	now := time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		desc     string
+		inserted int64
+		claimed  int64
+		want     bool
+	}{
+		{"new event", 1, 0, true},
+		{"duplicate of failed event", 0, 1, true},
+		{"duplicate of processed or claimed event", 0, 0, false},
+	}
+
+	for _, test := range tests {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		defer db.Close()
+
+		mock.ExpectExec(`INSERT IGNORE INTO stripe_events \(id, type, payload, claimed_until\) VALUES \(\?, \?, \?, \?\)`).
+			WithArgs("evt_1", "customer.subscription.deleted", []byte(`{}`), now.Add(eventClaimTimeout)).
+			WillReturnResult(sqlmock.NewResult(0, test.inserted))
+		if test.inserted == 0 {
+			mock.ExpectExec(`UPDATE stripe_events SET claimed_until = \? WHERE id = \? AND processed_at IS NULL AND \(claimed_until IS NULL OR claimed_until <= \?\)`).
+				WithArgs(now.Add(eventClaimTimeout), "evt_1", now).
+				WillReturnResult(sqlmock.NewResult(0, test.claimed))
+		}
+
+		store := NewEventStore(sqlx.NewDb(db, "sqlmock"))
+		store.now = func() time.Time { return now }
+		have, err := store.Record("evt_1", "customer.subscription.deleted", []byte(`{}`))
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.desc, err)
+		}
+		if have != test.want {
+			t.Errorf("%s: have %v want %v", test.desc, have, test.want)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("%s: unmet expectations: %v", test.desc, err)
+		}
+	}
+}
+
+func TestEventStore_MarkProcessed(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec(`UPDATE stripe_events SET processed_at = NOW\(\), claimed_until = NULL, .error. = NULL WHERE id = \?`).
+		WithArgs("evt_1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`UPDATE stripe_events SET processed_at = NULL, claimed_until = NULL, .error. = \? WHERE id = \?`).
+		WithArgs("some error", "evt_2").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	store := NewEventStore(sqlx.NewDb(db, "sqlmock"))
+	if err := store.MarkProcessed("evt_1", nil); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if err := store.MarkProcessed("evt_2", errors.New("some error")); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestEventStore_Get_notFound(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT .* FROM stripe_events WHERE id = ?").
+		WithArgs("evt_1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "type", "payload", "received_at", "processed_at", "error"}))
+
+	store := NewEventStore(sqlx.NewDb(db, "sqlmock"))
+	event, err := store.Get("evt_1")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if event != nil {
+		t.Errorf("expected nil event, have: %+v", event)
+	}
+}
@@ -0,0 +1,470 @@
+package payments
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	stripe "github.com/stripe/stripe-go"
+)
+
+// Fake is an in-memory Provider for use in tests. It approximates Stripe's
+// behaviour for the subset of the API used, but does not validate payment
+// source tokens or charge customers.
+type Fake struct {
+	mu     sync.Mutex
+	lastID int
+
+	Plans     map[string]*stripe.Plan     // Plans is the plans customers can subscribe to, keyed by ID.
+	Customers map[string]*stripe.Customer // Customers is all customers, keyed by ID.
+	Coupons   map[string]*stripe.Coupon   // Coupons is all coupons, keyed by ID.
+	Cards     map[string]*stripe.Card     // Cards is the card for each payment source token.
+	Err       error                       // Err, if set, is returned by all methods.
+	Now       func() time.Time            // Now returns the current time.
+
+	// PastInvoices is the previous invoices of each customer, newest first,
+	// keyed by customer ID.
+	PastInvoices map[string][]*stripe.Invoice
+}
+
+var _ Provider = (*Fake)(nil)
+
+// NewFake returns a Fake provider with plans available to subscribe to.
+func NewFake(plans ...*stripe.Plan) *Fake {
+	f := &Fake{
+		Plans:     make(map[string]*stripe.Plan),
+		Customers: make(map[string]*stripe.Customer),
+		Coupons:   make(map[string]*stripe.Coupon),
+		Cards:     make(map[string]*stripe.Card),
+		Now:       time.Now,
+
+		PastInvoices: make(map[string][]*stripe.Invoice),
+	}
+	for _, plan := range plans {
+		f.Plans[plan.ID] = plan
+	}
+	return f
+}
+
+// notFound returns an error similar to the error the Stripe API returns when
+// a resource does not exist.
+func notFound(resource, id string) error {
+	return &stripe.Error{
+		Type:           "invalid_request_error",
+		Msg:            fmt.Sprintf("No such %s: %s", resource, id),
+		HTTPStatusCode: http.StatusNotFound,
+	}
+}
+
+// newID returns a new unique ID with prefix, such as cus_fake1.
+func (f *Fake) newID(prefix string) string {
+	f.lastID++
+	return fmt.Sprintf("%s_fake%d", prefix, f.lastID)
+}
+
+// NewCustomer implements the Provider interface.
+func (f *Fake) NewCustomer(meta map[string]string, token, planID, couponID string, trial bool) (*stripe.Customer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	plan, ok := f.Plans[planID]
+	if !ok {
+		return nil, notFound("plan", planID)
+	}
+	var coupon *stripe.Coupon
+	if couponID != "" {
+		coupon, ok = f.Coupons[couponID]
+		if !ok || !coupon.Valid {
+			return nil, notFound("coupon", couponID)
+		}
+	}
+
+	customer := &stripe.Customer{
+		ID:       f.newID("cus"),
+		Created:  f.Now().Unix(),
+		Currency: plan.Currency,
+		Meta:     meta,
+		Sources:  &stripe.SourceList{},
+		Subs:     &stripe.SubList{},
+	}
+	if token != "" {
+		f.addCard(customer, f.Cards[token])
+	}
+	f.Customers[customer.ID] = customer
+	if coupon != nil {
+		f.applyCoupon(customer, coupon)
+	}
+	f.subscribe(customer, plan, trial)
+	return customer, nil
+}
+
+// subscribe adds a new subscription to plan to the customer, the subscription
+// is trialing if trial is true and the plan has a trial period, else active.
+func (f *Fake) subscribe(customer *stripe.Customer, plan *stripe.Plan, trial bool) *stripe.Sub {
+	now := f.Now()
+	end := now.AddDate(0, 1, 0)
+	if plan.Interval == stripe.Year {
+		end = now.AddDate(1, 0, 0)
+	}
+	sub := &stripe.Sub{
+		ID:          f.newID("sub"),
+		Customer:    &stripe.Customer{ID: customer.ID},
+		Plan:        plan,
+		Quantity:    1,
+		Status:      stripe.Active,
+		Start:       now.Unix(),
+		PeriodStart: now.Unix(),
+		PeriodEnd:   end.Unix(),
+	}
+	if trial && plan.TrialPeriod > 0 {
+		// The first period is the trial, billing starts when it ends.
+		sub.Status = stripe.Trialing
+		sub.TrialStart = now.Unix()
+		sub.TrialEnd = now.AddDate(0, 0, int(plan.TrialPeriod)).Unix()
+		sub.PeriodEnd = sub.TrialEnd
+	}
+	customer.Subs.Values = append(customer.Subs.Values, sub)
+	customer.Subs.Count++
+	return sub
+}
+
+// Customer implements the Provider interface.
+func (f *Fake) Customer(customerID string) (*stripe.Customer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	customer, ok := f.Customers[customerID]
+	if !ok {
+		return nil, notFound("customer", customerID)
+	}
+	return customer, nil
+}
+
+// addCard adds card to the customer as the default payment source, card may
+// be nil if the card's details are unknown.
+func (f *Fake) addCard(customer *stripe.Customer, card *stripe.Card) {
+	source := &stripe.PaymentSource{ID: f.newID("card"), Type: stripe.PaymentSourceCard}
+	if card != nil {
+		c := *card
+		c.ID = source.ID
+		source.Card = &c
+	}
+	customer.Sources.Values = append(customer.Sources.Values, source)
+	customer.Sources.Count++
+	customer.DefaultSource = &stripe.PaymentSource{ID: source.ID, Type: stripe.PaymentSourceCard}
+}
+
+// UpdateDefaultCard implements the Provider interface.
+func (f *Fake) UpdateDefaultCard(customerID, token string) (*stripe.Card, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	customer, ok := f.Customers[customerID]
+	if !ok {
+		return nil, notFound("customer", customerID)
+	}
+	card, ok := f.Cards[token]
+	if !ok {
+		return nil, notFound("token", token)
+	}
+	f.addCard(customer, card)
+	return customer.Sources.Values[len(customer.Sources.Values)-1].Card, nil
+}
+
+// Subscribe implements the Provider interface.
+func (f *Fake) Subscribe(customerID, planID string, trial bool) (*stripe.Sub, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	customer, ok := f.Customers[customerID]
+	if !ok {
+		return nil, notFound("customer", customerID)
+	}
+	plan, ok := f.Plans[planID]
+	if !ok {
+		return nil, notFound("plan", planID)
+	}
+	return f.subscribe(customer, plan, trial), nil
+}
+
+// findSub returns the subscription subID and the customer it belongs to.
+func (f *Fake) findSub(subID string) (*stripe.Customer, *stripe.Sub, error) {
+	for _, customer := range f.Customers {
+		for _, sub := range customer.Subs.Values {
+			if sub.ID == subID {
+				return customer, sub, nil
+			}
+		}
+	}
+	return nil, nil, notFound("subscription", subID)
+}
+
+// ChangePlan implements the Provider interface.
+func (f *Fake) ChangePlan(subID, planID string, prorationDate time.Time) (*stripe.Sub, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	_, sub, err := f.findSub(subID)
+	if err != nil {
+		return nil, err
+	}
+	plan, ok := f.Plans[planID]
+	if !ok {
+		return nil, notFound("plan", planID)
+	}
+	sub.Plan = plan
+	return sub, nil
+}
+
+// CancelSubscription implements the Provider interface.
+func (f *Fake) CancelSubscription(subID string, atPeriodEnd bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.Err != nil {
+		return f.Err
+	}
+	customer, sub, err := f.findSub(subID)
+	if err != nil {
+		return err
+	}
+	now := f.Now().Unix()
+	sub.Canceled = now
+	if atPeriodEnd {
+		sub.EndCancel = true
+		return nil
+	}
+
+	// Immediately cancelled subscriptions are no longer listed
+	sub.Status = stripe.Canceled
+	sub.Ended = now
+	var subs []*stripe.Sub
+	for _, s := range customer.Subs.Values {
+		if s.ID != subID {
+			subs = append(subs, s)
+		}
+	}
+	customer.Subs.Values = subs
+	customer.Subs.Count--
+	return nil
+}
+
+// ListPlans implements the Provider interface.
+func (f *Fake) ListPlans() ([]*stripe.Plan, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	var plans []*stripe.Plan
+	for _, plan := range f.Plans {
+		plans = append(plans, plan)
+	}
+	return plans, nil
+}
+
+// Plan implements the Provider interface.
+func (f *Fake) Plan(planID string) (*stripe.Plan, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	plan, ok := f.Plans[planID]
+	if !ok {
+		return nil, notFound("plan", planID)
+	}
+	return plan, nil
+}
+
+// Coupon implements the Provider interface.
+func (f *Fake) Coupon(couponID string) (*stripe.Coupon, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	coupon, ok := f.Coupons[couponID]
+	if !ok {
+		return nil, notFound("coupon", couponID)
+	}
+	return coupon, nil
+}
+
+// ApplyCoupon implements the Provider interface.
+func (f *Fake) ApplyCoupon(customerID, couponID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.Err != nil {
+		return f.Err
+	}
+	customer, ok := f.Customers[customerID]
+	if !ok {
+		return notFound("customer", customerID)
+	}
+	coupon, ok := f.Coupons[couponID]
+	if !ok || !coupon.Valid {
+		return notFound("coupon", couponID)
+	}
+	f.applyCoupon(customer, coupon)
+	return nil
+}
+
+// applyCoupon replaces the customer's discount with coupon's discount.
+func (f *Fake) applyCoupon(customer *stripe.Customer, coupon *stripe.Coupon) {
+	now := f.Now()
+	discount := &stripe.Discount{
+		Coupon:   coupon,
+		Customer: customer.ID,
+		Start:    now.Unix(),
+	}
+	switch coupon.Duration {
+	case "once":
+		discount.End = now.AddDate(0, 1, 0).Unix()
+	case "repeating":
+		discount.End = now.AddDate(0, int(coupon.DurationPeriod), 0).Unix()
+	}
+	customer.Discount = discount
+	coupon.Redemptions++
+}
+
+// UpcomingInvoice implements the Provider interface.
+func (f *Fake) UpcomingInvoice(customerID string) (*stripe.Invoice, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	customer, ok := f.Customers[customerID]
+	if !ok {
+		return nil, notFound("customer", customerID)
+	}
+	return f.invoice(customer, nil), nil
+}
+
+// Invoices implements the Provider interface.
+func (f *Fake) Invoices(customerID, startingAfter string, limit int) ([]*stripe.Invoice, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.Err != nil {
+		return nil, false, f.Err
+	}
+	if _, ok := f.Customers[customerID]; !ok {
+		return nil, false, notFound("customer", customerID)
+	}
+
+	invoices := f.PastInvoices[customerID]
+	if startingAfter != "" {
+		start := -1
+		for i, invoice := range invoices {
+			if invoice.ID == startingAfter {
+				start = i + 1
+			}
+		}
+		if start == -1 {
+			return nil, false, notFound("invoice", startingAfter)
+		}
+		invoices = invoices[start:]
+	}
+	if len(invoices) > limit {
+		return invoices[:limit], true, nil
+	}
+	return invoices, false, nil
+}
+
+// PreviewPlanChange implements the Provider interface.
+func (f *Fake) PreviewPlanChange(customerID, subID, planID string, prorationDate time.Time) (*stripe.Invoice, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	customer, sub, err := f.findSub(subID)
+	if err != nil {
+		return nil, err
+	}
+	if customer.ID != customerID {
+		return nil, notFound("subscription", subID)
+	}
+	plan, ok := f.Plans[planID]
+	if !ok {
+		return nil, notFound("plan", planID)
+	}
+
+	// Credit the unused time on the current plan and charge the remaining
+	// time on the new plan.
+	var remaining float64
+	if period := sub.PeriodEnd - sub.PeriodStart; period > 0 {
+		remaining = float64(sub.PeriodEnd-prorationDate.Unix()) / float64(period)
+	}
+	prorations := []*stripe.InvoiceLine{
+		{Amount: -int64(float64(sub.Plan.Amount) * remaining), Currency: sub.Plan.Currency, Proration: true, Plan: sub.Plan, Sub: sub.ID},
+		{Amount: int64(float64(plan.Amount) * remaining), Currency: plan.Currency, Proration: true, Plan: plan, Sub: sub.ID},
+	}
+
+	invoice := f.invoice(customer, map[string]*stripe.Plan{subID: plan})
+	for _, line := range prorations {
+		invoice.Lines.Values = append(invoice.Lines.Values, line)
+		invoice.Amount += line.Amount
+		invoice.Total += line.Amount
+	}
+	return invoice, nil
+}
+
+// invoice returns the next invoice for a customer, or nil if there are no
+// active subscriptions. Plans are overridden for subscription IDs in plans.
+func (f *Fake) invoice(customer *stripe.Customer, plans map[string]*stripe.Plan) *stripe.Invoice {
+	invoice := &stripe.Invoice{
+		Customer: &stripe.Customer{ID: customer.ID},
+		Currency: customer.Currency,
+		Lines:    &stripe.InvoiceLineList{},
+	}
+	for _, sub := range customer.Subs.Values {
+		if sub.EndCancel {
+			continue
+		}
+		plan := sub.Plan
+		if p, ok := plans[sub.ID]; ok {
+			plan = p
+		}
+		invoice.Lines.Values = append(invoice.Lines.Values, &stripe.InvoiceLine{
+			Amount:   int64(plan.Amount),
+			Currency: plan.Currency,
+			Plan:     plan,
+			Sub:      sub.ID,
+		})
+		invoice.Subtotal += int64(plan.Amount)
+		if invoice.Date == 0 || sub.PeriodEnd < invoice.Date {
+			invoice.Date = sub.PeriodEnd
+		}
+	}
+	if len(invoice.Lines.Values) == 0 {
+		return nil
+	}
+
+	invoice.Total = invoice.Subtotal
+	if customer.Discount != nil {
+		coupon := customer.Discount.Coupon
+		switch {
+		case coupon.Percent > 0:
+			invoice.Total -= invoice.Subtotal * int64(coupon.Percent) / 100
+		case coupon.Amount > 0:
+			invoice.Total -= int64(coupon.Amount)
+		}
+		if invoice.Total < 0 {
+			invoice.Total = 0
+		}
+	}
+	invoice.Amount = invoice.Total
+	return invoice
+}
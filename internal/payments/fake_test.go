@@ -0,0 +1,132 @@
+package payments
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	stripe "github.com/stripe/stripe-go"
+)
+
+func TestFake_subscriptions(t *testing.T) {
+	personal := &stripe.Plan{ID: "Personal", Amount: 500, Currency: "usd", Interval: stripe.Month}
+	professional := &stripe.Plan{ID: "Professional", Amount: 2000, Currency: "usd", Interval: stripe.Month}
+	f := NewFake(personal, professional)
+
+	customer, err := f.NewCustomer(map[string]string{UserIDMeta: "1"}, "tok_visa", "Personal", "", true)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if have := customer.Meta[UserIDMeta]; have != "1" {
+		t.Errorf("have userID metadata %q want %q", have, "1")
+	}
+	if len(customer.Subs.Values) != 1 {
+		t.Fatalf("have %d subscriptions want 1", len(customer.Subs.Values))
+	}
+	subID := customer.Subs.Values[0].ID
+
+	invoice, err := f.UpcomingInvoice(customer.ID)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if invoice.Amount != 500 {
+		t.Errorf("have invoice amount %v want %v", invoice.Amount, 500)
+	}
+
+	if _, err := f.ChangePlan(subID, "Professional", time.Now()); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if have := customer.Subs.Values[0].Plan.ID; have != "Professional" {
+		t.Errorf("have plan %q want %q", have, "Professional")
+	}
+
+	if err := f.CancelSubscription(subID, true); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	invoice, err = f.UpcomingInvoice(customer.ID)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if invoice != nil {
+		t.Errorf("have invoice %+v after cancelling, want nil", invoice)
+	}
+
+	if err := f.CancelSubscription(subID, false); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if len(customer.Subs.Values) != 0 {
+		t.Errorf("have %d subscriptions after cancelling immediately want 0", len(customer.Subs.Values))
+	}
+}
+
+func TestFake_coupon(t *testing.T) {
+	f := NewFake(&stripe.Plan{ID: "Personal", Amount: 1000, Currency: "usd"})
+	f.Coupons["HALF"] = &stripe.Coupon{ID: "HALF", Percent: 50, Duration: "forever", Valid: true}
+
+	customer, err := f.NewCustomer(map[string]string{UserIDMeta: "1"}, "tok_visa", "Personal", "", true)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := f.ApplyCoupon(customer.ID, "HALF"); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	invoice, err := f.UpcomingInvoice(customer.ID)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if invoice.Amount != 500 {
+		t.Errorf("have invoice amount %v want %v", invoice.Amount, 500)
+	}
+
+	err = f.ApplyCoupon(customer.ID, "UNKNOWN")
+	if serr, ok := err.(*stripe.Error); !ok || serr.HTTPStatusCode != http.StatusNotFound {
+		t.Errorf("have err %v want not found", err)
+	}
+
+	// Coupons can be redeemed when creating a customer
+	customer, err = f.NewCustomer(map[string]string{UserIDMeta: "2"}, "tok_visa", "Personal", "HALF", true)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if customer.Discount == nil || customer.Discount.Coupon.ID != "HALF" {
+		t.Errorf("have discount %+v want coupon HALF", customer.Discount)
+	}
+	if _, err := f.NewCustomer(map[string]string{UserIDMeta: "3"}, "tok_visa", "Personal", "UNKNOWN", true); err == nil {
+		t.Error("expected error for unknown coupon")
+	}
+}
+
+func TestFake_PreviewPlanChange(t *testing.T) {
+	now := time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC)
+	f := NewFake(
+		&stripe.Plan{ID: "Personal", Amount: 1000, Currency: "usd", Interval: stripe.Month},
+		&stripe.Plan{ID: "Professional", Amount: 3000, Currency: "usd", Interval: stripe.Month},
+	)
+	f.Now = func() time.Time { return now }
+
+	customer, err := f.NewCustomer(map[string]string{UserIDMeta: "1"}, "tok_visa", "Personal", "", true)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	subID := customer.Subs.Values[0].ID
+
+	// Half way through the 31 day period of March.
+	prorationDate := now.Add(31 * 24 * time.Hour / 2)
+	invoice, err := f.PreviewPlanChange(customer.ID, subID, "Professional", prorationDate)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	var prorated int64
+	for _, line := range invoice.Lines.Values {
+		if line.Proration {
+			prorated += line.Amount
+		}
+	}
+	if prorated != 1000 {
+		t.Errorf("have prorated amount %v want %v", prorated, 1000)
+	}
+	if invoice.Amount != 4000 {
+		t.Errorf("have invoice amount %v want %v", invoice.Amount, 4000)
+	}
+}
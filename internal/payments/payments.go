@@ -1 +1,3 @@
+// Package payments contains helpers for interacting with the payment
+// provider, Stripe.
 package payments
@@ -0,0 +1,191 @@
+package payments
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/bradleyfalzon/gopherci-web/internal/money"
+	"github.com/pkg/errors"
+	stripe "github.com/stripe/stripe-go"
+)
+
+// Unlimited is the value of a plan's limit when the plan has no limit.
+const Unlimited = -1
+
+// DefaultCurrency is the lower case currency of stripe customers if no other
+// billing currency is configured.
+const DefaultCurrency = "usd"
+
+// Stripe plan metadata keys describing a plan's limits.
+const (
+	// OrganisationsMeta is the maximum number of organisation installations,
+	// or "unlimited".
+	OrganisationsMeta = "organisations"
+	// BuildsPerDayMeta is the maximum number of builds per day, or
+	// "unlimited".
+	BuildsPerDayMeta = "builds_per_day"
+	// OfferedMeta is "false" if the plan is no longer offered to new
+	// customers, plans are offered by default.
+	OfferedMeta = "offered"
+)
+
+// Plan describes a subscription plan and its limits.
+type Plan struct {
+	ID            string // ID is the stripe plan ID.
+	Name          string // Name is the name of the plan for display.
+	Amount        int64  // Amount is the price per Interval in the currency's smallest unit.
+	Currency      string // Currency is the lower case currency, such as usd.
+	Interval      string // Interval is the billing interval, such as month or year.
+	TrialDays     int    // TrialDays is the length of the free trial in days, 0 if none.
+	Organisations int    // Organisations is the maximum number of organisation installations, or Unlimited.
+	BuildsPerDay  int    // BuildsPerDay is the maximum number of builds per day, or Unlimited.
+	Offered       bool   // Offered is true if the plan is offered to new customers.
+}
+
+// PlanFromStripe returns the Plan for a stripe plan, the plan's limits are
+// read from its metadata. Limits missing from the metadata, such as on plans
+// created before limits were recorded, are Unlimited.
+func PlanFromStripe(p *stripe.Plan) (Plan, error) {
+	plan := Plan{
+		ID:        p.ID,
+		Name:      p.Name,
+		Amount:    int64(p.Amount),
+		Currency:  string(p.Currency),
+		Interval:  string(p.Interval),
+		TrialDays: int(p.TrialPeriod),
+		Offered:   p.Meta[OfferedMeta] != "false",
+	}
+	var err error
+	if plan.Organisations, err = parseLimit(p.Meta[OrganisationsMeta]); err != nil {
+		return plan, errors.Wrapf(err, "invalid %s metadata for stripe plan %q", OrganisationsMeta, p.ID)
+	}
+	if plan.BuildsPerDay, err = parseLimit(p.Meta[BuildsPerDayMeta]); err != nil {
+		return plan, errors.Wrapf(err, "invalid %s metadata for stripe plan %q", BuildsPerDayMeta, p.ID)
+	}
+	return plan, nil
+}
+
+// parseLimit parses a plan limit from stripe metadata, which is either a
+// non-negative number, "unlimited", or blank if the limit is not set.
+func parseLimit(value string) (int, error) {
+	if value == "unlimited" || value == "" {
+		return Unlimited, nil
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, err
+	}
+	if limit < 0 {
+		return 0, fmt.Errorf("limit %d is negative", limit)
+	}
+	return limit, nil
+}
+
+// AmountDisplay returns the plan's price formatted for display.
+func (p Plan) AmountDisplay() string {
+	return money.Format(p.Currency, p.Amount)
+}
+
+// OrganisationsDisplay returns the plan's organisation limit formatted for
+// display.
+func (p Plan) OrganisationsDisplay() string {
+	switch p.Organisations {
+	case Unlimited:
+		return "Unlimited"
+	case 0:
+		return "None"
+	}
+	return strconv.Itoa(p.Organisations)
+}
+
+// BuildsPerDayDisplay returns the plan's daily build limit formatted for
+// display.
+func (p Plan) BuildsPerDayDisplay() string {
+	if p.BuildsPerDay == Unlimited {
+		return "Unlimited"
+	}
+	return strconv.Itoa(p.BuildsPerDay)
+}
+
+// Catalogue is a collection of plans keyed by stripe plan ID.
+type Catalogue map[string]Plan
+
+// NewCatalogue returns a Catalogue containing plans.
+func NewCatalogue(plans ...Plan) Catalogue {
+	c := make(Catalogue)
+	for _, plan := range plans {
+		c[plan.ID] = plan
+	}
+	return c
+}
+
+// LoadCatalogue returns a Catalogue containing all of provider's plans,
+// including plans no longer offered to new customers. Plans with invalid
+// limits are logged and skipped, so they're not offered and their subscribers
+// have no limits.
+func LoadCatalogue(logger *logrus.Entry, provider Provider) (Catalogue, error) {
+	stripePlans, err := provider.ListPlans()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not list plans")
+	}
+	var plans []Plan
+	for _, p := range stripePlans {
+		plan, err := PlanFromStripe(p)
+		if err != nil {
+			logger.WithError(err).Warnf("skipping stripe plan %q", p.ID)
+			continue
+		}
+		plans = append(plans, plan)
+	}
+	return NewCatalogue(plans...), nil
+}
+
+// Plan returns the plan for a stripe plan ID, ok is false if no plan exists.
+func (c Catalogue) Plan(planID string) (plan Plan, ok bool) {
+	plan, ok = c[planID]
+	return plan, ok
+}
+
+// Subscribed returns the plan for the stripe plan ID and name of a
+// subscription. Plans not in the catalogue, such as plans created since it was
+// loaded or with invalid limits, have no limits.
+func (c Catalogue) Subscribed(planID, name string) Plan {
+	if plan, ok := c[planID]; ok {
+		return plan
+	}
+	return Plan{ID: planID, Name: name, Organisations: Unlimited, BuildsPerDay: Unlimited}
+}
+
+// Intervals returns the billing intervals of the offered plans, sorted.
+func (c Catalogue) Intervals() []string {
+	seen := make(map[string]bool)
+	var intervals []string
+	for _, plan := range c {
+		if plan.Offered && !seen[plan.Interval] {
+			seen[plan.Interval] = true
+			intervals = append(intervals, plan.Interval)
+		}
+	}
+	sort.Strings(intervals)
+	return intervals
+}
+
+// Offered returns the plans offered to new customers billed every interval,
+// from cheapest to most expensive.
+func (c Catalogue) Offered(interval string) []Plan {
+	var plans []Plan
+	for _, plan := range c {
+		if plan.Offered && plan.Interval == interval {
+			plans = append(plans, plan)
+		}
+	}
+	sort.Slice(plans, func(i, j int) bool {
+		if plans[i].Amount != plans[j].Amount {
+			return plans[i].Amount < plans[j].Amount
+		}
+		return plans[i].ID < plans[j].ID
+	})
+	return plans
+}
@@ -0,0 +1,152 @@
+package payments
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	stripe "github.com/stripe/stripe-go"
+)
+
+func TestPlanFromStripe(t *testing.T) {
+	tests := []struct {
+		plan    stripe.Plan
+		want    Plan
+		wantErr bool
+	}{
+		{
+			plan: stripe.Plan{
+				ID: "PersonalMonthlyUSD", Name: "Personal", Amount: 399, Currency: "usd", Interval: stripe.Month, TrialPeriod: 30,
+				Meta: map[string]string{OrganisationsMeta: "0", BuildsPerDayMeta: "10"},
+			},
+			want: Plan{ID: "PersonalMonthlyUSD", Name: "Personal", Amount: 399, Currency: "usd", Interval: "month", TrialDays: 30, Organisations: 0, BuildsPerDay: 10, Offered: true},
+		},
+		{
+			plan: stripe.Plan{
+				ID: "SignificantYearlyUSD", Name: "Significant Contributor", Amount: 29990, Currency: "usd", Interval: stripe.Year,
+				Meta: map[string]string{OrganisationsMeta: "unlimited", BuildsPerDayMeta: "200"},
+			},
+			want: Plan{ID: "SignificantYearlyUSD", Name: "Significant Contributor", Amount: 29990, Currency: "usd", Interval: "year", Organisations: Unlimited, BuildsPerDay: 200, Offered: true},
+		},
+		{
+			plan: stripe.Plan{
+				ID: "PersonalMonthly", Name: "Personal", Amount: 500, Currency: "aud", Interval: stripe.Month,
+				Meta: map[string]string{OrganisationsMeta: "0", BuildsPerDayMeta: "10", OfferedMeta: "false"},
+			},
+			want: Plan{ID: "PersonalMonthly", Name: "Personal", Amount: 500, Currency: "aud", Interval: "month", Organisations: 0, BuildsPerDay: 10, Offered: false},
+		},
+		{
+			plan: stripe.Plan{ID: "missing", Meta: map[string]string{BuildsPerDayMeta: "10"}},
+			want: Plan{ID: "missing", Organisations: Unlimited, BuildsPerDay: 10, Offered: true},
+		},
+		{
+			plan: stripe.Plan{ID: "unlabelled", Name: "Legacy", Amount: 500, Currency: "usd", Interval: stripe.Month, Meta: map[string]string{}},
+			want: Plan{ID: "unlabelled", Name: "Legacy", Amount: 500, Currency: "usd", Interval: "month", Organisations: Unlimited, BuildsPerDay: Unlimited, Offered: true},
+		},
+		{
+			plan:    stripe.Plan{ID: "invalid", Meta: map[string]string{OrganisationsMeta: "some", BuildsPerDayMeta: "10"}},
+			wantErr: true,
+		},
+		{
+			plan:    stripe.Plan{ID: "negative", Meta: map[string]string{OrganisationsMeta: "0", BuildsPerDayMeta: "-5"}},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		have, err := PlanFromStripe(&test.plan)
+		switch {
+		case test.wantErr && err == nil:
+			t.Errorf("plan %v: expected error", test.plan.ID)
+		case !test.wantErr && err != nil:
+			t.Errorf("plan %v: unexpected error: %v", test.plan.ID, err)
+		case !test.wantErr && have != test.want:
+			t.Errorf("plan %v:\nhave %+v\nwant %+v", test.plan.ID, have, test.want)
+		}
+	}
+}
+
+func TestPlan_Display(t *testing.T) {
+	tests := []struct {
+		plan              Plan
+		wantAmount        string
+		wantOrganisations string
+		wantBuilds        string
+	}{
+		{Plan{Amount: 399, Currency: "usd", Organisations: 0, BuildsPerDay: 10}, "$3.99 USD", "None", "10"},
+		{Plan{Amount: 799, Currency: "usd", Organisations: 5, BuildsPerDay: 50}, "$7.99 USD", "5", "50"},
+		{Plan{Amount: 2999, Currency: "usd", Organisations: Unlimited, BuildsPerDay: Unlimited}, "$29.99 USD", "Unlimited", "Unlimited"},
+	}
+	for _, test := range tests {
+		if have := test.plan.AmountDisplay(); have != test.wantAmount {
+			t.Errorf("plan %+v: have amount %q want %q", test.plan, have, test.wantAmount)
+		}
+		if have := test.plan.OrganisationsDisplay(); have != test.wantOrganisations {
+			t.Errorf("plan %+v: have organisations %q want %q", test.plan, have, test.wantOrganisations)
+		}
+		if have := test.plan.BuildsPerDayDisplay(); have != test.wantBuilds {
+			t.Errorf("plan %+v: have builds %q want %q", test.plan, have, test.wantBuilds)
+		}
+	}
+}
+
+func TestLoadCatalogue(t *testing.T) {
+	limits := map[string]string{OrganisationsMeta: "0", BuildsPerDayMeta: "10"}
+	f := NewFake(
+		&stripe.Plan{ID: "PersonalMonthly", Amount: 500, Currency: "aud", Interval: stripe.Month, Meta: map[string]string{OrganisationsMeta: "0", BuildsPerDayMeta: "10", OfferedMeta: "false"}},
+		&stripe.Plan{ID: "PersonalMonthlyUSD", Amount: 399, Currency: "usd", Interval: stripe.Month, Meta: limits},
+		&stripe.Plan{ID: "ProfessionalMonthlyUSD", Amount: 799, Currency: "usd", Interval: stripe.Month, Meta: limits},
+		&stripe.Plan{ID: "PersonalYearlyUSD", Amount: 3990, Currency: "usd", Interval: stripe.Year, Meta: limits},
+	)
+
+	logger := logrus.New().WithField("pkg", "payments_test")
+	catalogue, err := LoadCatalogue(logger, f)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if len(catalogue) != 4 {
+		t.Errorf("have %d plans want 4", len(catalogue))
+	}
+	if _, ok := catalogue.Plan("PersonalMonthly"); !ok {
+		t.Error("expected legacy plan in catalogue")
+	}
+
+	if have, want := catalogue.Intervals(), []string{"month", "year"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("have intervals %v want %v", have, want)
+	}
+
+	var have []string
+	for _, plan := range catalogue.Offered("month") {
+		have = append(have, plan.ID)
+	}
+	if want := []string{"PersonalMonthlyUSD", "ProfessionalMonthlyUSD"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("have offered monthly plans %v want %v", have, want)
+	}
+
+	// Plans without limits have no limits, and plans with invalid limits are
+	// skipped, neither prevent the catalogue from loading.
+	f.Plans["unlabelled"] = &stripe.Plan{ID: "unlabelled", Amount: 500, Currency: "usd", Interval: stripe.Month}
+	f.Plans["invalid"] = &stripe.Plan{ID: "invalid", Meta: map[string]string{OrganisationsMeta: "-1", BuildsPerDayMeta: "10"}}
+	catalogue, err = LoadCatalogue(logger, f)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if plan, ok := catalogue.Plan("unlabelled"); !ok || plan.Organisations != Unlimited || plan.BuildsPerDay != Unlimited {
+		t.Errorf("have unlabelled plan %+v (%v) want unlimited", plan, ok)
+	}
+	if _, ok := catalogue.Plan("invalid"); ok {
+		t.Error("expected plan with invalid limits to be skipped")
+	}
+}
+
+func TestCatalogue_Subscribed(t *testing.T) {
+	personal := Plan{ID: "PersonalMonthlyUSD", Name: "Personal", Organisations: 0, BuildsPerDay: 10}
+	catalogue := NewCatalogue(personal)
+
+	if have := catalogue.Subscribed("PersonalMonthlyUSD", "Personal"); have != personal {
+		t.Errorf("have %+v want %+v", have, personal)
+	}
+	want := Plan{ID: "NewPlan", Name: "New", Organisations: Unlimited, BuildsPerDay: Unlimited}
+	if have := catalogue.Subscribed("NewPlan", "New"); have != want {
+		t.Errorf("have %+v want %+v", have, want)
+	}
+}
@@ -0,0 +1,57 @@
+package payments
+
+import (
+	"time"
+
+	stripe "github.com/stripe/stripe-go"
+)
+
+// Customer metadata keys identifying the owner of a customer.
+const (
+	UserIDMeta    = "userID"    // UserIDMeta is the ID of the user owning the customer.
+	AccountIDMeta = "accountID" // AccountIDMeta is the ID of the billing account owning the customer.
+)
+
+// Provider is a payment provider used to manage customers and their
+// subscriptions. It's implemented by Stripe for use with the Stripe API and
+// Fake for use in tests.
+type Provider interface {
+	// NewCustomer creates a customer with metadata meta, identifying the
+	// customer's owner, and a payment source token and subscribes them to
+	// planID, with couponID's discount if not blank. If trial is false the
+	// plan's free trial is skipped.
+	NewCustomer(meta map[string]string, token, planID, couponID string, trial bool) (*stripe.Customer, error)
+	// Customer returns a customer by its ID, including its subscriptions and
+	// discount.
+	Customer(customerID string) (*stripe.Customer, error)
+	// UpdateDefaultCard adds the card with payment source token to an existing
+	// customer and makes it the default payment source.
+	UpdateDefaultCard(customerID, token string) (*stripe.Card, error)
+	// Subscribe subscribes an existing customer to planID, if trial is false
+	// the plan's free trial is skipped.
+	Subscribe(customerID, planID string, trial bool) (*stripe.Sub, error)
+	// ChangePlan changes subscription subID to planID, prorating the
+	// difference from prorationDate.
+	ChangePlan(subID, planID string, prorationDate time.Time) (*stripe.Sub, error)
+	// CancelSubscription cancels subscription subID, at the end of the current
+	// billing period if atPeriodEnd is true, else immediately.
+	CancelSubscription(subID string, atPeriodEnd bool) error
+	// ListPlans returns all plans.
+	ListPlans() ([]*stripe.Plan, error)
+	// Plan returns a plan by its ID.
+	Plan(planID string) (*stripe.Plan, error)
+	// Coupon returns a coupon by its ID.
+	Coupon(couponID string) (*stripe.Coupon, error)
+	// ApplyCoupon applies couponID to a customer.
+	ApplyCoupon(customerID, couponID string) error
+	// UpcomingInvoice returns a customer's upcoming invoice, or nil if the
+	// customer has no upcoming invoice.
+	UpcomingInvoice(customerID string) (*stripe.Invoice, error)
+	// Invoices returns up to limit of a customer's invoices, newest first,
+	// starting after the invoice startingAfter, or the newest invoice if
+	// blank. more is true if there are older invoices.
+	Invoices(customerID, startingAfter string, limit int) (invoices []*stripe.Invoice, more bool, err error)
+	// PreviewPlanChange returns a customer's upcoming invoice as if
+	// subscription subID was changed to planID at prorationDate.
+	PreviewPlanChange(customerID, subID, planID string, prorationDate time.Time) (*stripe.Invoice, error)
+}
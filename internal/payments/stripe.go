@@ -0,0 +1,164 @@
+package payments
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	stripe "github.com/stripe/stripe-go"
+	"github.com/stripe/stripe-go/client"
+)
+
+// Stripe is a Provider using the Stripe API.
+type Stripe struct {
+	api *client.API
+}
+
+var _ Provider = (*Stripe)(nil)
+
+// NewStripeAPI returns a Stripe API client using key. Requests are logged to
+// logger at logLevel, with the same levels as stripe.LogLevel, instead of the
+// package level stripe.Logger and stripe.LogLevel, so clients don't share any
+// state.
+func NewStripeAPI(key string, logger stripe.Printfer, logLevel int) *client.API {
+	config := &stripe.BackendConfig{Logger: logger, LogLevel: logLevel}
+	return client.New(key, &stripe.Backends{
+		API:     stripe.GetBackendWithConfig(stripe.APIBackend, config),
+		Uploads: stripe.GetBackendWithConfig(stripe.UploadsBackend, config),
+	})
+}
+
+// NewStripe returns a Stripe provider using the Stripe client api. The
+// client's key is used instead of the package level stripe.Key, so multiple
+// providers with different keys may be used concurrently.
+func NewStripe(api *client.API) *Stripe {
+	return &Stripe{api: api}
+}
+
+// NewCustomer implements the Provider interface.
+func (s *Stripe) NewCustomer(meta map[string]string, token, planID, couponID string, trial bool) (*stripe.Customer, error) {
+	params := &stripe.CustomerParams{
+		Coupon: couponID,
+		Params: stripe.Params{Meta: meta},
+	}
+	if trial {
+		params.Plan = planID
+	}
+	_ = params.SetSource(token)
+	customer, err := s.api.Customers.New(params)
+	if err != nil || trial {
+		return customer, err
+	}
+
+	// Customers created with a plan always start its free trial, so the
+	// customer is subscribed separately to skip it.
+	if _, err := s.Subscribe(customer.ID, planID, false); err != nil {
+		return nil, errors.Wrapf(err, "created stripe customer %q but could not subscribe to %q", customer.ID, planID)
+	}
+	return s.Customer(customer.ID)
+}
+
+// Customer implements the Provider interface.
+func (s *Stripe) Customer(customerID string) (*stripe.Customer, error) {
+	return s.api.Customers.Get(customerID, nil)
+}
+
+// UpdateDefaultCard implements the Provider interface.
+func (s *Stripe) UpdateDefaultCard(customerID, token string) (*stripe.Card, error) {
+	card, err := s.api.Cards.New(&stripe.CardParams{Customer: customerID, Token: token})
+	if err != nil {
+		return nil, err
+	}
+	_, err = s.api.Customers.Update(customerID, &stripe.CustomerParams{DefaultSource: card.ID})
+	return card, err
+}
+
+// Subscribe implements the Provider interface.
+func (s *Stripe) Subscribe(customerID, planID string, trial bool) (*stripe.Sub, error) {
+	return s.api.Subs.New(&stripe.SubParams{
+		Customer:    customerID,
+		Plan:        planID,
+		TrialEndNow: !trial,
+	})
+}
+
+// ChangePlan implements the Provider interface.
+func (s *Stripe) ChangePlan(subID, planID string, prorationDate time.Time) (*stripe.Sub, error) {
+	return s.api.Subs.Update(subID, &stripe.SubParams{
+		Plan:          planID,
+		ProrationDate: prorationDate.Unix(),
+	})
+}
+
+// CancelSubscription implements the Provider interface.
+func (s *Stripe) CancelSubscription(subID string, atPeriodEnd bool) error {
+	_, err := s.api.Subs.Cancel(subID, &stripe.SubParams{EndCancel: atPeriodEnd})
+	return err
+}
+
+// ListPlans implements the Provider interface.
+func (s *Stripe) ListPlans() ([]*stripe.Plan, error) {
+	var plans []*stripe.Plan
+	i := s.api.Plans.List(nil)
+	for i.Next() {
+		plans = append(plans, i.Plan())
+	}
+	return plans, i.Err()
+}
+
+// Plan implements the Provider interface.
+func (s *Stripe) Plan(planID string) (*stripe.Plan, error) {
+	return s.api.Plans.Get(planID, nil)
+}
+
+// Coupon implements the Provider interface.
+func (s *Stripe) Coupon(couponID string) (*stripe.Coupon, error) {
+	return s.api.Coupons.Get(couponID, nil)
+}
+
+// ApplyCoupon implements the Provider interface.
+func (s *Stripe) ApplyCoupon(customerID, couponID string) error {
+	_, err := s.api.Customers.Update(customerID, &stripe.CustomerParams{Coupon: couponID})
+	return err
+}
+
+// UpcomingInvoice implements the Provider interface.
+func (s *Stripe) UpcomingInvoice(customerID string) (*stripe.Invoice, error) {
+	invoice, err := s.api.Invoices.GetNext(&stripe.InvoiceParams{Customer: customerID})
+	if serr, ok := err.(*stripe.Error); ok && serr.HTTPStatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	return invoice, err
+}
+
+// Invoices implements the Provider interface.
+func (s *Stripe) Invoices(customerID, startingAfter string, limit int) ([]*stripe.Invoice, bool, error) {
+	params := &stripe.InvoiceListParams{Customer: customerID}
+	params.Start = startingAfter
+	params.Limit = limit
+	params.Single = true // only fetch a single page
+
+	var invoices []*stripe.Invoice
+	i := s.api.Invoices.List(params)
+	for i.Next() {
+		invoices = append(invoices, i.Invoice())
+	}
+	if err := i.Err(); err != nil {
+		return nil, false, err
+	}
+	var more bool
+	if meta := i.Meta(); meta != nil {
+		more = meta.More
+	}
+	return invoices, more, nil
+}
+
+// PreviewPlanChange implements the Provider interface.
+func (s *Stripe) PreviewPlanChange(customerID, subID, planID string, prorationDate time.Time) (*stripe.Invoice, error) {
+	return s.api.Invoices.GetNext(&stripe.InvoiceParams{
+		Customer:         customerID,
+		Sub:              subID,
+		SubPlan:          planID,
+		SubProrationDate: prorationDate.Unix(),
+	})
+}
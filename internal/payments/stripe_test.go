@@ -0,0 +1,53 @@
+package payments
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"sync"
+	"testing"
+
+	stripe "github.com/stripe/stripe-go"
+	"github.com/stripe/stripe-go/client"
+)
+
+func TestNewStripeAPI_concurrent(t *testing.T) {
+	var (
+		logLevel = stripe.LogLevel
+		apis     = make([]*client.API, 10)
+		loggers  = make([]*log.Logger, len(apis))
+		wg       sync.WaitGroup
+	)
+	for i := range apis {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			loggers[i] = log.New(&bytes.Buffer{}, "", 0)
+			apis[i] = NewStripeAPI(fmt.Sprintf("sk_test_%d", i), loggers[i], i%3+1)
+		}(i)
+	}
+	wg.Wait()
+
+	for i, api := range apis {
+		if want := fmt.Sprintf("sk_test_%d", i); api.Customers.Key != want {
+			t.Errorf("client %d: have key %q want %q", i, api.Customers.Key, want)
+		}
+		backend, ok := api.Customers.B.(*stripe.BackendImplementation)
+		if !ok {
+			t.Fatalf("client %d: have backend %T want *stripe.BackendImplementation", i, api.Customers.B)
+		}
+		if backend.Logger != loggers[i] || backend.LogLevel != i%3+1 {
+			t.Errorf("client %d: have logger %p level %d want logger %p level %d", i, backend.Logger, backend.LogLevel, loggers[i], i%3+1)
+		}
+		if i > 0 && api.Customers.B == apis[i-1].Customers.B {
+			t.Errorf("clients %d and %d share a backend", i-1, i)
+		}
+	}
+
+	if stripe.Key != "" {
+		t.Errorf("package level stripe.Key was set to %q", stripe.Key)
+	}
+	if stripe.LogLevel != logLevel {
+		t.Errorf("package level stripe.LogLevel was changed from %d to %d", logLevel, stripe.LogLevel)
+	}
+}
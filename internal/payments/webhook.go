@@ -0,0 +1,138 @@
+package payments
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bradleyfalzon/gopherci-web/internal/signature"
+	"github.com/pkg/errors"
+)
+
+// SignatureHeader is the HTTP header Stripe sends a webhook's signature in.
+const SignatureHeader = "Stripe-Signature"
+
+// DefaultTolerance is the maximum age of a webhook's signed timestamp that
+// will be accepted, this is the same tolerance Stripe's libraries use.
+const DefaultTolerance = 5 * time.Minute
+
+// signingScheme is the only signature scheme Stripe currently uses for live
+// webhooks, other schemes (such as v0 test signatures) are ignored.
+const signingScheme = "v1"
+
+var (
+	// ErrNotSigned is returned when the webhook has no signature header.
+	ErrNotSigned = errors.New("payments: webhook has no Stripe-Signature header")
+	// ErrInvalidHeader is returned when the signature header cannot be parsed.
+	ErrInvalidHeader = errors.New("payments: webhook has an invalid Stripe-Signature header")
+	// ErrNoValidSignature is returned when none of the webhook's signatures
+	// match any of the configured secrets.
+	ErrNoValidSignature = errors.New("payments: webhook has no valid signature")
+)
+
+// TimestampError is returned when a webhook's signed timestamp is outside the
+// accepted tolerance, such as a replayed webhook.
+type TimestampError struct {
+	Timestamp time.Time     // Timestamp is the time the webhook was signed.
+	Tolerance time.Duration // Tolerance is the maximum accepted age.
+}
+
+// Error implements the error interface.
+func (e *TimestampError) Error() string {
+	return fmt.Sprintf("payments: webhook timestamp %v is outside the tolerance of %v", e.Timestamp, e.Tolerance)
+}
+
+// WebhookVerifier verifies a webhook was sent by Stripe using the endpoint's
+// signing secrets, and that it was signed recently.
+type WebhookVerifier struct {
+	secrets   signature.Secrets
+	tolerance time.Duration
+	now       func() time.Time // used to overwrite time in tests
+}
+
+// NewWebhookVerifier returns a WebhookVerifier for the endpoint's signing
+// secrets. Signatures older or newer than tolerance are rejected.
+func NewWebhookVerifier(tolerance time.Duration, secrets ...string) *WebhookVerifier {
+	return &WebhookVerifier{
+		secrets:   signature.NewSecrets(secrets...),
+		tolerance: tolerance,
+		now:       time.Now,
+	}
+}
+
+// Verify checks the payload matches the signature header, returns nil if the
+// payload is authentic, or ErrNotSigned, ErrInvalidHeader, ErrNoValidSignature
+// or *TimestampError.
+func (v *WebhookVerifier) Verify(payload []byte, header string) error {
+	if header == "" {
+		return ErrNotSigned
+	}
+
+	timestamp, signatures, err := parseSignatureHeader(header)
+	if err != nil {
+		return err
+	}
+
+	if !v.secrets.Verify(sha256.New, signedPayload(payload, timestamp), signatures...) {
+		return ErrNoValidSignature
+	}
+
+	age := v.now().Sub(timestamp)
+	if v.tolerance > 0 && (age > v.tolerance || age < -v.tolerance) {
+		return &TimestampError{Timestamp: timestamp, Tolerance: v.tolerance}
+	}
+	return nil
+}
+
+// parseSignatureHeader parses a header in the form of t=123,v1=abc,v1=def
+// returning the timestamp and all v1 signatures.
+func parseSignatureHeader(header string) (time.Time, [][]byte, error) {
+	var (
+		timestamp  time.Time
+		signatures [][]byte
+	)
+	for _, pair := range strings.Split(header, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return timestamp, nil, ErrInvalidHeader
+		}
+		switch parts[0] {
+		case "t":
+			unix, err := strconv.ParseInt(parts[1], 10, 64)
+			if err != nil {
+				return timestamp, nil, ErrInvalidHeader
+			}
+			timestamp = time.Unix(unix, 0)
+		case signingScheme:
+			sig, err := hex.DecodeString(parts[1])
+			if err != nil {
+				continue // ignore invalid signatures, one may still be valid
+			}
+			signatures = append(signatures, sig)
+		}
+	}
+	if timestamp.IsZero() {
+		return timestamp, nil, ErrInvalidHeader
+	}
+	if len(signatures) == 0 {
+		return timestamp, nil, ErrNoValidSignature
+	}
+	return timestamp, signatures, nil
+}
+
+// signedPayload returns the message Stripe signs for payload sent at
+// timestamp.
+func signedPayload(payload []byte, timestamp time.Time) []byte {
+	return append([]byte(fmt.Sprintf("%d.", timestamp.Unix())), payload...)
+}
+
+// SignWebhook returns a Stripe-Signature header value for payload signed
+// with secret at timestamp, it behaves like Stripe and is used to send fake
+// webhooks in tests and development.
+func SignWebhook(payload []byte, secret string, timestamp time.Time) string {
+	sig := signature.Sign(sha256.New, secret, signedPayload(payload, timestamp))
+	return fmt.Sprintf("t=%d,%s=%s", timestamp.Unix(), signingScheme, hex.EncodeToString(sig))
+}
@@ -0,0 +1,87 @@
+package payments
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebhookVerifier_Verify(t *testing.T) {
+	var (
+		now     = time.Unix(1500000000, 0)
+		payload = []byte(`{"id":"evt_1","type":"customer.subscription.deleted"}`)
+	)
+
+	tests := []struct {
+		desc    string
+		secrets []string
+		header  string
+		wantErr error
+	}{
+		{"valid", []string{"whsec_1"}, SignWebhook(payload, "whsec_1", now), nil},
+		{"rotated secret", []string{"whsec_old", "whsec_new"}, SignWebhook(payload, "whsec_new", now), nil},
+		{"multiple signatures", []string{"whsec_1"}, SignWebhook(payload, "whsec_other", now) + "," + strings.SplitN(SignWebhook(payload, "whsec_1", now), ",", 2)[1], nil},
+		{"wrong secret", []string{"whsec_1"}, SignWebhook(payload, "whsec_2", now), ErrNoValidSignature},
+		{"no secrets", nil, SignWebhook(payload, "whsec_1", now), ErrNoValidSignature},
+		{"not signed", []string{"whsec_1"}, "", ErrNotSigned},
+		{"no timestamp", []string{"whsec_1"}, "v1=abc", ErrInvalidHeader},
+		{"bad timestamp", []string{"whsec_1"}, "t=abc,v1=abc", ErrInvalidHeader},
+		{"malformed", []string{"whsec_1"}, "garbage", ErrInvalidHeader},
+		{"no v1 signature", []string{"whsec_1"}, "t=1500000000,v0=abc", ErrNoValidSignature},
+	}
+
+	for _, test := range tests {
+		v := NewWebhookVerifier(DefaultTolerance, test.secrets...)
+		v.now = func() time.Time { return now }
+
+		err := v.Verify(payload, test.header)
+		if err != test.wantErr {
+			t.Errorf("%s: have err %v, want %v", test.desc, err, test.wantErr)
+		}
+	}
+}
+
+func TestWebhookVerifier_Verify_tampered(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	v := NewWebhookVerifier(DefaultTolerance, "whsec_1")
+	v.now = func() time.Time { return now }
+
+	header := SignWebhook([]byte(`{"id":"evt_1"}`), "whsec_1", now)
+	if err := v.Verify([]byte(`{"id":"evt_2"}`), header); err != ErrNoValidSignature {
+		t.Errorf("have err %v, want %v", err, ErrNoValidSignature)
+	}
+}
+
+func TestWebhookVerifier_Verify_tolerance(t *testing.T) {
+	var (
+		now     = time.Unix(1500000000, 0)
+		payload = []byte(`{"id":"evt_1"}`)
+	)
+
+	tests := []struct {
+		signedAt time.Time
+		wantErr  bool
+	}{
+		{now, false},
+		{now.Add(-DefaultTolerance + time.Second), false},
+		{now.Add(-DefaultTolerance - time.Second), true},
+		{now.Add(DefaultTolerance + time.Second), true},
+	}
+
+	for _, test := range tests {
+		v := NewWebhookVerifier(DefaultTolerance, "whsec_1")
+		v.now = func() time.Time { return now }
+
+		err := v.Verify(payload, SignWebhook(payload, "whsec_1", test.signedAt))
+		switch {
+		case test.wantErr && err == nil:
+			t.Errorf("signed at %v: expected error", test.signedAt)
+		case test.wantErr:
+			if _, ok := err.(*TimestampError); !ok {
+				t.Errorf("signed at %v: have err %T, want *TimestampError", test.signedAt, err)
+			}
+		case err != nil:
+			t.Errorf("signed at %v: unexpected error: %v", test.signedAt, err)
+		}
+	}
+}
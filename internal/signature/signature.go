@@ -0,0 +1,46 @@
+// Package signature verifies HMAC signatures of webhook payloads.
+package signature
+
+import (
+	"crypto/hmac"
+	"hash"
+	"strings"
+)
+
+// Secrets are the signing secrets a webhook may be signed with. More than one
+// secret is accepted so a secret can be rolled without rejecting webhooks
+// signed with the old secret.
+type Secrets []string
+
+// NewSecrets returns Secrets of secrets, ignoring blank secrets.
+func NewSecrets(secrets ...string) Secrets {
+	var s Secrets
+	for _, secret := range secrets {
+		if secret = strings.TrimSpace(secret); secret != "" {
+			s = append(s, secret)
+		}
+	}
+	return s
+}
+
+// Sign returns the HMAC of message using hash h and secret.
+func Sign(h func() hash.Hash, secret string, message []byte) []byte {
+	mac := hmac.New(h, []byte(secret))
+	mac.Write(message)
+	return mac.Sum(nil)
+}
+
+// Verify returns true if any of signatures is the HMAC of message using hash
+// h and any of the secrets. Signatures are compared in constant time.
+func (s Secrets) Verify(h func() hash.Hash, message []byte, signatures ...[]byte) bool {
+	var valid bool
+	for _, secret := range s {
+		expected := Sign(h, secret, message)
+		for _, signature := range signatures {
+			if hmac.Equal(expected, signature) {
+				valid = true
+			}
+		}
+	}
+	return valid
+}
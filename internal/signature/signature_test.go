@@ -0,0 +1,41 @@
+package signature
+
+import (
+	"crypto/sha256"
+	"testing"
+)
+
+func TestSecrets_Verify(t *testing.T) {
+	var (
+		payload = []byte(`{"id": 1}`)
+		old     = Sign(sha256.New, "old", payload)
+		current = Sign(sha256.New, "current", payload)
+		other   = Sign(sha256.New, "other", payload)
+	)
+	secrets := NewSecrets(" current ", "", "old")
+	if want := (Secrets{"current", "old"}); len(secrets) != len(want) || secrets[0] != want[0] || secrets[1] != want[1] {
+		t.Fatalf("have secrets %q want %q", secrets, want)
+	}
+
+	tests := []struct {
+		desc       string
+		signatures [][]byte
+		want       bool
+	}{
+		{"current secret", [][]byte{current}, true},
+		{"old secret while rolling", [][]byte{old}, true},
+		{"any valid signature", [][]byte{other, current}, true},
+		{"unknown secret", [][]byte{other}, false},
+		{"no signatures", nil, false},
+		{"modified payload", [][]byte{Sign(sha256.New, "current", []byte(`{"id": 2}`))}, false},
+	}
+	for _, test := range tests {
+		if have := secrets.Verify(sha256.New, payload, test.signatures...); have != test.want {
+			t.Errorf("%s: have %v want %v", test.desc, have, test.want)
+		}
+	}
+
+	if NewSecrets().Verify(sha256.New, payload, current) {
+		t.Error("no secrets: expected signature to be invalid")
+	}
+}
@@ -0,0 +1,299 @@
+package users
+
+import (
+	"database/sql"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/bradleyfalzon/gopherci-web/internal/notify"
+	"github.com/bradleyfalzon/gopherci-web/internal/payments"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	stripe "github.com/stripe/stripe-go"
+)
+
+// Account is a billing account belonging to a GitHub organisation. The
+// organisation's subscription and installations belong to the account, not
+// the user who enabled them, so they continue if that user leaves the
+// organisation. Any admin of the organisation can manage the account.
+type Account struct {
+	Logger           *logrus.Entry
+	db               *sqlx.DB
+	payments         payments.Provider
+	catalogue        payments.Catalogue
+	AccountID        int    `db:"id"`
+	GitHubID         int    `db:"github_id"` // GitHubID is the organisation's GitHub account ID.
+	Login            string `db:"login"`     // Login is the organisation's GitHub login.
+	Email            string `db:"email"`     // Email is the billing contact, the admin who last subscribed.
+	StripeCustomerID string `db:"stripe_customer_id"`
+	// StripeCurrency is the lower case currency of the stripe customer, blank
+	// if the account is not a stripe customer.
+	StripeCurrency string `db:"stripe_currency"`
+}
+
+// getAccount looks up a single billing account matching the where condition,
+// if no account was found, account is nil.
+func getAccount(logger *logrus.Entry, db *sqlx.DB, provider payments.Provider, catalogue payments.Catalogue, where string, args ...interface{}) (*Account, error) {
+	account := &Account{db: db, payments: provider, catalogue: catalogue}
+	err := db.Get(account, "SELECT id, github_id, login, email, stripe_customer_id, stripe_currency FROM billing_accounts WHERE "+where, args...)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, nil
+	case err != nil:
+		return nil, errors.Wrap(err, "could not select from billing_accounts")
+	}
+	account.Logger = logger.WithField("billingAccountID", account.AccountID)
+	return account, nil
+}
+
+// BillingURL returns the console page where the account's subscription is
+// managed.
+func (a *Account) BillingURL() string {
+	return "https://gopherci.io/console/org/" + a.Login + "/billing"
+}
+
+// StripeCustomer gets the account's stripe customer, returns nil if there's
+// no stripe customer ID or an error if an error occurs.
+func (a *Account) StripeCustomer() (*stripe.Customer, error) {
+	if a.StripeCustomerID == "" {
+		return nil, nil
+	}
+	customer, err := a.payments.Customer(a.StripeCustomerID)
+	return customer, errors.Wrapf(err, "could not get stripe customer id %q", a.StripeCustomerID)
+}
+
+// StripeSubscriptions returns the current and previous subscriptions of the
+// account's stripe customer.
+func (a *Account) StripeSubscriptions(customer *stripe.Customer) []Subscription {
+	return stripeSubscriptions(customer)
+}
+
+// ActiveStripeSubscription returns the subscription which has not been
+// cancelled, or nil if all subscriptions have been cancelled.
+func (a *Account) ActiveStripeSubscription(customer *stripe.Customer) *Subscription {
+	return activeSubscription(customer)
+}
+
+// HasActiveSubscription returns true if the account has a stripe
+// subscription that has not yet ended.
+func (a *Account) HasActiveSubscription() (bool, error) {
+	customer, err := a.StripeCustomer()
+	if err != nil || customer == nil {
+		return false, err
+	}
+	return HasActiveSubscription(customer), nil
+}
+
+// Plan returns the plan of the account's active subscription, or nil if the
+// account has no active subscription.
+func (a *Account) Plan() (*payments.Plan, error) {
+	customer, err := a.StripeCustomer()
+	if err != nil || customer == nil {
+		return nil, err
+	}
+	return customerPlan(a.catalogue, customer), nil
+}
+
+// ProcessStripePayment subscribes the account to plan using the payment
+// source token, recording email as the account's billing contact. Only
+// accounts which have never been a stripe customer are offered a free trial,
+// not accounts subscribing again or changing currency.
+func (a *Account) ProcessStripePayment(token, plan, email string) error {
+	p, err := a.payments.Plan(plan)
+	if err != nil {
+		return errors.Wrapf(err, "could not get plan %q", plan)
+	}
+
+	if _, err := a.db.Exec(`UPDATE billing_accounts SET email = ? WHERE id = ?`, email, a.AccountID); err != nil {
+		return errors.Wrapf(err, "could not record billing email for billingAccountID %v", a.AccountID)
+	}
+	a.Email = email
+
+	if a.StripeCustomerID != "" && a.StripeCurrency == string(p.Currency) {
+		if _, err := a.payments.Subscribe(a.StripeCustomerID, plan, false); err != nil {
+			return errors.Wrapf(err, "could not subscribe billingAccountID %v stripe customer %v to %q", a.AccountID, a.StripeCustomerID, plan)
+		}
+		return nil
+	}
+
+	customer, err := a.payments.NewCustomer(map[string]string{
+		payments.AccountIDMeta: strconv.Itoa(a.AccountID),
+	}, token, plan, "", a.StripeCustomerID == "")
+	if err != nil {
+		return errors.Wrap(err, "could not create stripe customer")
+	}
+
+	_, err = a.db.Exec(`UPDATE billing_accounts SET stripe_customer_id = ?, stripe_currency = ? WHERE id = ?`, customer.ID, string(customer.Currency), a.AccountID)
+	if err != nil {
+		return errors.Wrapf(err, "Created stripe customer with id %q but could not allocate to billingAccountID %v", customer.ID, a.AccountID)
+	}
+	a.StripeCustomerID, a.StripeCurrency = customer.ID, string(customer.Currency)
+	return nil
+}
+
+// SendTrialReminder notifies the account's billing contact the free trial of
+// subscription sub ends soon. No reminder is sent if the account has no
+// billing email.
+func (a *Account) SendTrialReminder(notifier notify.Notifier, sub *stripe.Sub) error {
+	if a.Email == "" {
+		a.Logger.Warn("no billing email, not sending trial reminder")
+		return nil
+	}
+	return sendTrialReminder(notifier, a.Email, a.BillingURL(), sub)
+}
+
+// CancelStripeSubscription cancels the account's stripe subscription at the
+// end of the current billing period. It does not disable any enabled
+// installations.
+func (a *Account) CancelStripeSubscription(id string) error {
+	return a.payments.CancelSubscription(id, true)
+}
+
+// EnableInstallation marks the organisation's GitHub installation as enabled
+// for this account on behalf of the user by, and queues the installation to be
+// enabled in GopherCI by ApplyInstallationChanges. If a user enabled the
+// installation it's taken over from them, and recorded as a transfer to the
+// account. Returns *QuotaError if the account has no active subscription, or
+// installations were disabled by dunning.
+func (a *Account) EnableInstallation(installationID int, by *User) error {
+	if err := a.checkQuota(); err != nil {
+		return err
+	}
+	var fromUserIDs []int
+	err := inTx(a.db, func(tx *sqlx.Tx) error {
+		err := tx.Select(&fromUserIDs, `SELECT user_id FROM gh_installations WHERE installation_id = ? AND user_id IS NOT NULL FOR UPDATE`, installationID)
+		if err != nil {
+			return errors.Wrapf(err, "could not select existing owner of installationID %v", installationID)
+		}
+		for _, fromUserID := range fromUserIDs {
+			_, err = tx.Exec(`INSERT INTO installation_transfers (installation_id, from_user_id, to_billing_account_id, by_user_id) VALUES (?, ?, ?, ?)`, installationID, fromUserID, a.AccountID, by.UserID)
+			if err != nil {
+				return errors.Wrapf(err, "could not record transfer of installationID %v", installationID)
+			}
+		}
+		_, err = tx.Exec(`DELETE FROM gh_installations WHERE installation_id = ?`, installationID)
+		if err != nil {
+			return errors.Wrapf(err, "could not remove existing installationID %v", installationID)
+		}
+		_, err = tx.Exec(`INSERT INTO gh_installations (billing_account_id, installation_id, account_id) VALUES (?, ?, ?)`, a.AccountID, installationID, a.GitHubID)
+		if err != nil {
+			return err
+		}
+		return queueInstallationChange(tx, installationID, true)
+	})
+	if err != nil {
+		return err
+	}
+	for _, fromUserID := range fromUserIDs {
+		a.Logger.WithField("installationID", installationID).Infof("took over installation from userID %v by userID %v", fromUserID, by.UserID)
+	}
+	return nil
+}
+
+// checkQuota returns *QuotaError if the account cannot enable installations,
+// as it has no active subscription or dunning disabled its installations.
+func (a *Account) checkQuota() error {
+	active, err := a.HasActiveSubscription()
+	if err != nil {
+		return errors.Wrap(err, "could not check account's subscription")
+	}
+	if !active {
+		return &QuotaError{}
+	}
+	disabled, err := a.dunning().disabled()
+	if err != nil {
+		return err
+	}
+	if disabled {
+		return &QuotaError{Disabled: true}
+	}
+	return nil
+}
+
+// MemberInstallation is an installation of the account's organisation which
+// is enabled by, and billed to, a user instead of the account.
+type MemberInstallation struct {
+	InstallationID int    `db:"installation_id"`
+	UserID         int    `db:"user_id"`
+	Email          string `db:"email"`
+}
+
+// MemberInstallations returns the installations of the account's
+// organisation enabled by users, which are taken over if they're enabled for
+// the account.
+func (a *Account) MemberInstallations() ([]MemberInstallation, error) {
+	var installations []MemberInstallation
+	err := a.db.Select(&installations, `SELECT i.installation_id, i.user_id, u.email FROM gh_installations i JOIN users u ON u.id = i.user_id WHERE i.account_id = ? ORDER BY i.installation_id`, a.GitHubID)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not select installations enabled by members")
+	}
+	return installations, nil
+}
+
+// DisableInstallation marks a GitHub installation as disabled for this
+// account, and queues the installation to be disabled in GopherCI by
+// ApplyInstallationChanges.
+func (a *Account) DisableInstallation(installationID int) error {
+	return inTx(a.db, func(tx *sqlx.Tx) error {
+		_, err := tx.Exec(`DELETE FROM gh_installations WHERE billing_account_id = ? AND installation_id = ?`, a.AccountID, installationID)
+		if err != nil {
+			return err
+		}
+		return queueInstallationChange(tx, installationID, false)
+	})
+}
+
+// DisableAllInstallations disables all installations enabled by this
+// account, and queues them to be disabled in GopherCI, such as when its
+// subscription ends.
+func (a *Account) DisableAllInstallations() error {
+	installationIDs, err := a.EnabledInstallations()
+	if err != nil {
+		return errors.Wrap(err, "could not get enabled installations")
+	}
+	a.Logger.Infof("disabling %d enabled installations", len(installationIDs))
+
+	for _, installationID := range installationIDs {
+		if err := a.DisableInstallation(installationID); err != nil {
+			return errors.Wrapf(err, "could not disable installationID %v for account", installationID)
+		}
+		a.Logger.WithField("installationID", installationID).Info("disabled installation for account")
+	}
+	return nil
+}
+
+// InstallationEnabled checks if installationID is enabled by this account,
+// any error means the installation is not enabled by this account.
+func (a *Account) InstallationEnabled(installationID int) bool {
+	var installations int
+	err := a.db.Get(&installations, `SELECT COUNT(*) FROM gh_installations WHERE billing_account_id = ? AND installation_id = ?`, a.AccountID, installationID)
+	if err != nil {
+		return false
+	}
+	return installations > 0
+}
+
+// EnabledInstallations returns the installationIDs enabled by this account.
+func (a *Account) EnabledInstallations() ([]int, error) {
+	installationIDs := []int{}
+	err := a.db.Select(&installationIDs, `SELECT installation_id FROM gh_installations WHERE billing_account_id = ?`, a.AccountID)
+	if err != nil {
+		return nil, err
+	}
+	return installationIDs, nil
+}
+
+// BuildUsage returns the account's build usage for all enabled installations
+// on the UTC day containing day.
+func (a *Account) BuildUsage(counter AnalysisCounter, day time.Time) (*BuildUsage, error) {
+	installationIDs, err := a.EnabledInstallations()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get enabled installations")
+	}
+	plan, err := a.Plan()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get account's plan")
+	}
+	return buildUsage(counter, day, installationIDs, plan)
+}
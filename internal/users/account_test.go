@@ -0,0 +1,251 @@
+package users
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"golang.org/x/oauth2"
+
+	sqlmock "github.com/bradleyfalzon/go-sqlmock"
+	"github.com/bradleyfalzon/gopherci-web/internal/payments"
+	"github.com/jmoiron/sqlx"
+	stripe "github.com/stripe/stripe-go"
+)
+
+func TestAccountProcessStripePayment(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	provider := payments.NewFake(&stripe.Plan{ID: "ProfessionalMonthlyUSD", Amount: 799, Currency: "usd"})
+	account := &Account{db: sqlx.NewDb(db, "sqlmock"), payments: provider, AccountID: 3, GitHubID: 4, Login: "org", Logger: logger}
+
+	mock.ExpectExec(`UPDATE billing_accounts SET email = \? WHERE id = \?`).
+		WithArgs("admin@example.com", account.AccountID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`UPDATE billing_accounts SET stripe_customer_id = \?, stripe_currency = \? WHERE id = \?`).
+		WithArgs(sqlmock.AnyArg(), "usd", account.AccountID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := account.ProcessStripePayment("tok_visa", "ProfessionalMonthlyUSD", "admin@example.com"); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	customer, err := account.StripeCustomer()
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if have := customer.Meta[payments.AccountIDMeta]; have != "3" {
+		t.Errorf("have accountID metadata %q want %q", have, "3")
+	}
+	if have := customer.Meta[payments.UserIDMeta]; have != "" {
+		t.Errorf("have userID metadata %q want none", have)
+	}
+	if active, err := account.HasActiveSubscription(); err != nil || !active {
+		t.Errorf("have active %v err %v want active subscription", active, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestAccountProcessStripePayment_noRepeatTrial(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	provider := payments.NewFake(
+		&stripe.Plan{ID: "ProfessionalMonthly", Amount: 999, Currency: "aud", TrialPeriod: 30},
+		&stripe.Plan{ID: "ProfessionalMonthlyUSD", Amount: 799, Currency: "usd", TrialPeriod: 30},
+	)
+	legacy, err := provider.NewCustomer(nil, "tok_visa", "ProfessionalMonthly", "", true)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	account := &Account{db: sqlx.NewDb(db, "sqlmock"), payments: provider, AccountID: 3, GitHubID: 4, Login: "org", StripeCustomerID: legacy.ID, StripeCurrency: "aud", Logger: logger}
+
+	// Changing currency creates a new customer, without another free trial.
+	mock.ExpectExec(`UPDATE billing_accounts SET email = \? WHERE id = \?`).
+		WithArgs("admin@example.com", account.AccountID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`UPDATE billing_accounts SET stripe_customer_id = \?, stripe_currency = \? WHERE id = \?`).
+		WithArgs(sqlmock.AnyArg(), "usd", account.AccountID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := account.ProcessStripePayment("tok_visa", "ProfessionalMonthlyUSD", "admin@example.com"); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	customer, err := account.StripeCustomer()
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	subs := account.StripeSubscriptions(customer)
+	if customer.ID == legacy.ID || len(subs) != 1 || subs[0].InTrial {
+		t.Errorf("have customer %v subscriptions %+v want new customer without trial", customer.ID, subs)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestAccountMemberInstallations(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	account := &Account{db: sqlx.NewDb(db, "sqlmock"), AccountID: 3, GitHubID: 4, Login: "org", Logger: logger}
+
+	mock.ExpectQuery(`SELECT i.installation_id, i.user_id, u.email FROM gh_installations i JOIN users u ON u.id = i.user_id WHERE i.account_id = \? ORDER BY i.installation_id`).
+		WithArgs(account.GitHubID).
+		WillReturnRows(sqlmock.NewRows([]string{"installation_id", "user_id", "email"}).AddRow(10, 7, "member@example.com"))
+
+	installations, err := account.MemberInstallations()
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	want := []MemberInstallation{{InstallationID: 10, UserID: 7, Email: "member@example.com"}}
+	if !reflect.DeepEqual(installations, want) {
+		t.Errorf("have %+v want %+v", installations, want)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestAccountEnableInstallation(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	provider := payments.NewFake(&stripe.Plan{ID: "ProfessionalMonthlyUSD", Amount: 799, Currency: "usd"})
+	account := &Account{db: sqlx.NewDb(db, "sqlmock"), payments: provider, AccountID: 3, GitHubID: 4, Login: "org", Logger: logger}
+
+	by := &User{UserID: 5}
+	if err := account.EnableInstallation(10, by); err == nil {
+		t.Fatal("expected error without subscription")
+	} else if _, ok := err.(*QuotaError); !ok {
+		t.Fatalf("have err %v, want *QuotaError", err)
+	}
+
+	customer, err := provider.NewCustomer(nil, "tok_visa", "ProfessionalMonthlyUSD", "", true)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	account.StripeCustomerID = customer.ID
+
+	// Installations disabled by dunning are not enabled until the payment
+	// succeeds.
+	expectDunning(mock, "account_dunning", "billing_account_id", account.AccountID, DunningDisabled)
+	if err := account.EnableInstallation(10, by); err == nil {
+		t.Fatal("expected error after dunning disabled installations")
+	} else if qerr, ok := err.(*QuotaError); !ok || !qerr.Disabled {
+		t.Fatalf("have err %v, want *QuotaError with Disabled", err)
+	}
+
+	expectDunning(mock, "account_dunning", "billing_account_id", account.AccountID, "")
+	// The installation is taken over from the user who enabled it, and
+	// recorded as a transfer to the account.
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT user_id FROM gh_installations WHERE installation_id = \? AND user_id IS NOT NULL FOR UPDATE`).
+		WithArgs(10).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(7))
+	mock.ExpectExec(`INSERT INTO installation_transfers \(installation_id, from_user_id, to_billing_account_id, by_user_id\) VALUES \(\?, \?, \?, \?\)`).
+		WithArgs(10, 7, account.AccountID, by.UserID).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`DELETE FROM gh_installations WHERE installation_id = \?`).
+		WithArgs(10).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`INSERT INTO gh_installations \(billing_account_id, installation_id, account_id\) VALUES \(\?, \?, \?\)`).
+		WithArgs(account.AccountID, 10, account.GitHubID).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectQueueChange(mock, 10, true)
+	mock.ExpectCommit()
+
+	if err := account.EnableInstallation(10, by); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestAccountDisableAllInstallations(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	account := &Account{db: sqlx.NewDb(db, "sqlmock"), AccountID: 3, Logger: logger}
+
+	mock.ExpectQuery(`SELECT installation_id FROM gh_installations WHERE billing_account_id = \?`).
+		WithArgs(account.AccountID).
+		WillReturnRows(sqlmock.NewRows([]string{"installation_id"}).AddRow(10))
+	mock.ExpectBegin()
+	mock.ExpectExec(`DELETE FROM gh_installations WHERE billing_account_id = \? AND installation_id = \?`).
+		WithArgs(account.AccountID, 10).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectQueueChange(mock, 10, false)
+	mock.ExpectCommit()
+
+	if err := account.DisableAllInstallations(); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestGitHubOrgAdmin(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/user/memberships/orgs/admin-org":
+			fmt.Fprintln(w, `{"state": "active", "role": "admin", "organization": {"login": "admin-org", "id": 4}}`)
+		case "/user/memberships/orgs/member-org":
+			fmt.Fprintln(w, `{"state": "active", "role": "member", "organization": {"login": "member-org", "id": 5}}`)
+		case "/user/memberships/orgs/pending-org":
+			fmt.Fprintln(w, `{"state": "pending", "role": "admin", "organization": {"login": "pending-org", "id": 6}}`)
+		default:
+			http.Error(w, `{"message": "Not Found"}`, http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+	githubBaseURL = ts.URL + "/"
+
+	user := &User{GHClient: NewClient(&oauth2.Config{}, &oauth2.Token{AccessToken: "a"}), Logger: logger}
+
+	tests := []struct {
+		org  string
+		want int // want is the org's ID, 0 if the user is not an admin
+	}{
+		{"admin-org", 4},
+		{"member-org", 0},
+		{"pending-org", 0},
+		{"other-org", 0},
+	}
+	for _, test := range tests {
+		org, err := user.GitHubOrgAdmin(context.Background(), test.org)
+		if err != nil {
+			t.Errorf("org %v: unexpected error: %v", test.org, err)
+			continue
+		}
+		var have int
+		if org != nil {
+			have = *org.ID
+		}
+		if have != test.want {
+			t.Errorf("org %v: have ID %v want %v", test.org, have, test.want)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package users
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// Delays between attempts to apply an installation change which failed.
+const (
+	minChangeBackoff = 10 * time.Second
+	maxChangeBackoff = time.Hour
+)
+
+// maxChangesPerApply is the maximum number of changes applied by a single
+// call to ApplyInstallationChanges.
+const maxChangesPerApply = 100
+
+// changeClaimTimeout is how long a change is claimed while it's applied, after
+// which another process may claim it, such as if the claiming process exited.
+const changeClaimTimeout = 5 * time.Minute
+
+// InstallationStateChanger enables and disables an installation in GopherCI,
+// it's satisfied by *gopherci.Client.
+type InstallationStateChanger interface {
+	EnableInstallation(installationID int) error
+	DisableInstallation(installationID int) error
+}
+
+// InstallationChange is a change to an installation's state in GopherCI. It's
+// recorded in the same transaction as the change in GopherCI-web, so the
+// two databases eventually agree, and applied by ApplyInstallationChanges.
+type InstallationChange struct {
+	ID             int            `db:"id"`
+	InstallationID int            `db:"installation_id"`
+	Enable         bool           `db:"enable"` // Enable is true to enable the installation, false to disable it.
+	Attempts       int            `db:"attempts"`
+	Error          sql.NullString `db:"error"` // error from the last attempt
+}
+
+// queueInstallationChange records in tx that installationID should be
+// enabled or disabled in GopherCI, replacing any change for the installation
+// which has not been applied or claimed. A claimed change is being applied,
+// so the new change is applied after it.
+func queueInstallationChange(tx *sqlx.Tx, installationID int, enable bool) error {
+	_, err := tx.Exec(`DELETE FROM installation_changes WHERE installation_id = ? AND applied_at IS NULL AND claimed_until IS NULL`, installationID)
+	if err != nil {
+		return errors.Wrapf(err, "could not remove pending changes for installationID %v", installationID)
+	}
+	_, err = tx.Exec(`INSERT INTO installation_changes (installation_id, enable) VALUES (?, ?)`, installationID, enable)
+	return errors.Wrapf(err, "could not queue change for installationID %v", installationID)
+}
+
+// QueueInstallationChange queues installationID to be enabled or disabled in
+// GopherCI by ApplyInstallationChanges, without changing the user or billing
+// account which enabled it, such as when the installation is suspended.
+// Disabling an installation removes any build limit throttle, so it's not
+// enabled again when the limit resets.
+func (um *UserManager) QueueInstallationChange(installationID int, enable bool) error {
+	return inTx(um.db, func(tx *sqlx.Tx) error {
+		if !enable {
+			if err := unthrottleInstallation(tx, installationID); err != nil {
+				return err
+			}
+		}
+		return queueInstallationChange(tx, installationID, enable)
+	})
+}
+
+// ResumeInstallation queues installationID, owned by GitHub accountID, to be
+// enabled in GopherCI after it was unsuspended, if the user or billing account
+// which enabled it could enable it now. Returns *QuotaError, and leaves the
+// installation disabled, if they have no active subscription, dunning
+// disabled their installations, or their plan no longer permits it. If their
+// daily build limit has been reached, the installation is throttled instead
+// and enabled when the limit resets. Returns true if the installation was
+// queued to be enabled.
+func (um *UserManager) ResumeInstallation(counter AnalysisCounter, now time.Time, installationID, accountID int) (bool, error) {
+	owner, err := um.GetInstallationOwner(installationID)
+	if err != nil {
+		return false, errors.Wrap(err, "could not get installation's owner")
+	}
+	account, err := um.GetInstallationAccount(installationID)
+	if err != nil {
+		return false, errors.Wrap(err, "could not get installation's billing account")
+	}
+
+	var usage *BuildUsage
+	switch {
+	case owner != nil:
+		if err := owner.checkQuota(installationID, accountID); err != nil {
+			return false, err
+		}
+		usage, err = owner.BuildUsage(counter, now)
+	case account != nil:
+		if err := account.checkQuota(); err != nil {
+			return false, err
+		}
+		usage, err = account.BuildUsage(counter, now)
+	default:
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "could not get build usage")
+	}
+
+	if usage.LimitReached() {
+		_, err := um.ThrottleInstallations(now, installationID)
+		return false, err
+	}
+	return true, um.QueueInstallationChange(installationID, true)
+}
+
+// inTx calls fn with a transaction on db, the transaction is committed if fn
+// returns nil, else it's rolled back and fn's error returned.
+func inTx(db *sqlx.DB, fn func(tx *sqlx.Tx) error) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "could not begin transaction")
+	}
+	if err := fn(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return errors.Wrap(tx.Commit(), "could not commit transaction")
+}
+
+// changeBackoff returns the delay before the next attempt to apply a change
+// which has failed attempts times, doubling from minChangeBackoff up to
+// maxChangeBackoff.
+func changeBackoff(attempts int) time.Duration {
+	backoff := minChangeBackoff
+	for i := 1; i < attempts && backoff < maxChangeBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxChangeBackoff {
+		return maxChangeBackoff
+	}
+	return backoff
+}
+
+// PendingInstallationChanges returns the subset of installationIDs which have
+// a change not yet applied in GopherCI.
+func (um *UserManager) PendingInstallationChanges(installationIDs ...int) (map[int]bool, error) {
+	pending := make(map[int]bool)
+	if len(installationIDs) == 0 {
+		return pending, nil
+	}
+	query, args, err := sqlx.In(`SELECT DISTINCT installation_id FROM installation_changes WHERE installation_id IN (?) AND applied_at IS NULL`, installationIDs)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	if err := um.db.Select(&ids, query, args...); err != nil {
+		return nil, errors.Wrap(err, "could not select pending installation changes")
+	}
+	for _, installationID := range ids {
+		pending[installationID] = true
+	}
+	return pending, nil
+}
+
+// claimInstallationChanges claims the changes due at now for
+// changeClaimTimeout so no other process applies them. Only the newest change
+// of each installation is returned, older changes are superseded and removed.
+// Installations with a change claimed by another process are skipped until
+// that change is applied, so an installation's changes are applied in order.
+func (um *UserManager) claimInstallationChanges(now time.Time) ([]InstallationChange, error) {
+	var claimed []InstallationChange
+	err := inTx(um.db, func(tx *sqlx.Tx) error {
+		var changes []InstallationChange
+		err := tx.Select(&changes, "SELECT id, installation_id, enable, attempts, `error` FROM installation_changes c WHERE applied_at IS NULL AND next_attempt_at <= ? AND (claimed_until IS NULL OR claimed_until <= ?) AND NOT EXISTS (SELECT 1 FROM installation_changes o WHERE o.installation_id = c.installation_id AND o.applied_at IS NULL AND o.claimed_until > ?) ORDER BY id LIMIT ? FOR UPDATE", now, now, now, maxChangesPerApply)
+		if err != nil {
+			return errors.Wrap(err, "could not select pending installation changes")
+		}
+
+		newest := make(map[int]int) // installationID => index in claimed
+		var superseded, ids []int
+		for _, change := range changes {
+			if i, ok := newest[change.InstallationID]; ok {
+				superseded = append(superseded, claimed[i].ID)
+				claimed[i] = change
+				continue
+			}
+			newest[change.InstallationID] = len(claimed)
+			claimed = append(claimed, change)
+		}
+		if len(superseded) > 0 {
+			query, args, err := sqlx.In(`DELETE FROM installation_changes WHERE id IN (?)`, superseded)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.Exec(query, args...); err != nil {
+				return errors.Wrap(err, "could not remove superseded installation changes")
+			}
+		}
+		if len(claimed) == 0 {
+			return nil
+		}
+
+		for _, change := range claimed {
+			ids = append(ids, change.ID)
+		}
+		query, args, err := sqlx.In(`UPDATE installation_changes SET claimed_until = ? WHERE id IN (?)`, now.Add(changeClaimTimeout), ids)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(query, args...)
+		return errors.Wrap(err, "could not claim installation changes")
+	})
+	if err != nil {
+		return nil, err
+	}
+	return claimed, nil
+}
+
+// ApplyInstallationChanges claims the changes due at now and applies them to
+// GopherCI, oldest first, and returns the number of changes applied. Failed
+// changes are retried with an exponential backoff. Changes are claimed before
+// they're applied, so multiple processes may apply changes concurrently. A
+// change whose claim expired and was taken by another process while it was
+// being applied is left to that process.
+func (um *UserManager) ApplyInstallationChanges(gci InstallationStateChanger, now time.Time) (int, error) {
+	changes, err := um.claimInstallationChanges(now)
+	if err != nil {
+		return 0, err
+	}
+	claimedUntil := now.Add(changeClaimTimeout)
+
+	var applied int
+	for _, change := range changes {
+		logger := um.logger.WithField("installationID", change.InstallationID).WithField("changeID", change.ID)
+
+		var gciErr error
+		if change.Enable {
+			gciErr = gci.EnableInstallation(change.InstallationID)
+		} else {
+			gciErr = gci.DisableInstallation(change.InstallationID)
+		}
+		if gciErr != nil {
+			attempts := change.Attempts + 1
+			logger.WithError(gciErr).Warnf("could not apply installation change, attempt %d", attempts)
+			res, err := um.db.Exec("UPDATE installation_changes SET attempts = ?, next_attempt_at = ?, claimed_until = NULL, `error` = ? WHERE id = ? AND claimed_until = ?", attempts, now.Add(changeBackoff(attempts)), gciErr.Error(), change.ID, claimedUntil)
+			if err != nil {
+				return applied, errors.Wrapf(err, "could not record failed installation change %v", change.ID)
+			}
+			if rows, err := res.RowsAffected(); err == nil && rows == 0 {
+				logger.Warn("lost claim on installation change, not recording failure")
+			}
+			continue
+		}
+
+		res, err := um.db.Exec("UPDATE installation_changes SET applied_at = ?, claimed_until = NULL, `error` = NULL WHERE id = ? AND claimed_until = ?", now, change.ID, claimedUntil)
+		if err != nil {
+			return applied, errors.Wrapf(err, "could not mark installation change %v as applied", change.ID)
+		}
+		rows, err := res.RowsAffected()
+		if err != nil {
+			return applied, errors.Wrapf(err, "could not get rows affected marking installation change %v as applied", change.ID)
+		}
+		if rows == 0 {
+			logger.Warn("lost claim on installation change, not marking as applied")
+			continue
+		}
+		applied++
+		logger.Infof("applied installation change, enable: %v", change.Enable)
+	}
+	return applied, nil
+}
@@ -0,0 +1,379 @@
+package users
+
+import (
+	"database/sql/driver"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	sqlmock "github.com/bradleyfalzon/go-sqlmock"
+	"github.com/bradleyfalzon/gopherci-web/internal/payments"
+	"github.com/jmoiron/sqlx"
+	stripe "github.com/stripe/stripe-go"
+)
+
+// expectQueueChange expects installationID to be queued to be enabled or
+// disabled in GopherCI.
+func expectQueueChange(mock sqlmock.Sqlmock, installationID int, enable bool) {
+	mock.ExpectExec(`DELETE FROM installation_changes WHERE installation_id = \? AND applied_at IS NULL AND claimed_until IS NULL`).
+		WithArgs(installationID).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INSERT INTO installation_changes \(installation_id, enable\) VALUES \(\?, \?\)`).
+		WithArgs(installationID, enable).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+}
+
+// expectClaimChanges expects the changes due at now to be selected, returning
+// rows, and the changes with claimedIDs to be claimed.
+func expectClaimChanges(mock sqlmock.Sqlmock, now time.Time, rows *sqlmock.Rows, claimedIDs ...driver.Value) {
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id, installation_id, enable, attempts, `error` FROM installation_changes c WHERE applied_at IS NULL AND next_attempt_at <= \\? AND \\(claimed_until IS NULL OR claimed_until <= \\?\\) AND NOT EXISTS \\(.*\\) ORDER BY id LIMIT \\? FOR UPDATE").
+		WithArgs(now, now, now, maxChangesPerApply).
+		WillReturnRows(rows)
+	if len(claimedIDs) > 0 {
+		mock.ExpectExec(`UPDATE installation_changes SET claimed_until = \? WHERE id IN \(.*\)`).
+			WithArgs(append([]driver.Value{now.Add(changeClaimTimeout)}, claimedIDs...)...).
+			WillReturnResult(sqlmock.NewResult(0, int64(len(claimedIDs))))
+	}
+	mock.ExpectCommit()
+}
+
+type mockStateChanger struct {
+	enabled  []int
+	disabled []int
+	err      error
+}
+
+func (c *mockStateChanger) EnableInstallation(installationID int) error {
+	if c.err != nil {
+		return c.err
+	}
+	c.enabled = append(c.enabled, installationID)
+	return nil
+}
+
+func (c *mockStateChanger) DisableInstallation(installationID int) error {
+	if c.err != nil {
+		return c.err
+	}
+	c.disabled = append(c.disabled, installationID)
+	return nil
+}
+
+func TestChangeBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 10 * time.Second},
+		{2, 20 * time.Second},
+		{3, 40 * time.Second},
+		{9, 2560 * time.Second},
+		{10, time.Hour},
+		{100, time.Hour},
+	}
+	for _, test := range tests {
+		if have := changeBackoff(test.attempts); have != test.want {
+			t.Errorf("attempts %d: have %v want %v", test.attempts, have, test.want)
+		}
+	}
+}
+
+func TestDisableInstallation_rollback(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	user := &User{db: sqlx.NewDb(db, "sqlmock"), UserID: 1, Logger: logger}
+
+	// The installation must remain enabled for the user if the change could
+	// not be queued, else GopherCI would never be disabled.
+	mock.ExpectBegin()
+	mock.ExpectExec(`DELETE FROM gh_installations WHERE user_id = \? AND installation_id = \?`).
+		WithArgs(user.UserID, 10).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`DELETE FROM installation_changes WHERE installation_id = \? AND applied_at IS NULL AND claimed_until IS NULL`).
+		WithArgs(10).
+		WillReturnError(errors.New("some error"))
+	mock.ExpectRollback()
+
+	if err := user.DisableInstallation(10); err == nil {
+		t.Fatal("expected error")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestPendingInstallationChanges(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(`SELECT DISTINCT installation_id FROM installation_changes WHERE installation_id IN \(\?, \?\) AND applied_at IS NULL`).
+		WithArgs(10, 11).
+		WillReturnRows(sqlmock.NewRows([]string{"installation_id"}).AddRow(11))
+
+	um := NewUserManager(logger, sqlx.NewDb(db, "sqlmock"), nil, nil, "", "")
+	pending, err := um.PendingInstallationChanges(10, 11)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if want := map[int]bool{11: true}; !reflect.DeepEqual(pending, want) {
+		t.Errorf("have %v want %v", pending, want)
+	}
+}
+
+func TestApplyInstallationChanges(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	now := time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC)
+	expectClaimChanges(mock, now, sqlmock.NewRows([]string{"id", "installation_id", "enable", "attempts", "error"}).
+		AddRow(1, 10, true, 0, nil).
+		AddRow(2, 11, false, 2, "previous error"), 1, 2)
+	mock.ExpectExec("UPDATE installation_changes SET applied_at = \\?, claimed_until = NULL, `error` = NULL WHERE id = \\? AND claimed_until = \\?").
+		WithArgs(now, 1, now.Add(changeClaimTimeout)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE installation_changes SET applied_at = \\?, claimed_until = NULL, `error` = NULL WHERE id = \\? AND claimed_until = \\?").
+		WithArgs(now, 2, now.Add(changeClaimTimeout)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	um := NewUserManager(logger, sqlx.NewDb(db, "sqlmock"), nil, nil, "", "")
+	gci := &mockStateChanger{}
+	applied, err := um.ApplyInstallationChanges(gci, now)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if applied != 2 {
+		t.Errorf("have %d applied want 2", applied)
+	}
+	if want := []int{10}; !reflect.DeepEqual(gci.enabled, want) {
+		t.Errorf("enabled installations have %v want %v", gci.enabled, want)
+	}
+	if want := []int{11}; !reflect.DeepEqual(gci.disabled, want) {
+		t.Errorf("disabled installations have %v want %v", gci.disabled, want)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestApplyInstallationChanges_retry(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	now := time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC)
+	expectClaimChanges(mock, now, sqlmock.NewRows([]string{"id", "installation_id", "enable", "attempts", "error"}).
+		AddRow(1, 10, true, 2, "previous error"), 1)
+	mock.ExpectExec("UPDATE installation_changes SET attempts = \\?, next_attempt_at = \\?, claimed_until = NULL, `error` = \\? WHERE id = \\? AND claimed_until = \\?").
+		WithArgs(3, now.Add(40*time.Second), "some error", 1, now.Add(changeClaimTimeout)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	um := NewUserManager(logger, sqlx.NewDb(db, "sqlmock"), nil, nil, "", "")
+	applied, err := um.ApplyInstallationChanges(&mockStateChanger{err: errors.New("some error")}, now)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if applied != 0 {
+		t.Errorf("have %d applied want 0", applied)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestApplyInstallationChanges_lostClaim(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	// The claim expired while the change was applied and another process
+	// claimed it, so it's left for that process to record.
+	now := time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC)
+	expectClaimChanges(mock, now, sqlmock.NewRows([]string{"id", "installation_id", "enable", "attempts", "error"}).
+		AddRow(1, 10, true, 0, nil), 1)
+	mock.ExpectExec("UPDATE installation_changes SET applied_at = \\?, claimed_until = NULL, `error` = NULL WHERE id = \\? AND claimed_until = \\?").
+		WithArgs(now, 1, now.Add(changeClaimTimeout)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	um := NewUserManager(logger, sqlx.NewDb(db, "sqlmock"), nil, nil, "", "")
+	applied, err := um.ApplyInstallationChanges(&mockStateChanger{}, now)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if applied != 0 {
+		t.Errorf("have %d applied want 0", applied)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestApplyInstallationChanges_superseded(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	// An enable whose claim expired must not be applied after the newer
+	// disable of the same installation.
+	now := time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC)
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id, installation_id, enable, attempts, `error` FROM installation_changes c .* FOR UPDATE").
+		WithArgs(now, now, now, maxChangesPerApply).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "installation_id", "enable", "attempts", "error"}).
+			AddRow(1, 10, true, 0, nil).
+			AddRow(2, 10, false, 0, nil))
+	mock.ExpectExec(`DELETE FROM installation_changes WHERE id IN \(\?\)`).
+		WithArgs(1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`UPDATE installation_changes SET claimed_until = \? WHERE id IN \(\?\)`).
+		WithArgs(now.Add(changeClaimTimeout), 2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectExec("UPDATE installation_changes SET applied_at = \\?, claimed_until = NULL, `error` = NULL WHERE id = \\? AND claimed_until = \\?").
+		WithArgs(now, 2, now.Add(changeClaimTimeout)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	um := NewUserManager(logger, sqlx.NewDb(db, "sqlmock"), nil, nil, "", "")
+	gci := &mockStateChanger{}
+	applied, err := um.ApplyInstallationChanges(gci, now)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if applied != 1 {
+		t.Errorf("have %d applied want 1", applied)
+	}
+	if len(gci.enabled) != 0 {
+		t.Errorf("enabled installations have %v want none", gci.enabled)
+	}
+	if want := []int{10}; !reflect.DeepEqual(gci.disabled, want) {
+		t.Errorf("disabled installations have %v want %v", gci.disabled, want)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestQueueInstallationChange(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE gh_installations SET throttled_at = NULL WHERE installation_id = \?`).
+		WithArgs(10).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectQueueChange(mock, 10, false)
+	mock.ExpectCommit()
+
+	um := NewUserManager(logger, sqlx.NewDb(db, "sqlmock"), nil, nil, "", "")
+	if err := um.QueueInstallationChange(10, false); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+// mockCounter counts analyses per installationID.
+type mockCounter map[int]int
+
+func (c mockCounter) CountDailyAnalyses(day time.Time, installationIDs ...int) (map[int]int, error) {
+	return c, nil
+}
+
+func TestResumeInstallation(t *testing.T) {
+	provider := payments.NewFake(&stripe.Plan{
+		ID: "PersonalMonthlyUSD", Name: "Personal", Amount: 500, Currency: "usd",
+		Meta: map[string]string{payments.OrganisationsMeta: "unlimited", payments.BuildsPerDayMeta: "10"},
+	})
+	customer, err := provider.NewCustomer(nil, "tok_visa", "PersonalMonthlyUSD", "", true)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	now := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		desc        string
+		customerID  string
+		dunning     DunningState
+		builds      int
+		wantResumed bool
+		wantQuota   bool
+	}{
+		{"no subscription", "", "", 0, false, true},
+		{"disabled by dunning", customer.ID, DunningDisabled, 0, false, true},
+		{"build limit reached", customer.ID, "", 10, false, false},
+		{"resumed", customer.ID, DunningPastDue, 0, true, false},
+	}
+	for _, test := range tests {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		defer db.Close()
+
+		mock.ExpectQuery(`SELECT .* FROM users WHERE id IN \(SELECT user_id FROM gh_installations WHERE installation_id = \?\)`).
+			WithArgs(10).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "email", "github_id", "github_token", "stripe_customer_id", "stripe_currency", "trial_started_at", "trial_ends_at"}).
+				AddRow(1, "user@example.com", 2, nil, test.customerID, "usd", nil, nil))
+		mock.ExpectQuery(`SELECT .* FROM billing_accounts WHERE id IN \(SELECT billing_account_id FROM gh_installations WHERE installation_id = \?\)`).
+			WithArgs(10).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "github_id", "login", "email", "stripe_customer_id", "stripe_currency"}))
+		if test.customerID != "" {
+			expectDunning(mock, "dunning", "user_id", 1, test.dunning)
+		}
+		if !test.wantQuota {
+			mock.ExpectQuery(`SELECT installation_id FROM gh_installations WHERE user_id = \?`).
+				WithArgs(1).
+				WillReturnRows(sqlmock.NewRows([]string{"installation_id"}).AddRow(10))
+			mock.ExpectBegin()
+			if test.wantResumed {
+				expectQueueChange(mock, 10, true)
+			} else {
+				// Throttled, so it's enabled when the build limit resets.
+				mock.ExpectQuery(`SELECT installation_id FROM gh_installations WHERE installation_id IN \(\?\) AND throttled_at IS NULL FOR UPDATE`).
+					WithArgs(10).
+					WillReturnRows(sqlmock.NewRows([]string{"installation_id"}).AddRow(10))
+				mock.ExpectExec(`UPDATE gh_installations SET throttled_at = \? WHERE installation_id = \?`).
+					WithArgs(now, 10).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				expectQueueChange(mock, 10, false)
+			}
+			mock.ExpectCommit()
+		}
+
+		um := NewUserManager(logger, sqlx.NewDb(db, "sqlmock"), provider, loadCatalogue(t, provider), "", "")
+		resumed, err := um.ResumeInstallation(mockCounter{10: test.builds}, now, 10, 3)
+		if _, ok := err.(*QuotaError); ok != test.wantQuota {
+			t.Errorf("%s: have err %v, want *QuotaError: %v", test.desc, err, test.wantQuota)
+		}
+		if !test.wantQuota && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.desc, err)
+		}
+		if resumed != test.wantResumed {
+			t.Errorf("%s: have resumed %v want %v", test.desc, resumed, test.wantResumed)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("%s: unmet expectations: %v", test.desc, err)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package users
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bradleyfalzon/gopherci-web/internal/money"
+	"github.com/pkg/errors"
+	stripe "github.com/stripe/stripe-go"
+	"github.com/stripe/stripe-go/coupon"
+)
+
+// couponPlansMeta is the coupon metadata key containing a comma separated
+// list of plan IDs the coupon applies to. Coupons without this key apply to
+// all plans.
+const couponPlansMeta = "plans"
+
+// CouponError is returned when a coupon cannot be redeemed, the message is
+// suitable to show to the user.
+type CouponError struct {
+	CouponID string
+	Reason   string // Reason is why the coupon cannot be redeemed, such as "has expired".
+}
+
+// Error implements the error interface.
+func (e *CouponError) Error() string {
+	if e.CouponID == "" {
+		return "Coupon " + e.Reason
+	}
+	return fmt.Sprintf("Coupon %s %s", e.CouponID, e.Reason)
+}
+
+// CouponPreview is a preview of a plan's price after a coupon's discount.
+type CouponPreview struct {
+	CouponID    string
+	Description string // Description describes the discount, such as "50% off forever".
+	PlanID      string // PlanID is the stripe plan ID the coupon is applied to.
+	PlanName    string // PlanName is the name of the plan.
+	// AmountDisplay is the plan's price before the discount, formatted for
+	// display.
+	AmountDisplay string
+	// DiscountedDisplay is the plan's price after the discount, formatted for
+	// display.
+	DiscountedDisplay string
+	// DiscountedCents is the plan's price after the discount in cents.
+	DiscountedCents int64
+	Currency        string // Currency is the plan's lower case currency, such as usd.
+	Interval        string // Interval is the billing interval, such as month.
+}
+
+// PreviewStripeCoupon validates couponID can be redeemed on plan planID and
+// returns the plan's price after the coupon's discount. If the coupon cannot
+// be redeemed a *CouponError is returned.
+func (u *User) PreviewStripeCoupon(couponID, planID string) (*CouponPreview, error) {
+	if couponID == "" {
+		return nil, &CouponError{Reason: "is required"}
+	}
+	c, err := u.payments.Coupon(couponID)
+	if serr, ok := err.(*stripe.Error); ok && serr.HTTPStatusCode == http.StatusNotFound {
+		return nil, &CouponError{CouponID: couponID, Reason: "does not exist"}
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not get coupon %q", couponID)
+	}
+	plan, err := u.payments.Plan(planID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not get plan %q", planID)
+	}
+	if err := validateCoupon(c, plan, time.Now()); err != nil {
+		return nil, err
+	}
+
+	discounted := discountedAmount(c, int64(plan.Amount))
+	return &CouponPreview{
+		CouponID:          c.ID,
+		Description:       couponDescription(c),
+		PlanID:            plan.ID,
+		PlanName:          plan.Name,
+		AmountDisplay:     money.Format(string(plan.Currency), int64(plan.Amount)),
+		DiscountedDisplay: money.Format(string(plan.Currency), discounted),
+		DiscountedCents:   discounted,
+		Currency:          string(plan.Currency),
+		Interval:          string(plan.Interval),
+	}, nil
+}
+
+// validateCoupon returns a *CouponError if coupon c cannot be redeemed on plan
+// at time now.
+func validateCoupon(c *stripe.Coupon, plan *stripe.Plan, now time.Time) error {
+	switch {
+	case c.Deleted || !c.Valid:
+		return &CouponError{CouponID: c.ID, Reason: "is no longer valid"}
+	case c.RedeemBy > 0 && now.Unix() > c.RedeemBy:
+		return &CouponError{CouponID: c.ID, Reason: "expired on " + time.Unix(c.RedeemBy, 0).Format("2 January 2006")}
+	case c.MaxRedemptions > 0 && c.Redemptions >= c.MaxRedemptions:
+		return &CouponError{CouponID: c.ID, Reason: "has been fully redeemed"}
+	case c.Amount > 0 && c.Currency != plan.Currency:
+		return &CouponError{CouponID: c.ID, Reason: "is not available in " + strings.ToUpper(string(plan.Currency))}
+	}
+
+	if plans, ok := c.Meta[couponPlansMeta]; ok {
+		for _, planID := range strings.Split(plans, ",") {
+			if strings.TrimSpace(planID) == plan.ID {
+				return nil
+			}
+		}
+		return &CouponError{CouponID: c.ID, Reason: fmt.Sprintf("does not apply to the %s plan", plan.Name)}
+	}
+	return nil
+}
+
+// discountedAmount returns amount after coupon c's discount, it's never
+// negative.
+func discountedAmount(c *stripe.Coupon, amount int64) int64 {
+	switch {
+	case c.Percent > 0:
+		amount -= amount * int64(c.Percent) / 100
+	case c.Amount > 0:
+		amount -= int64(c.Amount)
+	}
+	if amount < 0 {
+		return 0
+	}
+	return amount
+}
+
+// couponDescription describes coupon c's discount, such as "50% off forever".
+func couponDescription(c *stripe.Coupon) string {
+	var description string
+	switch {
+	case c.Percent > 0:
+		description = fmt.Sprintf("%d%% off", c.Percent)
+	case c.Amount > 0:
+		description = money.Format(string(c.Currency), int64(c.Amount)) + " off"
+	}
+
+	switch c.Duration {
+	case coupon.Forever:
+		description += " forever"
+	case coupon.Once:
+		description += " the next invoice"
+	case coupon.Repeating:
+		description += fmt.Sprintf(" for %d months", c.DurationPeriod)
+	}
+	return description
+}
@@ -0,0 +1,132 @@
+package users
+
+import (
+	"testing"
+	"time"
+
+	sqlmock "github.com/bradleyfalzon/go-sqlmock"
+	"github.com/bradleyfalzon/gopherci-web/internal/payments"
+	"github.com/jmoiron/sqlx"
+	stripe "github.com/stripe/stripe-go"
+)
+
+func TestValidateCoupon(t *testing.T) {
+	now := time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC)
+	plan := &stripe.Plan{ID: "PersonalMonthlyUSD", Name: "Personal", Amount: 399, Currency: "usd"}
+	tests := []struct {
+		coupon stripe.Coupon
+		want   string // want is the error, blank if valid
+	}{
+		{stripe.Coupon{ID: "HALF", Percent: 50, Valid: true}, ""},
+		{stripe.Coupon{ID: "FIVE", Amount: 500, Currency: "usd", Valid: true}, ""},
+		{stripe.Coupon{ID: "INVALID", Percent: 50, Valid: false}, "Coupon INVALID is no longer valid"},
+		{stripe.Coupon{ID: "DELETED", Percent: 50, Valid: true, Deleted: true}, "Coupon DELETED is no longer valid"},
+		{stripe.Coupon{ID: "REDEEMBY", Percent: 50, Valid: true, RedeemBy: now.Add(time.Hour).Unix()}, ""},
+		{stripe.Coupon{ID: "EXPIRED", Percent: 50, Valid: true, RedeemBy: now.AddDate(0, 0, -1).Unix()}, "Coupon EXPIRED expired on 28 February 2017"},
+		{stripe.Coupon{ID: "LIMITED", Percent: 50, Valid: true, MaxRedemptions: 10, Redemptions: 9}, ""},
+		{stripe.Coupon{ID: "REDEEMED", Percent: 50, Valid: true, MaxRedemptions: 10, Redemptions: 10}, "Coupon REDEEMED has been fully redeemed"},
+		{stripe.Coupon{ID: "YEN", Amount: 500, Currency: "jpy", Valid: true}, "Coupon YEN is not available in USD"},
+		{stripe.Coupon{ID: "PERSONAL", Percent: 50, Valid: true, Meta: map[string]string{"plans": "ProfessionalMonthlyUSD, PersonalMonthlyUSD"}}, ""},
+		{stripe.Coupon{ID: "PRO", Percent: 50, Valid: true, Meta: map[string]string{"plans": "ProfessionalMonthlyUSD"}}, "Coupon PRO does not apply to the Personal plan"},
+	}
+	for _, test := range tests {
+		c := test.coupon
+		err := validateCoupon(&c, plan, now)
+		switch {
+		case test.want == "" && err != nil:
+			t.Errorf("coupon %v: unexpected error: %v", c.ID, err)
+		case test.want != "" && (err == nil || err.Error() != test.want):
+			t.Errorf("coupon %v: have error %v want %q", c.ID, err, test.want)
+		}
+		if _, ok := err.(*CouponError); err != nil && !ok {
+			t.Errorf("coupon %v: have error type %T want *CouponError", c.ID, err)
+		}
+	}
+}
+
+func TestDiscountedAmount(t *testing.T) {
+	tests := []struct {
+		coupon stripe.Coupon
+		amount int64
+		want   int64
+	}{
+		{stripe.Coupon{Percent: 50}, 799, 400},
+		{stripe.Coupon{Percent: 100}, 799, 0},
+		{stripe.Coupon{Amount: 500}, 799, 299},
+		{stripe.Coupon{Amount: 1000}, 799, 0},
+		{stripe.Coupon{}, 799, 799},
+	}
+	for _, test := range tests {
+		if have := discountedAmount(&test.coupon, test.amount); have != test.want {
+			t.Errorf("coupon %+v amount %v: have %v want %v", test.coupon, test.amount, have, test.want)
+		}
+	}
+}
+
+func TestPreviewStripeCoupon(t *testing.T) {
+	provider := payments.NewFake(&stripe.Plan{ID: "PersonalMonthlyUSD", Name: "Personal", Amount: 399, Currency: "usd", Interval: stripe.Month})
+	provider.Coupons["HALF"] = &stripe.Coupon{ID: "HALF", Percent: 50, Duration: "forever", Valid: true}
+	user := &User{payments: provider, UserID: 1, Logger: logger}
+
+	preview, err := user.PreviewStripeCoupon("HALF", "PersonalMonthlyUSD")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	want := &CouponPreview{
+		CouponID:          "HALF",
+		Description:       "50% off forever",
+		PlanID:            "PersonalMonthlyUSD",
+		PlanName:          "Personal",
+		AmountDisplay:     "$3.99 USD",
+		DiscountedDisplay: "$2.00 USD",
+		DiscountedCents:   200,
+		Currency:          "usd",
+		Interval:          "month",
+	}
+	if *preview != *want {
+		t.Errorf("have %+v want %+v", preview, want)
+	}
+
+	_, err = user.PreviewStripeCoupon("UNKNOWN", "PersonalMonthlyUSD")
+	if cerr, ok := err.(*CouponError); !ok || cerr.Reason != "does not exist" {
+		t.Errorf("have err %v want coupon does not exist", err)
+	}
+}
+
+func TestProcessStripePayment_coupon(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	provider := payments.NewFake(&stripe.Plan{ID: "PersonalMonthlyUSD", Amount: 500, Currency: "usd"})
+	provider.Coupons["HALF"] = &stripe.Coupon{ID: "HALF", Percent: 50, Duration: "forever", Valid: true}
+	provider.Coupons["REDEEMED"] = &stripe.Coupon{ID: "REDEEMED", Percent: 50, Valid: true, MaxRedemptions: 1, Redemptions: 1}
+	user := &User{db: sqlx.NewDb(db, "sqlmock"), payments: provider, UserID: 1, Logger: logger}
+
+	if err := user.ProcessStripePayment("tok_visa", "PersonalMonthlyUSD", "REDEEMED"); err == nil {
+		t.Fatal("expected error for fully redeemed coupon")
+	}
+	if len(provider.Customers) != 0 {
+		t.Errorf("have %d stripe customers want 0", len(provider.Customers))
+	}
+
+	mock.ExpectExec(`UPDATE users SET stripe_customer_id = \?, stripe_currency = \? WHERE ID = \?`).
+		WithArgs(sqlmock.AnyArg(), "usd", user.UserID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := user.ProcessStripePayment("tok_visa", "PersonalMonthlyUSD", "HALF"); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	customer, err := user.StripeCustomer()
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if customer.Discount == nil || customer.Discount.Coupon.ID != "HALF" {
+		t.Errorf("have discount %+v want coupon HALF", customer.Discount)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
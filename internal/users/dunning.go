@@ -0,0 +1,291 @@
+package users
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/bradleyfalzon/gopherci-web/internal/notify"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// paymentMethodURL is the console page where users update their card.
+const paymentMethodURL = "https://gopherci.io/console/billing/payment-method"
+
+// DunningState is the state of a user's or billing account's failed payment workflow.
+type DunningState string
+
+const (
+	// DunningPastDue is the state of a user with a failed payment, who is
+	// being sent reminders during the grace period.
+	DunningPastDue DunningState = "past_due"
+	// DunningDisabled is the state of a user whose grace period ended
+	// without payment, all their installations have been disabled.
+	DunningDisabled DunningState = "disabled"
+)
+
+// Dunning represents a user's or billing account's failed payment workflow,
+// from the dunning or account_dunning table.
+type Dunning struct {
+	State         DunningState `db:"state"`
+	PastDueAt     time.Time    `db:"past_due_at"`    // PastDueAt is when the payment first failed.
+	RemindersSent int          `db:"reminders_sent"` // RemindersSent is the number of reminders sent.
+	DisabledAt    *time.Time   `db:"disabled_at"`    // DisabledAt is when installations were disabled, if disabled.
+}
+
+// DunningPolicy configures the reminders and grace period after a payment
+// fails.
+type DunningPolicy struct {
+	// Reminders is how long after the payment failed each reminder is sent,
+	// in ascending order.
+	Reminders []time.Duration
+	// GracePeriod is how long after the payment failed the user's
+	// installations are disabled.
+	GracePeriod time.Duration
+}
+
+// DefaultDunningPolicy sends reminders immediately, after 3 and 7 days, then
+// disables installations after 14 days.
+var DefaultDunningPolicy = DunningPolicy{
+	Reminders:   []time.Duration{0, 3 * 24 * time.Hour, 7 * 24 * time.Hour},
+	GracePeriod: 14 * 24 * time.Hour,
+}
+
+// ParseDunningPolicy returns a DunningPolicy from reminderDays, a comma
+// separated list of days after the payment failed to send reminders, such as
+// "0,3,7", and graceDays, the number of days until installations are
+// disabled. DefaultDunningPolicy values are used for blank arguments.
+func ParseDunningPolicy(reminderDays, graceDays string) (DunningPolicy, error) {
+	policy := DefaultDunningPolicy
+	if reminderDays != "" {
+		policy.Reminders = nil
+		for _, day := range strings.Split(reminderDays, ",") {
+			days, err := strconv.Atoi(strings.TrimSpace(day))
+			if err != nil || days < 0 {
+				return DunningPolicy{}, fmt.Errorf("invalid reminder days %q", day)
+			}
+			reminder := time.Duration(days) * 24 * time.Hour
+			if n := len(policy.Reminders); n > 0 && reminder < policy.Reminders[n-1] {
+				return DunningPolicy{}, fmt.Errorf("reminder days %q are not in ascending order", reminderDays)
+			}
+			policy.Reminders = append(policy.Reminders, reminder)
+		}
+	}
+	if graceDays != "" {
+		days, err := strconv.Atoi(graceDays)
+		if err != nil || days < 0 {
+			return DunningPolicy{}, fmt.Errorf("invalid grace period days %q", graceDays)
+		}
+		policy.GracePeriod = time.Duration(days) * 24 * time.Hour
+	}
+	return policy, nil
+}
+
+// DunningAction is the next action to take in a user's failed payment
+// workflow.
+type DunningAction int
+
+const (
+	// DunningWait means no action is required yet.
+	DunningWait DunningAction = iota
+	// DunningRemind means a reminder should be sent.
+	DunningRemind
+	// DunningDisable means the grace period has ended and installations
+	// should be disabled.
+	DunningDisable
+)
+
+// Next returns the next action for dunning at now. Only a single reminder is
+// sent each time, even if multiple reminders are due.
+func (p DunningPolicy) Next(dunning *Dunning, now time.Time) DunningAction {
+	if dunning == nil || dunning.State != DunningPastDue {
+		return DunningWait
+	}
+	elapsed := now.Sub(dunning.PastDueAt)
+	switch {
+	case elapsed >= p.GracePeriod:
+		return DunningDisable
+	case dunning.RemindersSent < len(p.Reminders) && elapsed >= p.Reminders[dunning.RemindersSent]:
+		return DunningRemind
+	}
+	return DunningWait
+}
+
+// dunningRecord is the failed payment workflow of a single user or billing
+// account, stored in table where column is id.
+type dunningRecord struct {
+	db     *sqlx.DB
+	logger *logrus.Entry
+	table  string
+	column string
+	id     int
+}
+
+// get returns the failed payment workflow, or nil if there are no failed
+// payments.
+func (d dunningRecord) get() (*Dunning, error) {
+	dunning := &Dunning{}
+	err := d.db.Get(dunning, "SELECT state, past_due_at, reminders_sent, disabled_at FROM "+d.table+" WHERE "+d.column+" = ?", d.id)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, nil
+	case err != nil:
+		return nil, errors.Wrapf(err, "could not select from %v", d.table)
+	}
+	return dunning, nil
+}
+
+// disabled returns true if the failed payment workflow disabled all
+// installations, and the payment has not since succeeded.
+func (d dunningRecord) disabled() (bool, error) {
+	dunning, err := d.get()
+	if err != nil {
+		return false, err
+	}
+	return dunning != nil && dunning.State == DunningDisabled, nil
+}
+
+// start starts the failed payment workflow, if it's not already started.
+func (d dunningRecord) start(now time.Time) error {
+	res, err := d.db.Exec("INSERT IGNORE INTO "+d.table+" ("+d.column+", state, past_due_at) VALUES (?, ?, ?)", d.id, DunningPastDue, now)
+	if err != nil {
+		return errors.Wrapf(err, "could not insert into %v", d.table)
+	}
+	if inserted, err := res.RowsAffected(); err == nil && inserted > 0 {
+		d.logger.Warn("payment failed, started dunning")
+	}
+	return nil
+}
+
+// end ends the failed payment workflow.
+func (d dunningRecord) end() error {
+	res, err := d.db.Exec("DELETE FROM "+d.table+" WHERE "+d.column+" = ?", d.id)
+	if err != nil {
+		return errors.Wrapf(err, "could not delete from %v", d.table)
+	}
+	if deleted, err := res.RowsAffected(); err == nil && deleted > 0 {
+		d.logger.Info("payment succeeded, ended dunning")
+	}
+	return nil
+}
+
+// process takes the next action in the failed payment workflow according to
+// policy, notifying email and calling disableAll once the grace period ends.
+// url is the page where the payment method is updated. Notifications are not
+// sent if email is blank.
+func (d dunningRecord) process(policy DunningPolicy, now time.Time, notifier notify.Notifier, email, url string, disableAll func() error) error {
+	dunning, err := d.get()
+	if err != nil {
+		return err
+	}
+
+	switch policy.Next(dunning, now) {
+	case DunningRemind:
+		disableAt := dunning.PastDueAt.Add(policy.GracePeriod)
+		body := fmt.Sprintf("Hi,\n\n"+
+			"We were unable to charge your card for your GopherCI subscription.\n\n"+
+			"Please update your payment method before %s to avoid your installations being disabled:\n\n%s\n",
+			disableAt.Format("2 January 2006"), url,
+		)
+		if err := d.notify(notifier, email, "GopherCI payment failed", body); err != nil {
+			return errors.Wrap(err, "could not send dunning reminder")
+		}
+		_, err := d.db.Exec("UPDATE "+d.table+" SET reminders_sent = reminders_sent + 1 WHERE "+d.column+" = ?", d.id)
+		if err != nil {
+			return errors.Wrap(err, "could not update dunning reminders sent")
+		}
+		d.logger.Infof("sent dunning reminder %d", dunning.RemindersSent+1)
+	case DunningDisable:
+		if err := disableAll(); err != nil {
+			return err
+		}
+		_, err := d.db.Exec("UPDATE "+d.table+" SET state = ?, disabled_at = ? WHERE "+d.column+" = ?", DunningDisabled, now, d.id)
+		if err != nil {
+			return errors.Wrap(err, "could not update dunning state")
+		}
+		d.logger.Warn("dunning grace period ended, disabled all installations")
+
+		body := fmt.Sprintf("Hi,\n\n"+
+			"We were unable to charge your card for your GopherCI subscription, so your installations have been disabled.\n\n"+
+			"Update your payment method and enable your installations again at:\n\n%s\n",
+			url,
+		)
+		if err := d.notify(notifier, email, "GopherCI installations disabled", body); err != nil {
+			return errors.Wrap(err, "could not send dunning disabled notification")
+		}
+	}
+	return nil
+}
+
+// notify sends the notification to email, unless email is blank.
+func (d dunningRecord) notify(notifier notify.Notifier, email, subject, body string) error {
+	if email == "" {
+		d.logger.Warnf("no email address, not sending %q", subject)
+		return nil
+	}
+	return notifier.Notify(email, subject, body)
+}
+
+// dunning returns the user's failed payment workflow record.
+func (u *User) dunning() dunningRecord {
+	return dunningRecord{db: u.db, logger: u.Logger, table: "dunning", column: "user_id", id: u.UserID}
+}
+
+// Dunning returns the user's failed payment workflow, or nil if the user has
+// no failed payments.
+func (u *User) Dunning() (*Dunning, error) {
+	return u.dunning().get()
+}
+
+// StartDunning starts the failed payment workflow for the user, if it's not
+// already started.
+func (u *User) StartDunning(now time.Time) error {
+	return u.dunning().start(now)
+}
+
+// EndDunning ends the failed payment workflow for the user, such as after a
+// successful payment. Installations disabled by the workflow are not enabled.
+func (u *User) EndDunning() error {
+	return u.dunning().end()
+}
+
+// ProcessDunning takes the next action in the user's failed payment
+// workflow according to policy, sending reminders using notifier and
+// disabling installations once the grace period ends.
+func (u *User) ProcessDunning(policy DunningPolicy, now time.Time, notifier notify.Notifier) error {
+	return u.dunning().process(policy, now, notifier, u.Email, paymentMethodURL, u.DisableAllInstallations)
+}
+
+// dunning returns the account's failed payment workflow record.
+func (a *Account) dunning() dunningRecord {
+	return dunningRecord{db: a.db, logger: a.Logger, table: "account_dunning", column: "billing_account_id", id: a.AccountID}
+}
+
+// Dunning returns the account's failed payment workflow, or nil if the
+// account has no failed payments.
+func (a *Account) Dunning() (*Dunning, error) {
+	return a.dunning().get()
+}
+
+// StartDunning starts the failed payment workflow for the account, if it's
+// not already started.
+func (a *Account) StartDunning(now time.Time) error {
+	return a.dunning().start(now)
+}
+
+// EndDunning ends the failed payment workflow for the account. Installations
+// disabled by the workflow are not enabled.
+func (a *Account) EndDunning() error {
+	return a.dunning().end()
+}
+
+// ProcessDunning takes the next action in the account's failed payment
+// workflow according to policy, sending reminders to the account's billing
+// email and disabling the account's installations once the grace period ends.
+func (a *Account) ProcessDunning(policy DunningPolicy, now time.Time, notifier notify.Notifier) error {
+	return a.dunning().process(policy, now, notifier, a.Email, a.BillingURL(), a.DisableAllInstallations)
+}
@@ -0,0 +1,272 @@
+package users
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	sqlmock "github.com/bradleyfalzon/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+)
+
+type notification struct {
+	to, subject, body string
+}
+
+type mockNotifier struct {
+	sent []notification
+}
+
+func (n *mockNotifier) Notify(to, subject, body string) error {
+	n.sent = append(n.sent, notification{to, subject, body})
+	return nil
+}
+
+// expectDunning expects the dunning of id to be selected from table, a blank
+// state returns no dunning.
+func expectDunning(mock sqlmock.Sqlmock, table, column string, id int, state DunningState) {
+	rows := sqlmock.NewRows([]string{"state", "past_due_at", "reminders_sent", "disabled_at"})
+	if state != "" {
+		rows.AddRow(string(state), time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC), 3, nil)
+	}
+	mock.ExpectQuery(`SELECT state, past_due_at, reminders_sent, disabled_at FROM ` + table + ` WHERE ` + column + ` = \?`).
+		WithArgs(id).
+		WillReturnRows(rows)
+}
+
+func TestParseDunningPolicy(t *testing.T) {
+	policy, err := ParseDunningPolicy("1, 5", "10")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	want := DunningPolicy{
+		Reminders:   []time.Duration{24 * time.Hour, 5 * 24 * time.Hour},
+		GracePeriod: 10 * 24 * time.Hour,
+	}
+	if !reflect.DeepEqual(policy, want) {
+		t.Errorf("have %+v want %+v", policy, want)
+	}
+
+	policy, err = ParseDunningPolicy("", "")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if !reflect.DeepEqual(policy, DefaultDunningPolicy) {
+		t.Errorf("have %+v want default %+v", policy, DefaultDunningPolicy)
+	}
+
+	for _, days := range []string{"a", "-1", "5,1"} {
+		if _, err := ParseDunningPolicy(days, ""); err == nil {
+			t.Errorf("reminder days %q: expected error", days)
+		}
+	}
+}
+
+func TestDunningPolicy_Next(t *testing.T) {
+	var (
+		day     = 24 * time.Hour
+		pastDue = time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC)
+		policy  = DunningPolicy{Reminders: []time.Duration{0, 3 * day}, GracePeriod: 7 * day}
+	)
+	tests := []struct {
+		desc    string
+		dunning *Dunning
+		elapsed time.Duration
+		want    DunningAction
+	}{
+		{"no dunning", nil, 0, DunningWait},
+		{"first reminder", &Dunning{State: DunningPastDue}, 0, DunningRemind},
+		{"waiting for second reminder", &Dunning{State: DunningPastDue, RemindersSent: 1}, 2 * day, DunningWait},
+		{"second reminder", &Dunning{State: DunningPastDue, RemindersSent: 1}, 3 * day, DunningRemind},
+		{"all reminders sent", &Dunning{State: DunningPastDue, RemindersSent: 2}, 6 * day, DunningWait},
+		{"grace period ended", &Dunning{State: DunningPastDue, RemindersSent: 1}, 7 * day, DunningDisable},
+		{"already disabled", &Dunning{State: DunningDisabled, RemindersSent: 2}, 8 * day, DunningWait},
+	}
+	for _, test := range tests {
+		if test.dunning != nil {
+			test.dunning.PastDueAt = pastDue
+		}
+		if have := policy.Next(test.dunning, pastDue.Add(test.elapsed)); have != test.want {
+			t.Errorf("%s: have %v want %v", test.desc, have, test.want)
+		}
+	}
+}
+
+func TestProcessDunning_remind(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	user := &User{db: sqlx.NewDb(db, "sqlmock"), UserID: 1, Email: "user@example.com", Logger: logger}
+	pastDue := time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	mock.ExpectQuery(`SELECT state, past_due_at, reminders_sent, disabled_at FROM dunning WHERE user_id = \?`).
+		WithArgs(user.UserID).
+		WillReturnRows(sqlmock.NewRows([]string{"state", "past_due_at", "reminders_sent", "disabled_at"}).AddRow("past_due", pastDue, 0, nil))
+	mock.ExpectExec(`UPDATE dunning SET reminders_sent = reminders_sent \+ 1 WHERE user_id = \?`).
+		WithArgs(user.UserID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	notifier := &mockNotifier{}
+	policy := DunningPolicy{Reminders: []time.Duration{0}, GracePeriod: 14 * 24 * time.Hour}
+	if err := user.ProcessDunning(policy, pastDue.Add(time.Hour), notifier); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if len(notifier.sent) != 1 {
+		t.Fatalf("have %d notifications want 1", len(notifier.sent))
+	}
+	if sent := notifier.sent[0]; sent.to != user.Email || !strings.Contains(sent.body, "15 March 2017") {
+		t.Errorf("unexpected notification: %+v", sent)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestProcessDunning_disable(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	user := &User{db: sqlx.NewDb(db, "sqlmock"), UserID: 1, Email: "user@example.com", Logger: logger}
+	pastDue := time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC)
+	now := pastDue.Add(15 * 24 * time.Hour)
+
+	mock.ExpectQuery(`SELECT state, past_due_at, reminders_sent, disabled_at FROM dunning WHERE user_id = \?`).
+		WithArgs(user.UserID).
+		WillReturnRows(sqlmock.NewRows([]string{"state", "past_due_at", "reminders_sent", "disabled_at"}).AddRow("past_due", pastDue, 3, nil))
+	mock.ExpectQuery("SELECT installation_id FROM gh_installations WHERE user_id = ?").
+		WithArgs(user.UserID).
+		WillReturnRows(sqlmock.NewRows([]string{"installation_id"}).AddRow(10))
+	mock.ExpectBegin()
+	mock.ExpectExec(`DELETE FROM gh_installations WHERE user_id = \? AND installation_id = \?`).
+		WithArgs(user.UserID, 10).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectQueueChange(mock, 10, false)
+	mock.ExpectCommit()
+	mock.ExpectExec(`UPDATE dunning SET state = \?, disabled_at = \? WHERE user_id = \?`).
+		WithArgs(DunningDisabled, now, user.UserID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	notifier := &mockNotifier{}
+	if err := user.ProcessDunning(DefaultDunningPolicy, now, notifier); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if len(notifier.sent) != 1 {
+		t.Errorf("have %d notifications want 1", len(notifier.sent))
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestAccountProcessDunning_remind(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	account := &Account{db: sqlx.NewDb(db, "sqlmock"), AccountID: 3, Login: "org", Email: "admin@example.com", Logger: logger}
+	pastDue := time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	mock.ExpectQuery(`SELECT state, past_due_at, reminders_sent, disabled_at FROM account_dunning WHERE billing_account_id = \?`).
+		WithArgs(account.AccountID).
+		WillReturnRows(sqlmock.NewRows([]string{"state", "past_due_at", "reminders_sent", "disabled_at"}).AddRow("past_due", pastDue, 0, nil))
+	mock.ExpectExec(`UPDATE account_dunning SET reminders_sent = reminders_sent \+ 1 WHERE billing_account_id = \?`).
+		WithArgs(account.AccountID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	notifier := &mockNotifier{}
+	policy := DunningPolicy{Reminders: []time.Duration{0}, GracePeriod: 14 * 24 * time.Hour}
+	if err := account.ProcessDunning(policy, pastDue.Add(time.Hour), notifier); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if len(notifier.sent) != 1 {
+		t.Fatalf("have %d notifications want 1", len(notifier.sent))
+	}
+	if sent := notifier.sent[0]; sent.to != account.Email || !strings.Contains(sent.body, "/console/org/org/billing") {
+		t.Errorf("unexpected notification: %+v", sent)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestAccountProcessDunning_disable(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	// Accounts subscribed before billing emails were recorded are still
+	// disabled, without a notification.
+	account := &Account{db: sqlx.NewDb(db, "sqlmock"), AccountID: 3, Login: "org", Logger: logger}
+	pastDue := time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC)
+	now := pastDue.Add(15 * 24 * time.Hour)
+
+	mock.ExpectQuery(`SELECT state, past_due_at, reminders_sent, disabled_at FROM account_dunning WHERE billing_account_id = \?`).
+		WithArgs(account.AccountID).
+		WillReturnRows(sqlmock.NewRows([]string{"state", "past_due_at", "reminders_sent", "disabled_at"}).AddRow("past_due", pastDue, 3, nil))
+	mock.ExpectQuery(`SELECT installation_id FROM gh_installations WHERE billing_account_id = \?`).
+		WithArgs(account.AccountID).
+		WillReturnRows(sqlmock.NewRows([]string{"installation_id"}).AddRow(10))
+	mock.ExpectBegin()
+	mock.ExpectExec(`DELETE FROM gh_installations WHERE billing_account_id = \? AND installation_id = \?`).
+		WithArgs(account.AccountID, 10).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectQueueChange(mock, 10, false)
+	mock.ExpectCommit()
+	mock.ExpectExec(`UPDATE account_dunning SET state = \?, disabled_at = \? WHERE billing_account_id = \?`).
+		WithArgs(DunningDisabled, now, account.AccountID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	notifier := &mockNotifier{}
+	if err := account.ProcessDunning(DefaultDunningPolicy, now, notifier); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if len(notifier.sent) != 0 {
+		t.Errorf("have %d notifications want 0", len(notifier.sent))
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestAccountsPastDue(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(`SELECT billing_account_id FROM account_dunning WHERE state = \? ORDER BY billing_account_id`).
+		WithArgs(DunningPastDue).
+		WillReturnRows(sqlmock.NewRows([]string{"billing_account_id"}).AddRow(3))
+	mock.ExpectQuery(`SELECT id, github_id, login, email, stripe_customer_id, stripe_currency FROM billing_accounts WHERE id = \?`).
+		WithArgs(3).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "github_id", "login", "email", "stripe_customer_id", "stripe_currency"}).
+			AddRow(3, 4, "org", "admin@example.com", "cus_1", "usd"))
+
+	um := NewUserManager(logger, sqlx.NewDb(db, "sqlmock"), nil, nil, "", "")
+	accounts, err := um.AccountsPastDue()
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if len(accounts) != 1 || accounts[0].AccountID != 3 || accounts[0].Email != "admin@example.com" {
+		t.Errorf("unexpected past due accounts: %+v", accounts)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
@@ -15,6 +15,7 @@ import (
 
 	"github.com/Sirupsen/logrus"
 	sqlmock "github.com/bradleyfalzon/go-sqlmock"
+	"github.com/bradleyfalzon/gopherci-web/internal/payments"
 	"github.com/bradleyfalzon/gopherci-web/internal/session"
 	"github.com/google/uuid"
 	"github.com/jmoiron/sqlx"
@@ -28,7 +29,7 @@ func TestOAuthLoginHandler(t *testing.T) {
 	r = r.WithContext(context.WithValue(context.Background(), session.CtxKey{}, s))
 	w := httptest.NewRecorder()
 
-	um := NewUserManager(logger, nil, "id", "secret", "stripeKey")
+	um := NewUserManager(logger, nil, payments.NewFake(), nil, "id", "secret")
 	um.oauthConf.Endpoint.AuthURL = "http://example.com"
 	um.oauthConf.Endpoint.TokenURL = ""
 	um.OAuthLoginHandler(w, r)
@@ -89,7 +90,7 @@ func TestOAuthCallbackHandler(t *testing.T) {
 	wantUserID := 12
 	//um := &mockUserManager{UserID: wantUserID}
 
-	um := NewUserManager(logger, nil, "id", "secret", "stripeKey")
+	um := NewUserManager(logger, nil, payments.NewFake(), nil, "id", "secret")
 	um.overwriteBaseURL = ts.URL
 	um.oauthConf.Endpoint.AuthURL = ""
 	um.oauthConf.Endpoint.TokenURL = ts.URL
@@ -130,7 +131,7 @@ func TestGitHubLogin_new(t *testing.T) {
 	defer ts.Close()
 	githubBaseURL = ts.URL
 
-	um := NewUserManager(logger, sqlx.NewDb(db, "sqlmock"), "", "", "stripeKey")
+	um := NewUserManager(logger, sqlx.NewDb(db, "sqlmock"), payments.NewFake(), nil, "", "")
 
 	mock.ExpectQuery("SELECT id FROM users WHERE github_id = ?").
 		WithArgs(githubID).
@@ -170,7 +171,7 @@ func TestGitHubLogin_update(t *testing.T) {
 	defer ts.Close()
 	githubBaseURL = ts.URL
 
-	um := NewUserManager(logger, sqlx.NewDb(db, "sqlmock"), "", "", "stripeKey")
+	um := NewUserManager(logger, sqlx.NewDb(db, "sqlmock"), payments.NewFake(), nil, "", "")
 
 	mock.ExpectQuery("SELECT id FROM users WHERE github_id = ?").
 		WithArgs(githubID).
@@ -197,7 +198,7 @@ func TestGitHubLogin_errSelect(t *testing.T) {
 	}
 	defer db.Close()
 
-	um := NewUserManager(logger, sqlx.NewDb(db, "sqlmock"), "", "", "stripeKey")
+	um := NewUserManager(logger, sqlx.NewDb(db, "sqlmock"), payments.NewFake(), nil, "", "")
 
 	mock.ExpectQuery("SELECT .*").WillReturnError(errors.New("some error"))
 
@@ -214,7 +215,7 @@ func TestGitHubLogin_errInsert(t *testing.T) {
 	}
 	defer db.Close()
 
-	um := NewUserManager(logger, sqlx.NewDb(db, "sqlmock"), "", "", "stripeKey")
+	um := NewUserManager(logger, sqlx.NewDb(db, "sqlmock"), payments.NewFake(), nil, "", "")
 
 	mock.ExpectQuery("SELECT .*").WillReturnError(sql.ErrNoRows)
 	mock.ExpectExec("INSERT INTO users .*").WillReturnError(errors.New("some error"))
@@ -232,7 +233,7 @@ func TestGitHubLogin_errUpdate(t *testing.T) {
 	}
 	defer db.Close()
 
-	um := NewUserManager(logger, sqlx.NewDb(db, "sqlmock"), "", "", "stripeKey")
+	um := NewUserManager(logger, sqlx.NewDb(db, "sqlmock"), payments.NewFake(), nil, "", "")
 
 	mock.ExpectQuery("SELECT .*").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
 	mock.ExpectExec("UPDATE users .*").WillReturnError(errors.New("some error"))
@@ -272,7 +273,7 @@ func TestGetGitHubEmail(t *testing.T) {
 		defer ts.Close()
 		githubBaseURL = ts.URL
 
-		um := NewUserManager(logger, nil, "", "", "stripeKey")
+		um := NewUserManager(logger, nil, payments.NewFake(), nil, "", "")
 		have, err := um.getGitHubEmail(context.Background(), &oauth2.Token{AccessToken: "a"})
 		if err != nil {
 			t.Fatal("unexpected error:", err)
@@ -0,0 +1,82 @@
+package users
+
+import (
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// ThrottleInstallations records installationIDs as throttled at now, as their
+// owner reached their plan's daily build limit, and queues them to be disabled
+// in GopherCI. Returns the installationIDs which were not already throttled.
+func (um *UserManager) ThrottleInstallations(now time.Time, installationIDs ...int) ([]int, error) {
+	var throttled []int
+	if len(installationIDs) == 0 {
+		return throttled, nil
+	}
+	err := inTx(um.db, func(tx *sqlx.Tx) error {
+		query, args, err := sqlx.In(`SELECT installation_id FROM gh_installations WHERE installation_id IN (?) AND throttled_at IS NULL FOR UPDATE`, installationIDs)
+		if err != nil {
+			return err
+		}
+		if err := tx.Select(&throttled, query, args...); err != nil {
+			return errors.Wrap(err, "could not select installations to throttle")
+		}
+		for _, installationID := range throttled {
+			_, err := tx.Exec(`UPDATE gh_installations SET throttled_at = ? WHERE installation_id = ?`, now, installationID)
+			if err != nil {
+				return errors.Wrapf(err, "could not throttle installationID %v", installationID)
+			}
+			if err := queueInstallationChange(tx, installationID, false); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return throttled, nil
+}
+
+// UnthrottleInstallations queues the installationIDs throttled by
+// ThrottleInstallations to be enabled in GopherCI, once their owner's daily
+// build limit has reset. Installations disabled for any other reason, such as
+// a failed payment or being suspended, remain disabled. Returns the
+// installationIDs which were throttled.
+func (um *UserManager) UnthrottleInstallations(installationIDs ...int) ([]int, error) {
+	var unthrottled []int
+	if len(installationIDs) == 0 {
+		return unthrottled, nil
+	}
+	err := inTx(um.db, func(tx *sqlx.Tx) error {
+		query, args, err := sqlx.In(`SELECT installation_id FROM gh_installations WHERE installation_id IN (?) AND throttled_at IS NOT NULL FOR UPDATE`, installationIDs)
+		if err != nil {
+			return err
+		}
+		if err := tx.Select(&unthrottled, query, args...); err != nil {
+			return errors.Wrap(err, "could not select throttled installations")
+		}
+		for _, installationID := range unthrottled {
+			if err := unthrottleInstallation(tx, installationID); err != nil {
+				return err
+			}
+			if err := queueInstallationChange(tx, installationID, true); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return unthrottled, nil
+}
+
+// unthrottleInstallation removes the throttle of installationID, if any, so
+// it's not enabled by UnthrottleInstallations.
+func unthrottleInstallation(tx *sqlx.Tx, installationID int) error {
+	_, err := tx.Exec(`UPDATE gh_installations SET throttled_at = NULL WHERE installation_id = ?`, installationID)
+	return errors.Wrapf(err, "could not remove throttle of installationID %v", installationID)
+}
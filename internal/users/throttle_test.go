@@ -0,0 +1,73 @@
+package users
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	sqlmock "github.com/bradleyfalzon/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+)
+
+func TestThrottleInstallations(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	now := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT installation_id FROM gh_installations WHERE installation_id IN \(\?, \?\) AND throttled_at IS NULL FOR UPDATE`).
+		WithArgs(10, 11).
+		WillReturnRows(sqlmock.NewRows([]string{"installation_id"}).AddRow(11))
+	mock.ExpectExec(`UPDATE gh_installations SET throttled_at = \? WHERE installation_id = \?`).
+		WithArgs(now, 11).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectQueueChange(mock, 11, false)
+	mock.ExpectCommit()
+
+	um := NewUserManager(logger, sqlx.NewDb(db, "sqlmock"), nil, nil, "", "")
+	throttled, err := um.ThrottleInstallations(now, 10, 11)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if want := []int{11}; !reflect.DeepEqual(throttled, want) {
+		t.Errorf("have %v want %v", throttled, want)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestUnthrottleInstallations(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	// Installation 10 was throttled, installation 11 was disabled for another
+	// reason, such as being suspended, so must remain disabled.
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT installation_id FROM gh_installations WHERE installation_id IN \(\?, \?\) AND throttled_at IS NOT NULL FOR UPDATE`).
+		WithArgs(10, 11).
+		WillReturnRows(sqlmock.NewRows([]string{"installation_id"}).AddRow(10))
+	mock.ExpectExec(`UPDATE gh_installations SET throttled_at = NULL WHERE installation_id = \?`).
+		WithArgs(10).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectQueueChange(mock, 10, true)
+	mock.ExpectCommit()
+
+	um := NewUserManager(logger, sqlx.NewDb(db, "sqlmock"), nil, nil, "", "")
+	unthrottled, err := um.UnthrottleInstallations(10, 11)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if want := []int{10}; !reflect.DeepEqual(unthrottled, want) {
+		t.Errorf("have %v want %v", unthrottled, want)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
@@ -0,0 +1,101 @@
+package users
+
+import (
+	"context"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// TransferError is returned when an installation cannot be transferred, the
+// message is suitable to show to the user.
+type TransferError struct {
+	Reason string // Reason is why the installation cannot be transferred.
+}
+
+// Error implements the error interface.
+func (e *TransferError) Error() string {
+	return "Cannot transfer installation, " + e.Reason
+}
+
+// Transfer is an audit entry of an installation being transferred from one
+// user to another, or taken over by an organisation's billing account.
+type Transfer struct {
+	InstallationID int       `db:"installation_id"`
+	FromUserID     int       `db:"from_user_id"`
+	FromEmail      string    `db:"from_email"`
+	ToUserID       int       `db:"to_user_id"` // ToUserID is 0 if transferred to a billing account.
+	ToEmail        string    `db:"to_email"`
+	ToAccountLogin string    `db:"to_account_login"` // ToAccountLogin is the organisation of the billing account, if any.
+	ByUserID       int       `db:"by_user_id"`       // ByUserID is the user who made the transfer.
+	ByEmail        string    `db:"by_email"`
+	CreatedAt      time.Time `db:"created_at"`
+}
+
+// TransferInstallation transfers installationID, owned by the GitHub
+// organisation org with accountID and enabled by this user, to user to, with
+// GitHub login toLogin, on behalf of the user by, who is either this user or an
+// admin of the organisation. The recipient must be a member or admin of the
+// organisation. An audit entry is recorded for both users. Returns
+// *TransferError if the installation cannot be transferred, or *QuotaError if
+// to has no active subscription or their plan does not permit another
+// organisation.
+func (u *User) TransferInstallation(ctx context.Context, installationID, accountID int, org string, to *User, toLogin string, by *User) error {
+	switch {
+	case accountID == u.GitHubID:
+		return &TransferError{Reason: "personal installations cannot be transferred"}
+	case to.UserID == u.UserID:
+		return &TransferError{Reason: "the installation is already enabled by this user"}
+	}
+
+	// Checked with by's client, as by is a member of the organisation.
+	member, err := by.GitHubOrgMember(ctx, org, toLogin, "admin", "member")
+	if err != nil {
+		return errors.Wrap(err, "could not check recipient's organisation membership")
+	}
+	if member == nil || member.ID == nil || *member.ID != accountID {
+		return &TransferError{Reason: toLogin + " is not a member of the organisation"}
+	}
+
+	if err := to.checkQuota(installationID, accountID); err != nil {
+		return err
+	}
+
+	err = inTx(u.db, func(tx *sqlx.Tx) error {
+		res, err := tx.Exec(`UPDATE gh_installations SET user_id = ? WHERE user_id = ? AND installation_id = ?`, to.UserID, u.UserID, installationID)
+		if err != nil {
+			return errors.Wrapf(err, "could not transfer installationID %v", installationID)
+		}
+		if updated, err := res.RowsAffected(); err == nil && updated == 0 {
+			return &TransferError{Reason: "the installation is not enabled by this user"}
+		}
+
+		_, err = tx.Exec(`INSERT INTO installation_transfers (installation_id, from_user_id, to_user_id, by_user_id) VALUES (?, ?, ?, ?)`, installationID, u.UserID, to.UserID, by.UserID)
+		return errors.Wrapf(err, "could not record transfer of installationID %v", installationID)
+	})
+	if err != nil {
+		return err
+	}
+	u.Logger.WithField("installationID", installationID).Infof("transferred installation to userID %v by userID %v", to.UserID, by.UserID)
+	return nil
+}
+
+// Transfers returns the transfers of installations to and from this user,
+// including installations taken over by billing accounts, newest first.
+func (u *User) Transfers() ([]Transfer, error) {
+	var transfers []Transfer
+	err := u.db.Select(&transfers, `
+SELECT t.installation_id, t.from_user_id, f.email AS from_email, COALESCE(t.to_user_id, 0) AS to_user_id, COALESCE(r.email, "") AS to_email, COALESCE(a.login, "") AS to_account_login, t.by_user_id, b.email AS by_email, t.created_at
+  FROM installation_transfers t
+  JOIN users f ON f.id = t.from_user_id
+  LEFT JOIN users r ON r.id = t.to_user_id
+  LEFT JOIN billing_accounts a ON a.id = t.to_billing_account_id
+  JOIN users b ON b.id = t.by_user_id
+ WHERE t.from_user_id = ? OR t.to_user_id = ?
+ ORDER BY t.created_at DESC, t.id DESC`, u.UserID, u.UserID)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not select installation transfers")
+	}
+	return transfers, nil
+}
@@ -0,0 +1,162 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/oauth2"
+
+	sqlmock "github.com/bradleyfalzon/go-sqlmock"
+	"github.com/bradleyfalzon/gopherci-web/internal/payments"
+	"github.com/jmoiron/sqlx"
+	stripe "github.com/stripe/stripe-go"
+)
+
+// newMembershipServer returns a GitHub API server where the user member is an
+// active member of the organisation org with ID 30, and pending has not
+// accepted its invitation. The caller must close the server.
+func newMembershipServer() *httptest.Server {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/orgs/org/memberships/member":
+			fmt.Fprintln(w, `{"state": "active", "role": "member", "organization": {"login": "org", "id": 30}}`)
+		case "/orgs/org/memberships/pending":
+			fmt.Fprintln(w, `{"state": "pending", "role": "member", "organization": {"login": "org", "id": 30}}`)
+		default:
+			http.Error(w, `{"message": "Not Found"}`, http.StatusNotFound)
+		}
+	}))
+	githubBaseURL = ts.URL + "/"
+	return ts
+}
+
+func TestTransferInstallation(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	ts := newMembershipServer()
+	defer ts.Close()
+
+	provider := payments.NewFake(&stripe.Plan{
+		ID: "ProfessionalMonthlyUSD", Amount: 799, Currency: "usd",
+		Meta: map[string]string{payments.OrganisationsMeta: "unlimited", payments.BuildsPerDayMeta: "50"},
+	})
+	customer, err := provider.NewCustomer(nil, "tok_visa", "ProfessionalMonthlyUSD", "", true)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	var (
+		sdb   = sqlx.NewDb(db, "sqlmock")
+		from  = &User{db: sdb, payments: provider, UserID: 1, GitHubID: 10, Logger: logger}
+		to    = &User{db: sdb, payments: provider, UserID: 2, GitHubID: 20, StripeCustomerID: customer.ID, Logger: logger}
+		admin = &User{UserID: 3, GHClient: NewClient(&oauth2.Config{}, &oauth2.Token{AccessToken: "a"}), Logger: logger}
+		org   = 30
+	)
+
+	expectDunning(mock, "dunning", "user_id", to.UserID, "")
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE gh_installations SET user_id = \? WHERE user_id = \? AND installation_id = \?`).
+		WithArgs(to.UserID, from.UserID, 100).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`INSERT INTO installation_transfers \(installation_id, from_user_id, to_user_id, by_user_id\) VALUES \(\?, \?, \?, \?\)`).
+		WithArgs(100, from.UserID, to.UserID, admin.UserID).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	if err := from.TransferInstallation(context.Background(), 100, org, "org", to, "member", admin); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestTransferInstallation_rollback(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	ts := newMembershipServer()
+	defer ts.Close()
+
+	provider := payments.NewFake(&stripe.Plan{
+		ID: "ProfessionalMonthlyUSD", Amount: 799, Currency: "usd",
+		Meta: map[string]string{payments.OrganisationsMeta: "unlimited", payments.BuildsPerDayMeta: "50"},
+	})
+	customer, err := provider.NewCustomer(nil, "tok_visa", "ProfessionalMonthlyUSD", "", true)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	var (
+		sdb  = sqlx.NewDb(db, "sqlmock")
+		from = &User{db: sdb, payments: provider, UserID: 1, GitHubID: 10, GHClient: NewClient(&oauth2.Config{}, &oauth2.Token{AccessToken: "a"}), Logger: logger}
+		to   = &User{db: sdb, payments: provider, UserID: 2, GitHubID: 20, StripeCustomerID: customer.ID, Logger: logger}
+	)
+
+	// The installation must remain with the user if the audit entry could not
+	// be recorded.
+	expectDunning(mock, "dunning", "user_id", to.UserID, "")
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE gh_installations SET user_id = \? WHERE user_id = \? AND installation_id = \?`).
+		WithArgs(to.UserID, from.UserID, 100).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`INSERT INTO installation_transfers`).
+		WithArgs(100, from.UserID, to.UserID, from.UserID).
+		WillReturnError(errors.New("some error"))
+	mock.ExpectRollback()
+
+	if err := from.TransferInstallation(context.Background(), 100, 30, "org", to, "member", from); err == nil {
+		t.Fatal("expected error")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestTransferInstallation_errors(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	ts := newMembershipServer()
+	defer ts.Close()
+
+	var (
+		sdb  = sqlx.NewDb(db, "sqlmock")
+		from = &User{db: sdb, UserID: 1, GitHubID: 10, GHClient: NewClient(&oauth2.Config{}, &oauth2.Token{AccessToken: "a"}), Logger: logger}
+		to   = &User{db: sdb, UserID: 2, GitHubID: 20, Logger: logger}
+	)
+
+	tests := []struct {
+		accountID int
+		to        *User
+		toLogin   string
+		want      string // want is the expected error type
+	}{
+		{from.GitHubID, to, "member", "*users.TransferError"}, // personal installation
+		{30, from, "member", "*users.TransferError"},          // to the same user
+		{30, to, "outsider", "*users.TransferError"},          // recipient is not a member
+		{30, to, "pending", "*users.TransferError"},           // recipient has not accepted their invitation
+		{31, to, "member", "*users.TransferError"},            // org is not the installation's organisation
+		{30, to, "member", "*users.QuotaError"},               // recipient has no subscription
+	}
+	for _, test := range tests {
+		err := from.TransferInstallation(context.Background(), 100, test.accountID, "org", test.to, test.toLogin, from)
+		if have := fmt.Sprintf("%T", err); have != test.want {
+			t.Errorf("accountID %v to %v: have err %v (%s) want %s", test.accountID, test.toLogin, err, have, test.want)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
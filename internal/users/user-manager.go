@@ -4,8 +4,9 @@ import (
 	"golang.org/x/oauth2"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/bradleyfalzon/gopherci-web/internal/payments"
 	"github.com/jmoiron/sqlx"
-	stripe "github.com/stripe/stripe-go"
+	"github.com/pkg/errors"
 
 	ghoauth "golang.org/x/oauth2/github"
 )
@@ -14,17 +15,21 @@ import (
 type UserManager struct {
 	logger           *logrus.Entry
 	db               *sqlx.DB
+	payments         payments.Provider
+	catalogue        payments.Catalogue
 	oauthConf        *oauth2.Config
 	overwriteBaseURL string // used to overwrite baseURL for testing
 }
 
-// NewUserManager returns a new UserManager initialised with db and GitHub
-// clientID and clientSecret.
-func NewUserManager(logger *logrus.Entry, db *sqlx.DB, clientID, clientSecret, stripeKey string) *UserManager {
-	stripe.Key = stripeKey
+// NewUserManager returns a new UserManager initialised with db, a payments
+// provider, the catalogue of the provider's plans and GitHub clientID and
+// clientSecret.
+func NewUserManager(logger *logrus.Entry, db *sqlx.DB, provider payments.Provider, catalogue payments.Catalogue, clientID, clientSecret string) *UserManager {
 	return &UserManager{
-		logger: logger,
-		db:     db,
+		logger:    logger,
+		db:        db,
+		payments:  provider,
+		catalogue: catalogue,
 		oauthConf: &oauth2.Config{
 			ClientID:     clientID,
 			ClientSecret: clientSecret,
@@ -37,5 +42,167 @@ func NewUserManager(logger *logrus.Entry, db *sqlx.DB, clientID, clientSecret, s
 // GetUser returns a user for a given UserID, returns nil if user is not found
 // or an error.
 func (um *UserManager) GetUser(userID int) (*User, error) {
-	return GetUser(um.logger, um.db, um.oauthConf, userID)
+	return GetUser(um.logger, um.db, um.payments, um.catalogue, um.oauthConf, userID)
+}
+
+// GetUserByStripeCustomerID returns a user for a given stripe customer ID,
+// returns nil if user is not found or an error.
+func (um *UserManager) GetUserByStripeCustomerID(customerID string) (*User, error) {
+	return GetUserByStripeCustomerID(um.logger, um.db, um.payments, um.catalogue, um.oauthConf, customerID)
+}
+
+// GetUserByGitHubID returns a user for a given GitHub account ID, returns nil
+// if user is not found or an error.
+func (um *UserManager) GetUserByGitHubID(githubID int) (*User, error) {
+	return GetUserByGitHubID(um.logger, um.db, um.payments, um.catalogue, um.oauthConf, githubID)
+}
+
+// GetInstallationOwner returns the user who enabled installationID, returns
+// nil if the installation is not enabled by a user or an error.
+func (um *UserManager) GetInstallationOwner(installationID int) (*User, error) {
+	return getUser(um.logger, um.db, um.payments, um.catalogue, um.oauthConf, "id IN (SELECT user_id FROM gh_installations WHERE installation_id = ?)", installationID)
+}
+
+// UsersWithEnabledInstallations returns all users who have at least one
+// enabled installation.
+func (um *UserManager) UsersWithEnabledInstallations() ([]*User, error) {
+	var userIDs []int
+	err := um.db.Select(&userIDs, "SELECT DISTINCT user_id FROM gh_installations WHERE user_id IS NOT NULL ORDER BY user_id")
+	if err != nil {
+		return nil, errors.Wrap(err, "could not select users with enabled installations")
+	}
+	return um.getUsers(userIDs)
+}
+
+// UsersWithStripeCustomer returns all users who have a stripe customer.
+func (um *UserManager) UsersWithStripeCustomer() ([]*User, error) {
+	var userIDs []int
+	err := um.db.Select(&userIDs, `SELECT id FROM users WHERE stripe_customer_id != "" ORDER BY id`)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not select users with stripe customers")
+	}
+	return um.getUsers(userIDs)
+}
+
+// UsersPastDue returns all users in the past due state of the failed payment
+// workflow.
+func (um *UserManager) UsersPastDue() ([]*User, error) {
+	var userIDs []int
+	err := um.db.Select(&userIDs, "SELECT user_id FROM dunning WHERE state = ? ORDER BY user_id", DunningPastDue)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not select past due users")
+	}
+	return um.getUsers(userIDs)
+}
+
+// AccountsPastDue returns all billing accounts in the past due state of the
+// failed payment workflow.
+func (um *UserManager) AccountsPastDue() ([]*Account, error) {
+	var accountIDs []int
+	err := um.db.Select(&accountIDs, "SELECT billing_account_id FROM account_dunning WHERE state = ? ORDER BY billing_account_id", DunningPastDue)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not select past due billing accounts")
+	}
+	return um.getAccounts(accountIDs)
+}
+
+// GetAccount returns the billing account of the GitHub organisation with
+// githubID, returns nil if the organisation has no billing account or an
+// error.
+func (um *UserManager) GetAccount(githubID int) (*Account, error) {
+	return getAccount(um.logger, um.db, um.payments, um.catalogue, "github_id = ?", githubID)
+}
+
+// GetOrCreateAccount returns the billing account of the GitHub organisation
+// with githubID and login, creating it if it does not exist.
+func (um *UserManager) GetOrCreateAccount(githubID int, login string) (*Account, error) {
+	// Update the login as organisations can be renamed.
+	_, err := um.db.Exec("INSERT INTO billing_accounts (github_id, login) VALUES (?, ?) ON DUPLICATE KEY UPDATE login = VALUES(login)", githubID, login)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not insert billing account for githubID %v", githubID)
+	}
+	return um.GetAccount(githubID)
+}
+
+// GetAccountByStripeCustomerID returns the billing account for a given stripe
+// customer ID, returns nil if no account is found or an error.
+func (um *UserManager) GetAccountByStripeCustomerID(customerID string) (*Account, error) {
+	if customerID == "" {
+		return nil, nil
+	}
+	return getAccount(um.logger, um.db, um.payments, um.catalogue, "stripe_customer_id = ?", customerID)
+}
+
+// GetInstallationAccount returns the billing account which enabled
+// installationID, returns nil if the installation is not enabled by a billing
+// account or an error.
+func (um *UserManager) GetInstallationAccount(installationID int) (*Account, error) {
+	return getAccount(um.logger, um.db, um.payments, um.catalogue, "id IN (SELECT billing_account_id FROM gh_installations WHERE installation_id = ?)", installationID)
+}
+
+// RemoveInstallation removes installationID regardless of the user or billing
+// account which enabled it, such as when the App has been uninstalled, and
+// queues it to be disabled in GopherCI, replacing any pending change. It is
+// not an error if the installation was not enabled.
+func (um *UserManager) RemoveInstallation(installationID int) error {
+	return inTx(um.db, func(tx *sqlx.Tx) error {
+		_, err := tx.Exec("DELETE FROM gh_installations WHERE installation_id = ?", installationID)
+		if err != nil {
+			return errors.Wrapf(err, "could not remove installationID %v", installationID)
+		}
+		return queueInstallationChange(tx, installationID, false)
+	})
+}
+
+// AccountsWithEnabledInstallations returns all billing accounts which have at
+// least one enabled installation.
+func (um *UserManager) AccountsWithEnabledInstallations() ([]*Account, error) {
+	var accountIDs []int
+	err := um.db.Select(&accountIDs, "SELECT DISTINCT billing_account_id FROM gh_installations WHERE billing_account_id IS NOT NULL ORDER BY billing_account_id")
+	if err != nil {
+		return nil, errors.Wrap(err, "could not select billing accounts with enabled installations")
+	}
+	return um.getAccounts(accountIDs)
+}
+
+// AccountsWithStripeCustomer returns all billing accounts which have a stripe
+// customer.
+func (um *UserManager) AccountsWithStripeCustomer() ([]*Account, error) {
+	var accountIDs []int
+	err := um.db.Select(&accountIDs, `SELECT id FROM billing_accounts WHERE stripe_customer_id != "" ORDER BY id`)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not select billing accounts with stripe customers")
+	}
+	return um.getAccounts(accountIDs)
+}
+
+// getAccounts returns the billing accounts for accountIDs, skipping accounts
+// which are not found.
+func (um *UserManager) getAccounts(accountIDs []int) ([]*Account, error) {
+	var accounts []*Account
+	for _, accountID := range accountIDs {
+		account, err := getAccount(um.logger, um.db, um.payments, um.catalogue, "id = ?", accountID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not get billingAccountID %v", accountID)
+		}
+		if account != nil {
+			accounts = append(accounts, account)
+		}
+	}
+	return accounts, nil
+}
+
+// getUsers returns the users for userIDs, skipping users which are not found.
+func (um *UserManager) getUsers(userIDs []int) ([]*User, error) {
+	var users []*User
+	for _, userID := range userIDs {
+		user, err := um.GetUser(userID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not get userID %v", userID)
+		}
+		if user != nil {
+			users = append(users, user)
+		}
+	}
+	return users, nil
 }
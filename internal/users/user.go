@@ -3,43 +3,74 @@ package users
 import (
 	"context"
 	"database/sql"
+	"encoding/csv"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"strconv"
-	"strings"
 	"time"
 
 	"golang.org/x/oauth2"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/bradleyfalzon/gopherci-web/internal/money"
+	"github.com/bradleyfalzon/gopherci-web/internal/notify"
+	"github.com/bradleyfalzon/gopherci-web/internal/payments"
 	"github.com/google/go-github/github"
 	"github.com/jmoiron/sqlx"
 	"github.com/pkg/errors"
 	stripe "github.com/stripe/stripe-go"
-	"github.com/stripe/stripe-go/coupon"
-	"github.com/stripe/stripe-go/customer"
-	"github.com/stripe/stripe-go/invoice"
-	"github.com/stripe/stripe-go/sub"
 )
 
 // User represents a GopherCI-web user.
 type User struct {
 	Logger           *logrus.Entry
 	db               *sqlx.DB
+	payments         payments.Provider
+	catalogue        payments.Catalogue
 	GHClient         *github.Client
 	UserID           int    `db:"id"`
 	Email            string `db:"email"`
 	GitHubID         int    `db:"github_id"`
 	GitHubToken      []byte `db:"github_token"` // nil if none assigned to user
 	StripeCustomerID string `db:"stripe_customer_id"`
+	// StripeCurrency is the lower case currency of the stripe customer, blank
+	// if the customer has not been charged in any currency.
+	StripeCurrency string `db:"stripe_currency"`
+	// TrialStartedAt and TrialEndsAt are the dates of the user's free trial,
+	// nil if the user has not started a free trial.
+	TrialStartedAt *time.Time `db:"trial_started_at"`
+	TrialEndsAt    *time.Time `db:"trial_ends_at"`
 }
 
 // GetUser looks up a user in the db and returns it, if no user was found,
 // user is nil, if an error occurs it will be returned.
-func GetUser(logger *logrus.Entry, db *sqlx.DB, oauthConf *oauth2.Config, userID int) (*User, error) {
-	user := &User{db: db}
-	err := db.Get(user, "SELECT id, email, github_id, github_token, stripe_customer_id FROM users WHERE id = ?", userID)
+func GetUser(logger *logrus.Entry, db *sqlx.DB, provider payments.Provider, catalogue payments.Catalogue, oauthConf *oauth2.Config, userID int) (*User, error) {
+	return getUser(logger, db, provider, catalogue, oauthConf, "id = ?", userID)
+}
+
+// GetUserByStripeCustomerID looks up a user in the db by their stripe
+// customer ID and returns it, if no user was found, user is nil, if an error
+// occurs it will be returned.
+func GetUserByStripeCustomerID(logger *logrus.Entry, db *sqlx.DB, provider payments.Provider, catalogue payments.Catalogue, oauthConf *oauth2.Config, customerID string) (*User, error) {
+	if customerID == "" {
+		return nil, nil
+	}
+	return getUser(logger, db, provider, catalogue, oauthConf, "stripe_customer_id = ?", customerID)
+}
+
+// GetUserByGitHubID looks up a user in the db by their GitHub account ID and
+// returns it, if no user was found, user is nil, if an error occurs it will
+// be returned.
+func GetUserByGitHubID(logger *logrus.Entry, db *sqlx.DB, provider payments.Provider, catalogue payments.Catalogue, oauthConf *oauth2.Config, githubID int) (*User, error) {
+	return getUser(logger, db, provider, catalogue, oauthConf, "github_id = ?", githubID)
+}
+
+// getUser looks up a single user matching the where condition.
+func getUser(logger *logrus.Entry, db *sqlx.DB, provider payments.Provider, catalogue payments.Catalogue, oauthConf *oauth2.Config, where string, args ...interface{}) (*User, error) {
+	user := &User{db: db, payments: provider, catalogue: catalogue}
+	err := db.Get(user, "SELECT id, email, github_id, github_token, stripe_customer_id, stripe_currency, trial_started_at, trial_ends_at FROM users WHERE "+where, args...)
 	switch {
 	case err == sql.ErrNoRows:
 		return nil, nil
@@ -72,23 +103,179 @@ func (u *User) GitHubListOrgMembershipsActive(ctx context.Context) ([]*github.Me
 	return memberships, nil
 }
 
-// EnableInstallation marks a GitHub installation as enabled for this user.
-// This does not enable the installation in GopherCI. Returns an error if an
-// error occured, else success if successfully changed from disabled to
-// enabled.
-func (u *User) EnableInstallation(installationID int) error {
-	// TODO check if they haven't exceeded any quotas first
-	_, err := u.db.Exec(`INSERT IGNORE INTO gh_installations (user_id, installation_id) VALUES (?, ?)`, u.UserID, installationID)
-	return err
+// GitHubOrgAdmin returns the GitHub organisation org if the user is an active
+// admin of it, nil if the user is not, or an error if an error occurred.
+func (u *User) GitHubOrgAdmin(ctx context.Context, org string) (*github.Organization, error) {
+	return u.GitHubOrgMember(ctx, org, "", "admin")
+}
+
+// GitHubOrgMember returns the GitHub organisation org if the GitHub user login,
+// or this user if login is blank, is an active member of it with any of roles,
+// or with any role if no roles are given. Returns nil if login is not such a
+// member, or an error if an error occurred. This user must be a member of org
+// to check another user's membership.
+func (u *User) GitHubOrgMember(ctx context.Context, org, login string, roles ...string) (*github.Organization, error) {
+	membership, resp, err := u.GHClient.Organizations.GetOrgMembership(ctx, login, org)
+	switch {
+	case resp != nil && resp.StatusCode == http.StatusNotFound:
+		return nil, nil
+	case err != nil:
+		return nil, errors.Wrapf(err, "could not get membership of org %q", org)
+	}
+	if membership.State == nil || *membership.State != "active" {
+		return nil, nil
+	}
+	if len(roles) == 0 {
+		return membership.Organization, nil
+	}
+	for _, role := range roles {
+		if membership.Role != nil && *membership.Role == role {
+			return membership.Organization, nil
+		}
+	}
+	return nil, nil
+}
+
+// QuotaError is returned when enabling an installation would exceed the
+// limits of the user's plan.
+type QuotaError struct {
+	Plan     string // Plan is the name of the user's plan, blank if no active plan.
+	Limit    int    // Limit is the maximum number of organisations for the plan.
+	Disabled bool   // Disabled is true if installations were disabled by dunning.
+}
+
+// Error implements the error interface.
+func (e *QuotaError) Error() string {
+	switch {
+	case e.Disabled:
+		return "Installations were disabled after a failed payment, update your payment method to enable an installation"
+	case e.Plan == "":
+		return "An active subscription is required to enable an installation"
+	case e.Limit == 0:
+		return fmt.Sprintf("The %s plan does not include organisations, upgrade your plan to enable an organisation", e.Plan)
+	}
+	return fmt.Sprintf("The %s plan is limited to %d organisations, upgrade your plan to enable more organisations", e.Plan, e.Limit)
+}
+
+// EnableInstallation marks a GitHub installation owned by GitHub accountID as
+// enabled for this user, and queues the installation to be enabled in
+// GopherCI by ApplyInstallationChanges. Returns *QuotaError if the user has no
+// active subscription, installations were disabled by dunning, or the
+// installation belongs to an organisation and the user's plan does not permit
+// any more organisations, or an error if an error occured, else success if
+// successfully changed from disabled to enabled.
+func (u *User) EnableInstallation(installationID, accountID int) error {
+	if err := u.checkQuota(installationID, accountID); err != nil {
+		return err
+	}
+	return inTx(u.db, func(tx *sqlx.Tx) error {
+		_, err := tx.Exec(`INSERT IGNORE INTO gh_installations (user_id, installation_id, account_id) VALUES (?, ?, ?)`, u.UserID, installationID, accountID)
+		if err != nil {
+			return err
+		}
+		return queueInstallationChange(tx, installationID, true)
+	})
+}
+
+// checkQuota returns *QuotaError if the user cannot enable installationID
+// owned by GitHub accountID. Every installation requires an active
+// subscription, as enforced by billing:check and installations:reconcile,
+// installations cannot be enabled once dunning has disabled them until the
+// payment succeeds, and organisation installations are limited by the user's
+// plan.
+func (u *User) checkQuota(installationID, accountID int) error {
+	plan, err := u.Plan()
+	if err != nil {
+		return errors.Wrap(err, "could not get user's plan")
+	}
+	if plan == nil {
+		return &QuotaError{}
+	}
+	disabled, err := u.dunning().disabled()
+	if err != nil {
+		return err
+	}
+	if disabled {
+		return &QuotaError{Plan: plan.Name, Disabled: true}
+	}
+	if accountID == u.GitHubID || plan.Organisations == payments.Unlimited {
+		return nil
+	}
+
+	organisations, err := u.countOrganisations(installationID)
+	if err != nil {
+		return err
+	}
+	if organisations >= plan.Organisations {
+		return &QuotaError{Plan: plan.Name, Limit: plan.Organisations}
+	}
+	return nil
+}
+
+// EnabledOrganisations returns the number of organisation installations
+// enabled by this user.
+func (u *User) EnabledOrganisations() (int, error) {
+	return u.countOrganisations(0)
+}
+
+// countOrganisations returns the number of organisation installations enabled
+// by this user, excluding installationID. Installations enabled before
+// account_id was recorded have a NULL account_id and are counted as
+// organisations until RecordInstallationAccounts records their account.
+func (u *User) countOrganisations(excludeInstallationID int) (int, error) {
+	var organisations int
+	err := u.db.Get(&organisations, `SELECT COUNT(*) FROM gh_installations WHERE user_id = ? AND (account_id IS NULL OR account_id != ?) AND installation_id != ?`, u.UserID, u.GitHubID, excludeInstallationID)
+	if err != nil {
+		return 0, errors.Wrap(err, "could not count enabled organisations")
+	}
+	return organisations, nil
+}
+
+// RecordInstallationAccounts records the GitHub account of the user's
+// installations enabled before account_id was recorded, accountIDs maps each
+// installationID to its GitHub accountID.
+func (u *User) RecordInstallationAccounts(accountIDs map[int]int) error {
+	for installationID, accountID := range accountIDs {
+		_, err := u.db.Exec(`UPDATE gh_installations SET account_id = ? WHERE user_id = ? AND installation_id = ? AND account_id IS NULL`, accountID, u.UserID, installationID)
+		if err != nil {
+			return errors.Wrapf(err, "could not record account of installationID %v", installationID)
+		}
+	}
+	return nil
 }
 
-// DisableInstallation marks a GitHub installation as disabled for this user.
-// This does not disable the installation in GopherCI. Returns an error if an
-// error occurred, else success if successfully changed from enabled to
-// disabled.
+// DisableInstallation marks a GitHub installation as disabled for this user,
+// and queues the installation to be disabled in GopherCI by
+// ApplyInstallationChanges. Returns an error if an error occurred, else
+// success if successfully changed from enabled to disabled.
 func (u *User) DisableInstallation(installationID int) error {
-	_, err := u.db.Exec(`DELETE FROM gh_installations WHERE user_id = ? AND installation_id = ?`, u.UserID, installationID)
-	return err
+	return inTx(u.db, func(tx *sqlx.Tx) error {
+		_, err := tx.Exec(`DELETE FROM gh_installations WHERE user_id = ? AND installation_id = ?`, u.UserID, installationID)
+		if err != nil {
+			return err
+		}
+		return queueInstallationChange(tx, installationID, false)
+	})
+}
+
+// DisableAllInstallations disables all installations enabled by this user,
+// and queues them to be disabled in GopherCI, such as when their subscription
+// ends. Each step is logged so the actions taken on behalf of the user can be
+// audited.
+func (u *User) DisableAllInstallations() error {
+	installationIDs, err := u.EnabledInstallations()
+	if err != nil {
+		return errors.Wrap(err, "could not get enabled installations")
+	}
+	u.Logger.Infof("disabling %d enabled installations", len(installationIDs))
+
+	for _, installationID := range installationIDs {
+		if err := u.DisableInstallation(installationID); err != nil {
+			return errors.Wrapf(err, "could not disable installationID %v for user", installationID)
+		}
+		u.Logger.WithField("installationID", installationID).Info("disabled installation for user")
+	}
+	return nil
 }
 
 // InstallationEnabled checks if installationID is enabled by this user, any error means
@@ -116,40 +303,146 @@ func (u *User) EnabledInstallations() ([]int, error) {
 	return installationIDs, nil
 }
 
-func (u *User) ProcessStripePayment(token, plan string) error {
-	// 2017-01-22, we've switched from AUD to USD currency in stripe, so existing
-	// customers need a new stripe customer ID as stripe won't accept a single
-	// customer with multiple currencies. So create a new stripe customer for
-	// these users. We can remove the "u.UserID > 17"  condition once everyone is
-	// off of the PersonalMonthly plan. See commit message for more information.
-	if u.StripeCustomerID != "" && u.UserID > 17 {
-		// TODO this should upgrade the existing plan (prorata) #8
-		_, err := sub.New(&stripe.SubParams{
-			Customer: u.StripeCustomerID,
-			Plan:     plan,
-		})
+// ProcessStripePayment subscribes the user to plan using the payment source
+// token, with couponID's discount if not blank. If the coupon cannot be
+// redeemed a *CouponError is returned.
+func (u *User) ProcessStripePayment(token, plan, couponID string) error {
+	if couponID != "" {
+		if _, err := u.PreviewStripeCoupon(couponID, plan); err != nil {
+			return err
+		}
+	}
+
+	p, err := u.payments.Plan(plan)
+	if err != nil {
+		return errors.Wrapf(err, "could not get plan %q", plan)
+	}
+
+	// Stripe won't accept a single customer with multiple currencies, so
+	// customers in a different currency to the plan, such as customers from
+	// before the switch from AUD to USD, get a new stripe customer.
+	currency := u.StripeCurrency
+	if u.StripeCustomerID != "" && currency == "" {
+		// The currency was not recorded, such as for customers from before
+		// currencies were recorded, so it's looked up from stripe.
+		customer, err := u.StripeCustomer()
+		if err != nil {
+			return err
+		}
+		currency = string(customer.Currency)
+	}
+	// A customer without a currency has never been charged, so can be charged
+	// in any currency.
+	if u.StripeCustomerID != "" && (currency == "" || currency == string(p.Currency)) {
+		// Customers with an active subscription change plans using
+		// ChangeStripePlan, so this customer has no active subscription.
+		// Only a single free trial is offered.
+		if couponID != "" {
+			if err := u.payments.ApplyCoupon(u.StripeCustomerID, couponID); err != nil {
+				return errors.Wrapf(err, "could not apply coupon %q to stripe customer %v", couponID, u.StripeCustomerID)
+			}
+		}
+		sub, err := u.payments.Subscribe(u.StripeCustomerID, plan, u.TrialStartedAt == nil)
 		if err != nil {
 			return errors.Wrapf(err, "could not subscribe userID %v stripe customer %v to %q", u.UserID, u.StripeCustomerID, plan)
 		}
-		return nil
+		if u.StripeCurrency == "" {
+			if err := u.RecordStripeCurrency(string(p.Currency)); err != nil {
+				return err
+			}
+		}
+		return u.RecordStripeTrial(sub)
 	}
 
-	customerParams := &stripe.CustomerParams{
-		Plan: plan,
-		Params: stripe.Params{
-			Meta: map[string]string{"userID": strconv.FormatInt(int64(u.UserID), 10)},
-		},
-	}
-	_ = customerParams.SetSource(token)
-	customer, err := customer.New(customerParams)
+	// Users who have had a free trial with a previous customer, such as in
+	// another currency, are not offered another.
+	customer, err := u.payments.NewCustomer(map[string]string{
+		payments.UserIDMeta: strconv.Itoa(u.UserID),
+	}, token, plan, couponID, u.TrialStartedAt == nil)
 	if err != nil {
 		return errors.Wrap(err, "could not create stripe customer")
 	}
 
-	_, err = u.db.Exec(`UPDATE users SET stripe_customer_id = ? WHERE ID = ?`, customer.ID, u.UserID)
+	_, err = u.db.Exec(`UPDATE users SET stripe_customer_id = ?, stripe_currency = ? WHERE ID = ?`, customer.ID, string(customer.Currency), u.UserID)
 	if err != nil {
 		return errors.Wrapf(err, "Created stripe customer with id %q but could not allocate to userID %v", customer.ID, u.UserID)
 	}
+	u.StripeCustomerID, u.StripeCurrency = customer.ID, string(customer.Currency)
+
+	if customer.Subs != nil {
+		for _, sub := range customer.Subs.Values {
+			if err := u.RecordStripeTrial(sub); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// RecordStripeCurrency records the currency of the user's stripe customer, as
+// stripe customers can only be charged in a single currency.
+func (u *User) RecordStripeCurrency(currency string) error {
+	_, err := u.db.Exec(`UPDATE users SET stripe_currency = ? WHERE id = ?`, currency, u.UserID)
+	if err != nil {
+		return errors.Wrapf(err, "could not record stripe currency for userID %v", u.UserID)
+	}
+	u.StripeCurrency = currency
+	return nil
+}
+
+// RecordStripeTrial records the free trial of subscription sub, if it has a
+// trial, so the user is only offered a single free trial.
+func (u *User) RecordStripeTrial(sub *stripe.Sub) error {
+	if sub.TrialStart == 0 || sub.TrialEnd == 0 {
+		return nil
+	}
+	startedAt, endsAt := time.Unix(sub.TrialStart, 0).UTC(), time.Unix(sub.TrialEnd, 0).UTC()
+	_, err := u.db.Exec(`UPDATE users SET trial_started_at = ?, trial_ends_at = ? WHERE id = ?`, startedAt, endsAt, u.UserID)
+	if err != nil {
+		return errors.Wrapf(err, "could not record trial for userID %v", u.UserID)
+	}
+	u.TrialStartedAt, u.TrialEndsAt = &startedAt, &endsAt
+	return nil
+}
+
+// billingURL is the console page where users manage their subscriptions.
+const billingURL = "https://gopherci.io/console/billing"
+
+// SendTrialReminder notifies the user the free trial of subscription sub ends
+// soon, and they'll be charged from then.
+func (u *User) SendTrialReminder(notifier notify.Notifier, sub *stripe.Sub) error {
+	return sendTrialReminder(notifier, u.Email, billingURL, sub)
+}
+
+// sendTrialReminder notifies email the free trial of subscription sub ends
+// soon, linking to url to manage the subscription.
+func sendTrialReminder(notifier notify.Notifier, email, url string, sub *stripe.Sub) error {
+	body := fmt.Sprintf("Hi,\n\n"+
+		"Your GopherCI free trial of the %s plan ends on %s, your card will be charged %s per %s from then.\n\n"+
+		"To change or cancel your subscription, visit:\n\n%s\n",
+		sub.Plan.Name, time.Unix(sub.TrialEnd, 0).Format("2 January 2006"),
+		money.Format(string(sub.Plan.Currency), int64(sub.Plan.Amount)), sub.Plan.Interval, url,
+	)
+	if err := notifier.Notify(email, "Your GopherCI free trial ends soon", body); err != nil {
+		return errors.Wrap(err, "could not send trial reminder")
+	}
+	return nil
+}
+
+// consoleURL is the console page where users manage their installations.
+const consoleURL = "https://gopherci.io/console"
+
+// SendUninstallNotice notifies the user the GopherCI App was uninstalled from
+// the GitHub account login, so the installation is no longer enabled.
+func (u *User) SendUninstallNotice(notifier notify.Notifier, login string) error {
+	body := fmt.Sprintf("Hi,\n\n"+
+		"The GopherCI GitHub App was uninstalled from %s, so GopherCI will no longer check its pull requests and pushes.\n\n"+
+		"To enable GopherCI again, install the App and enable the installation at:\n\n%s\n",
+		login, consoleURL,
+	)
+	if err := notifier.Notify(u.Email, "GopherCI uninstalled from "+login, body); err != nil {
+		return errors.Wrap(err, "could not send uninstall notice")
+	}
 	return nil
 }
 
@@ -159,31 +452,179 @@ func (u *User) StripeCustomer() (*stripe.Customer, error) {
 	if u.StripeCustomerID == "" {
 		return nil, nil
 	}
-	customer, err := customer.Get(u.StripeCustomerID, nil)
+	customer, err := u.payments.Customer(u.StripeCustomerID)
 	return customer, errors.Wrapf(err, "could not get stripe customer id %q", u.StripeCustomerID)
 }
 
-// ProcessStripeCoupon adds a couponID to a stripe customer.
-func (u *User) ProcessStripeCoupon(couponID string) error {
-	coupon, err := coupon.Get(couponID, nil)
-	if err != nil {
+// ProcessStripeCoupon adds a couponID to a stripe customer subscribed to plan
+// planID. If the coupon cannot be redeemed a *CouponError is returned.
+func (u *User) ProcessStripeCoupon(couponID, planID string) error {
+	if _, err := u.PreviewStripeCoupon(couponID, planID); err != nil {
 		return err
 	}
-	if !coupon.Valid {
-		return errors.New("coupon does not exist")
+	return u.payments.ApplyCoupon(u.StripeCustomerID, couponID)
+}
+
+// Card represents a payment card.
+type Card struct {
+	Brand    string     // Brand is the card's brand, such as Visa.
+	LastFour string     // LastFour is the last four digits of the card number.
+	ExpMonth time.Month // ExpMonth is the month the card expires.
+	ExpYear  int        // ExpYear is the year the card expires.
+}
+
+// ExpiresAt returns the time the card expires, which is the end of its
+// expiry month.
+func (c *Card) ExpiresAt() time.Time {
+	return time.Date(c.ExpYear, c.ExpMonth+1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+// ExpiresWithin returns true if the card has expired, or will expire within
+// d of now.
+func (c *Card) ExpiresWithin(now time.Time, d time.Duration) bool {
+	return !now.Add(d).Before(c.ExpiresAt())
+}
+
+// StripeDefaultCard returns the customer's default payment card, or nil if
+// the customer does not have a default card.
+func (u *User) StripeDefaultCard(customer *stripe.Customer) *Card {
+	if customer.DefaultSource == nil || customer.Sources == nil {
+		return nil
+	}
+	for _, source := range customer.Sources.Values {
+		if source.ID != customer.DefaultSource.ID || source.Card == nil {
+			continue
+		}
+		return &Card{
+			Brand:    string(source.Card.Brand),
+			LastFour: source.Card.LastFour,
+			ExpMonth: time.Month(source.Card.Month),
+			ExpYear:  int(source.Card.Year),
+		}
 	}
+	return nil
+}
 
-	customerParams := &stripe.CustomerParams{
-		Coupon: couponID,
+// UpdateStripeCard adds the card with payment source token to the user's
+// stripe customer and makes it the default card for future invoices.
+func (u *User) UpdateStripeCard(token string) error {
+	if u.StripeCustomerID == "" {
+		return errors.New("user is not a stripe customer")
+	}
+	if _, err := u.payments.UpdateDefaultCard(u.StripeCustomerID, token); err != nil {
+		return errors.Wrapf(err, "could not update default card for stripe customer %q", u.StripeCustomerID)
 	}
-	_, err = customer.Update(u.StripeCustomerID, customerParams)
-	return err
+	return nil
 }
 
 // Invoice represents an upcoming or previous invoice.
 type Invoice struct {
-	AmountDisplay string
-	DueDate       time.Time
+	ID            string    // ID is the stripe invoice ID, blank for upcoming invoices.
+	AmountDisplay string    // AmountDisplay is the amount formatted for display.
+	DueDate       time.Time // DueDate is the date of the invoice.
+	Status        string    // Status is paid, open or void, blank for upcoming invoices.
+	PeriodStart   time.Time // PeriodStart is the start of the billing period.
+	PeriodEnd     time.Time // PeriodEnd is the end of the billing period.
+	URL           string    // URL is the hosted invoice page or receipt, if any.
+	PDFURL        string    // PDFURL is the link to download the invoice as a PDF, if any.
+}
+
+// Invoice statuses.
+const (
+	InvoicePaid = "paid"
+	InvoiceOpen = "open"
+	InvoiceVoid = "void"
+)
+
+// newInvoice converts a stripe invoice to an Invoice.
+func newInvoice(invoice *stripe.Invoice) Invoice {
+	i := Invoice{
+		ID:            invoice.ID,
+		AmountDisplay: money.Format(string(invoice.Currency), invoice.Amount),
+		DueDate:       time.Unix(invoice.Date, 0),
+		Status:        InvoiceOpen,
+		URL:           invoice.HostedInvoiceURL,
+		PDFURL:        invoice.InvoicePDF,
+	}
+	switch {
+	case invoice.Paid:
+		i.Status = InvoicePaid
+	case invoice.Forgive:
+		// Forgiven invoices will never be paid.
+		i.Status = InvoiceVoid
+	}
+	if invoice.Start > 0 {
+		i.PeriodStart = time.Unix(invoice.Start, 0)
+	}
+	if invoice.End > 0 {
+		i.PeriodEnd = time.Unix(invoice.End, 0)
+	}
+	return i
+}
+
+// StripeInvoices returns up to limit of the user's previous invoices, newest
+// first, starting after the invoice ID startingAfter, or the newest if blank.
+// more is true if there are older invoices.
+func (u *User) StripeInvoices(startingAfter string, limit int) (invoices []Invoice, more bool, err error) {
+	if u.StripeCustomerID == "" {
+		return nil, false, nil
+	}
+	stripeInvoices, more, err := u.payments.Invoices(u.StripeCustomerID, startingAfter, limit)
+	if err != nil {
+		return nil, false, errors.Wrapf(err, "could not list invoices for stripe customer %q", u.StripeCustomerID)
+	}
+	for _, invoice := range stripeInvoices {
+		invoices = append(invoices, newInvoice(invoice))
+	}
+	return invoices, more, nil
+}
+
+// AllStripeInvoices returns all of the user's previous invoices, newest
+// first.
+func (u *User) AllStripeInvoices() ([]Invoice, error) {
+	const pageSize = 100
+	var (
+		invoices      []Invoice
+		startingAfter string
+	)
+	for {
+		page, more, err := u.StripeInvoices(startingAfter, pageSize)
+		if err != nil {
+			return nil, err
+		}
+		invoices = append(invoices, page...)
+		if !more || len(page) == 0 {
+			return invoices, nil
+		}
+		startingAfter = page[len(page)-1].ID
+	}
+}
+
+// WriteInvoicesCSV writes invoices to w in CSV format, with a header row.
+func WriteInvoicesCSV(w io.Writer, invoices []Invoice) error {
+	const dateFormat = "2006-01-02"
+	cw := csv.NewWriter(w)
+	_ = cw.Write([]string{"Invoice", "Date", "Period Start", "Period End", "Amount", "Status", "URL"})
+	for _, invoice := range invoices {
+		var periodStart, periodEnd string
+		if !invoice.PeriodStart.IsZero() {
+			periodStart = invoice.PeriodStart.UTC().Format(dateFormat)
+		}
+		if !invoice.PeriodEnd.IsZero() {
+			periodEnd = invoice.PeriodEnd.UTC().Format(dateFormat)
+		}
+		_ = cw.Write([]string{
+			invoice.ID,
+			invoice.DueDate.UTC().Format(dateFormat),
+			periodStart,
+			periodEnd,
+			invoice.AmountDisplay,
+			invoice.Status,
+			invoice.URL,
+		})
+	}
+	cw.Flush()
+	return cw.Error()
 }
 
 // StripeUpcomingInvoice returns the upcoming invoice for a user, nil if
@@ -192,15 +633,12 @@ func (u *User) StripeUpcomingInvoice() (*Invoice, error) {
 	if u.StripeCustomerID == "" {
 		return nil, nil
 	}
-	invoice, err := invoice.GetNext(&stripe.InvoiceParams{Customer: u.StripeCustomerID})
-	if err != nil {
-		if serr, ok := err.(*stripe.Error); ok && serr.HTTPStatusCode == http.StatusNotFound {
-			return nil, nil
-		}
+	invoice, err := u.payments.UpcomingInvoice(u.StripeCustomerID)
+	if err != nil || invoice == nil {
 		return nil, err
 	}
 	return &Invoice{
-		AmountDisplay: amountString(invoice.Currency, invoice.Amount),
+		AmountDisplay: money.Format(string(invoice.Currency), invoice.Amount),
 		DueDate:       time.Unix(invoice.Date, 0),
 	}, nil
 }
@@ -208,6 +646,7 @@ func (u *User) StripeUpcomingInvoice() (*Invoice, error) {
 // Subscription represents a payment subscription.
 type Subscription struct {
 	ID            string
+	PlanID        string    // PlanID is the stripe plan ID.
 	Name          string    // Name is the plan name.
 	AmountDisplay string    // AmountDisplay is the amount formatted for display.
 	AmountCents   uint      // AmountCents is the amount in cents.
@@ -221,6 +660,11 @@ type Subscription struct {
 	// Ended is whether the subcription is currently active (it maybe cancelled,
 	// but not currently ended).
 	Ended bool
+	// TrialEndsAt is the date the free trial ends, zero if the subscription
+	// did not have a trial.
+	TrialEndsAt time.Time
+	// InTrial is whether the subscription is currently in its free trial.
+	InTrial bool
 }
 
 // Discount represents a discount to be applied.
@@ -248,21 +692,7 @@ func (u *User) StripeDiscount(customer *stripe.Customer) *Discount {
 		return nil
 	}
 
-	switch {
-	case customer.Discount.Coupon.Percent > 0:
-		discount.Description = fmt.Sprintf("%d%% off", customer.Discount.Coupon.Percent)
-	case customer.Discount.Coupon.Amount > 0:
-		discount.Description = fmt.Sprintf("%d%% off", customer.Discount.Coupon.Percent)
-	}
-
-	switch customer.Discount.Coupon.Duration {
-	case coupon.Forever:
-		discount.Description += " forever"
-	case coupon.Once:
-		discount.Description += " the next invoice"
-	case coupon.Repeating:
-		discount.Description += fmt.Sprintf(" for %d months", customer.Discount.Coupon.DurationPeriod)
-	}
+	discount.Description = couponDescription(customer.Discount.Coupon)
 
 	return &discount
 }
@@ -270,6 +700,12 @@ func (u *User) StripeDiscount(customer *stripe.Customer) *Discount {
 // StripeSubscriptions returns a slice of subscriptions for the current user,
 // both current and previous subscriptions are returned.
 func (u *User) StripeSubscriptions(customer *stripe.Customer) []Subscription {
+	return stripeSubscriptions(customer)
+}
+
+// stripeSubscriptions returns all current and previous subscriptions of
+// customer.
+func stripeSubscriptions(customer *stripe.Customer) []Subscription {
 	var subs []Subscription
 	if customer.Subs == nil {
 		return nil
@@ -277,8 +713,9 @@ func (u *User) StripeSubscriptions(customer *stripe.Customer) []Subscription {
 	for _, sub := range customer.Subs.Values {
 		s := Subscription{
 			ID:            sub.ID,
+			PlanID:        sub.Plan.ID,
 			Name:          sub.Plan.Name,
-			AmountDisplay: amountString(sub.Plan.Currency, int64(sub.Plan.Amount)),
+			AmountDisplay: money.Format(string(sub.Plan.Currency), int64(sub.Plan.Amount)),
 			AmountCents:   uint(sub.Plan.Amount),
 			Interval:      string(sub.Plan.Interval),
 			Ended:         sub.EndCancel,
@@ -295,19 +732,189 @@ func (u *User) StripeSubscriptions(customer *stripe.Customer) []Subscription {
 		if sub.Ended > 0 {
 			s.EndedAt = time.Unix(sub.Ended, 0)
 		}
+		if sub.TrialEnd > 0 {
+			s.TrialEndsAt = time.Unix(sub.TrialEnd, 0)
+		}
+		s.InTrial = sub.Status == stripe.Trialing
 		subs = append(subs, s)
 	}
 	return subs
 }
 
-func amountString(currency stripe.Currency, amount int64) string {
-	return fmt.Sprintf("$%s %.2f", strings.ToUpper(string(currency)), float64(amount)/100)
+// Plan returns the plan of the user's active subscription, or nil if the
+// user has no active subscription.
+func (u *User) Plan() (*payments.Plan, error) {
+	customer, err := u.StripeCustomer()
+	if err != nil || customer == nil {
+		return nil, err
+	}
+	return customerPlan(u.catalogue, customer), nil
+}
+
+// customerPlan returns the plan of customer's active subscription from
+// catalogue, or nil if customer has no active subscription.
+func customerPlan(catalogue payments.Catalogue, customer *stripe.Customer) *payments.Plan {
+	for _, sub := range stripeSubscriptions(customer) {
+		if !sub.EndedAt.IsZero() {
+			continue
+		}
+		plan := catalogue.Subscribed(sub.PlanID, sub.Name)
+		return &plan
+	}
+	return nil
+}
+
+// AnalysisCounter counts the analyses of installations, it's satisfied by
+// *gopherci.Client.
+type AnalysisCounter interface {
+	CountDailyAnalyses(day time.Time, installationIDs ...int) (map[int]int, error)
+}
+
+// BuildUsage is a user's usage of builds for a single day.
+type BuildUsage struct {
+	Installations map[int]int // Installations is the number of builds per installationID.
+	Total         int         // Total is the number of builds for all installations.
+	// Limit is the plan's daily build limit, or payments.Unlimited. Users
+	// without a plan have no limit, subscriptions are enforced separately.
+	Limit int
+}
+
+// LimitReached returns true if no more builds are permitted for the day.
+func (b *BuildUsage) LimitReached() bool {
+	return b.Limit != payments.Unlimited && b.Total >= b.Limit
+}
+
+// BuildUsage returns the user's build usage for all enabled installations on
+// the UTC day containing day.
+func (u *User) BuildUsage(counter AnalysisCounter, day time.Time) (*BuildUsage, error) {
+	installationIDs, err := u.EnabledInstallations()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get enabled installations")
+	}
+	plan, err := u.Plan()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get user's plan")
+	}
+	return buildUsage(counter, day, installationIDs, plan)
+}
+
+// buildUsage returns the build usage of installationIDs on the UTC day
+// containing day, limited by plan, which may be nil.
+func buildUsage(counter AnalysisCounter, day time.Time, installationIDs []int, plan *payments.Plan) (*BuildUsage, error) {
+	counts, err := counter.CountDailyAnalyses(day, installationIDs...)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not count daily analyses")
+	}
+
+	usage := &BuildUsage{Installations: make(map[int]int), Limit: payments.Unlimited}
+	if plan != nil {
+		usage.Limit = plan.BuildsPerDay
+	}
+	for _, installationID := range installationIDs {
+		usage.Installations[installationID] = counts[installationID]
+		usage.Total += counts[installationID]
+	}
+	return usage, nil
+}
+
+// HasActiveSubscription returns true if the user has a stripe subscription
+// that has not yet ended, this includes subscriptions which are cancelled
+// but will not end until the end of the current billing period.
+func (u *User) HasActiveSubscription() (bool, error) {
+	customer, err := u.StripeCustomer()
+	if err != nil || customer == nil {
+		return false, err
+	}
+	return HasActiveSubscription(customer), nil
+}
+
+// HasActiveSubscription returns true if customer has a subscription that has
+// not yet ended, customer may be nil.
+func HasActiveSubscription(customer *stripe.Customer) bool {
+	if customer == nil {
+		return false
+	}
+	for _, sub := range stripeSubscriptions(customer) {
+		if sub.EndedAt.IsZero() {
+			return true
+		}
+	}
+	return false
+}
+
+// ActiveStripeSubscription returns the subscription which has not been
+// cancelled, or nil if all subscriptions have been cancelled.
+func (u *User) ActiveStripeSubscription(customer *stripe.Customer) *Subscription {
+	return activeSubscription(customer)
+}
+
+// activeSubscription returns customer's subscription which has not been
+// cancelled, or nil if all subscriptions have been cancelled.
+func activeSubscription(customer *stripe.Customer) *Subscription {
+	for _, sub := range stripeSubscriptions(customer) {
+		if sub.CancelledAt.IsZero() {
+			return &sub
+		}
+	}
+	return nil
+}
+
+// ProrationPreview is a preview of the next invoice after changing plans.
+type ProrationPreview struct {
+	// ProrationDate is the time the proration was calculated, the same time
+	// must be used to change the plan to be charged the previewed amount.
+	ProrationDate time.Time
+	// ProrationDisplay is the total of the prorated adjustments, negative for
+	// a credit, formatted for display.
+	ProrationDisplay string
+	// ProrationCents is the total of the prorated adjustments in cents.
+	ProrationCents int64
+	// AmountDisplay is the amount of the next invoice formatted for display.
+	AmountDisplay string
+	// DueDate is the date of the next invoice.
+	DueDate time.Time
+}
+
+// PreviewStripePlanChange previews the next invoice if the subscription subID
+// was changed to plan, with proration calculated at prorationDate.
+func (u *User) PreviewStripePlanChange(subID, plan string, prorationDate time.Time) (*ProrationPreview, error) {
+	invoice, err := u.payments.PreviewPlanChange(u.StripeCustomerID, subID, plan, prorationDate)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not preview plan change for userID %v subscription %q to %q", u.UserID, subID, plan)
+	}
+
+	var prorated int64
+	if invoice.Lines != nil {
+		for _, line := range invoice.Lines.Values {
+			if line.Proration {
+				prorated += line.Amount
+			}
+		}
+	}
+	return &ProrationPreview{
+		ProrationDate:    prorationDate,
+		ProrationDisplay: money.Format(string(invoice.Currency), prorated),
+		ProrationCents:   prorated,
+		AmountDisplay:    money.Format(string(invoice.Currency), invoice.Amount),
+		DueDate:          time.Unix(invoice.Date, 0),
+	}, nil
+}
+
+// ChangeStripePlan changes the subscription subID to plan in place, the
+// difference is prorated from prorationDate and included in the next
+// invoice. It does not check the user's installations are within the limits
+// of the new plan.
+func (u *User) ChangeStripePlan(subID, plan string, prorationDate time.Time) error {
+	_, err := u.payments.ChangePlan(subID, plan, prorationDate)
+	if err != nil {
+		return errors.Wrapf(err, "could not change userID %v subscription %q to %q", u.UserID, subID, plan)
+	}
+	return nil
 }
 
 // CancelStripeSubscription cancels a stripe subscription at the end of the
 // current billing period if endCancel is true. It does not disable any
 // enabled installations.
 func (u *User) CancelStripeSubscription(id string, endCancel bool) error {
-	_, err := sub.Cancel(id, &stripe.SubParams{EndCancel: endCancel})
-	return err
+	return u.payments.CancelSubscription(id, endCancel)
 }
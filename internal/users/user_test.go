@@ -0,0 +1,766 @@
+package users
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	sqlmock "github.com/bradleyfalzon/go-sqlmock"
+	"github.com/bradleyfalzon/gopherci-web/internal/payments"
+	"github.com/jmoiron/sqlx"
+	stripe "github.com/stripe/stripe-go"
+	"github.com/stripe/stripe-go/coupon"
+	"golang.org/x/oauth2"
+)
+
+// loadCatalogue returns the catalogue of provider's plans.
+func loadCatalogue(t *testing.T, provider payments.Provider) payments.Catalogue {
+	catalogue, err := payments.LoadCatalogue(logger, provider)
+	if err != nil {
+		t.Fatal("could not load catalogue:", err)
+	}
+	return catalogue
+}
+
+func TestGetUserByStripeCustomerID(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	rows := sqlmock.NewRows([]string{"id", "email", "github_id", "github_token", "stripe_customer_id", "stripe_currency", "trial_started_at", "trial_ends_at"}).
+		AddRow(1, "user@example.com", 2, nil, "cus_1", "usd", nil, nil)
+
+	mock.ExpectQuery("SELECT .* FROM users WHERE stripe_customer_id = ?").
+		WithArgs("cus_1").
+		WillReturnRows(rows)
+
+	user, err := GetUserByStripeCustomerID(logger, sqlx.NewDb(db, "sqlmock"), nil, nil, &oauth2.Config{}, "cus_1")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if user == nil {
+		t.Fatal("expected user, got nil")
+	}
+	if user.UserID != 1 || user.StripeCustomerID != "cus_1" {
+		t.Errorf("unexpected user: %+v", user)
+	}
+}
+
+func TestGetUserByStripeCustomerID_empty(t *testing.T) {
+	user, err := GetUserByStripeCustomerID(logger, nil, nil, nil, &oauth2.Config{}, "")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if user != nil {
+		t.Errorf("expected nil user for empty customer ID, got: %+v", user)
+	}
+}
+
+func TestDisableAllInstallations(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	user := &User{db: sqlx.NewDb(db, "sqlmock"), UserID: 1, Logger: logger}
+
+	mock.ExpectQuery("SELECT installation_id FROM gh_installations WHERE user_id = ?").
+		WithArgs(user.UserID).
+		WillReturnRows(sqlmock.NewRows([]string{"installation_id"}).AddRow(10).AddRow(11))
+	for _, installationID := range []int{10, 11} {
+		mock.ExpectBegin()
+		mock.ExpectExec(`DELETE FROM gh_installations WHERE user_id = \? AND installation_id = \?`).
+			WithArgs(user.UserID, installationID).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		expectQueueChange(mock, installationID, false)
+		mock.ExpectCommit()
+	}
+
+	if err := user.DisableAllInstallations(); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestDisableAllInstallations_error(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	user := &User{db: sqlx.NewDb(db, "sqlmock"), UserID: 1, Logger: logger}
+
+	mock.ExpectQuery("SELECT installation_id FROM gh_installations WHERE user_id = ?").
+		WithArgs(user.UserID).
+		WillReturnRows(sqlmock.NewRows([]string{"installation_id"}).AddRow(10).AddRow(11))
+	mock.ExpectBegin()
+	mock.ExpectExec(`DELETE FROM gh_installations WHERE user_id = \? AND installation_id = \?`).
+		WithArgs(user.UserID, 10).
+		WillReturnError(errors.New("some error"))
+	mock.ExpectRollback()
+
+	// Remaining installations are not disabled, so they're retried.
+	if err := user.DisableAllInstallations(); err == nil {
+		t.Fatal("expected error")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestEnableInstallation_personal(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	provider := payments.NewFake(&stripe.Plan{
+		ID: "PersonalMonthlyUSD", Name: "Personal", Amount: 500, Currency: "usd",
+		Meta: map[string]string{payments.OrganisationsMeta: "0", payments.BuildsPerDayMeta: "10"},
+	})
+	customer, err := provider.NewCustomer(nil, "tok_visa", "PersonalMonthlyUSD", "", true)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	// Personal installations are not subject to organisation quotas.
+	user := &User{db: sqlx.NewDb(db, "sqlmock"), payments: provider, catalogue: loadCatalogue(t, provider), UserID: 1, GitHubID: 2, StripeCustomerID: customer.ID, Logger: logger}
+
+	expectDunning(mock, "dunning", "user_id", user.UserID, DunningPastDue)
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT IGNORE INTO gh_installations \(user_id, installation_id, account_id\) VALUES \(\?, \?, \?\)`).
+		WithArgs(user.UserID, 10, user.GitHubID).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectQueueChange(mock, 10, true)
+	mock.ExpectCommit()
+
+	if err := user.EnableInstallation(10, user.GitHubID); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestEnableInstallation_noSubscription(t *testing.T) {
+	user := &User{UserID: 1, GitHubID: 2, Logger: logger}
+
+	// Both personal and organisation installations require a subscription.
+	for _, accountID := range []int{user.GitHubID, 3} {
+		err := user.EnableInstallation(10, accountID)
+		if _, ok := err.(*QuotaError); !ok {
+			t.Errorf("accountID %v: have err %v, want *QuotaError", accountID, err)
+		}
+	}
+}
+
+func TestEnableInstallation_dunningDisabled(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	provider := payments.NewFake(&stripe.Plan{
+		ID: "ProfessionalMonthlyUSD", Name: "Professional", Amount: 799, Currency: "usd",
+		Meta: map[string]string{payments.OrganisationsMeta: "unlimited", payments.BuildsPerDayMeta: "50"},
+	})
+	customer, err := provider.NewCustomer(nil, "tok_visa", "ProfessionalMonthlyUSD", "", true)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	user := &User{db: sqlx.NewDb(db, "sqlmock"), payments: provider, catalogue: loadCatalogue(t, provider), UserID: 1, GitHubID: 2, StripeCustomerID: customer.ID, Logger: logger}
+
+	// The subscription has not ended, but dunning disabled all installations,
+	// so they must not be enabled again until the payment succeeds.
+	for _, accountID := range []int{user.GitHubID, 3} {
+		expectDunning(mock, "dunning", "user_id", user.UserID, DunningDisabled)
+		err := user.EnableInstallation(10, accountID)
+		if qerr, ok := err.(*QuotaError); !ok || !qerr.Disabled {
+			t.Errorf("accountID %v: have err %v, want *QuotaError with Disabled", accountID, err)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestPlan_notInCatalogue(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	// Plans created since the catalogue was loaded have no limits, rather
+	// than preventing the user from enabling installations.
+	provider := payments.NewFake(&stripe.Plan{ID: "LegacyMonthlyUSD", Name: "Legacy", Amount: 500, Currency: "usd"})
+	customer, err := provider.NewCustomer(nil, "tok_visa", "LegacyMonthlyUSD", "", true)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	user := &User{db: sqlx.NewDb(db, "sqlmock"), payments: provider, catalogue: payments.NewCatalogue(), UserID: 1, GitHubID: 2, StripeCustomerID: customer.ID, Logger: logger}
+
+	plan, err := user.Plan()
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	want := payments.Plan{ID: "LegacyMonthlyUSD", Name: "Legacy", Organisations: payments.Unlimited, BuildsPerDay: payments.Unlimited}
+	if plan == nil || *plan != want {
+		t.Fatalf("have plan %+v want %+v", plan, want)
+	}
+
+	expectDunning(mock, "dunning", "user_id", user.UserID, "")
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT IGNORE INTO gh_installations \(user_id, installation_id, account_id\) VALUES \(\?, \?, \?\)`).
+		WithArgs(user.UserID, 10, 3).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectQueueChange(mock, 10, true)
+	mock.ExpectCommit()
+
+	if err := user.EnableInstallation(10, 3); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestBuildUsage_LimitReached(t *testing.T) {
+	tests := []struct {
+		total int
+		limit int
+		want  bool
+	}{
+		{0, 10, false},
+		{9, 10, false},
+		{10, 10, true},
+		{11, 10, true},
+		{1000, payments.Unlimited, false},
+	}
+
+	for _, test := range tests {
+		usage := &BuildUsage{Total: test.total, Limit: test.limit}
+		if have := usage.LimitReached(); have != test.want {
+			t.Errorf("total %v limit %v: have %v want %v", test.total, test.limit, have, test.want)
+		}
+	}
+}
+
+func TestProcessStripePayment_newCustomer(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	provider := payments.NewFake(&stripe.Plan{ID: "PersonalMonthlyUSD", Amount: 500, Currency: "usd"})
+	user := &User{db: sqlx.NewDb(db, "sqlmock"), payments: provider, UserID: 1, Logger: logger}
+
+	mock.ExpectExec(`UPDATE users SET stripe_customer_id = \?, stripe_currency = \? WHERE ID = \?`).
+		WithArgs(sqlmock.AnyArg(), "usd", user.UserID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := user.ProcessStripePayment("tok_visa", "PersonalMonthlyUSD", ""); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if len(provider.Customers) != 1 {
+		t.Errorf("have %d stripe customers want 1", len(provider.Customers))
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestProcessStripePayment_currencyMismatch(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	provider := payments.NewFake(
+		&stripe.Plan{ID: "PersonalMonthly", Amount: 500, Currency: "aud"},
+		&stripe.Plan{ID: "PersonalMonthlyUSD", Amount: 399, Currency: "usd"},
+	)
+	legacy, err := provider.NewCustomer(nil, "tok_visa", "PersonalMonthly", "", true)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	user := &User{db: sqlx.NewDb(db, "sqlmock"), payments: provider, UserID: 1, StripeCustomerID: legacy.ID, StripeCurrency: "aud", Logger: logger}
+
+	mock.ExpectExec(`UPDATE users SET stripe_customer_id = \?, stripe_currency = \? WHERE ID = \?`).
+		WithArgs(sqlmock.AnyArg(), "usd", user.UserID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := user.ProcessStripePayment("tok_visa", "PersonalMonthlyUSD", ""); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if user.StripeCustomerID == legacy.ID || user.StripeCurrency != "usd" {
+		t.Errorf("have stripe customer %q currency %q want new usd customer", user.StripeCustomerID, user.StripeCurrency)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestProcessStripePayment_unrecordedCurrency(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	provider := payments.NewFake(
+		&stripe.Plan{ID: "PersonalMonthly", Amount: 500, Currency: "aud"},
+		&stripe.Plan{ID: "PersonalMonthlyUSD", Amount: 399, Currency: "usd"},
+	)
+	legacy, err := provider.NewCustomer(nil, "tok_visa", "PersonalMonthly", "", true)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := provider.CancelSubscription(legacy.Subs.Values[0].ID, false); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	// The customer's currency was not recorded, but it's still charged in AUD.
+	user := &User{db: sqlx.NewDb(db, "sqlmock"), payments: provider, UserID: 1, StripeCustomerID: legacy.ID, Logger: logger}
+
+	mock.ExpectExec(`UPDATE users SET stripe_customer_id = \?, stripe_currency = \? WHERE ID = \?`).
+		WithArgs(sqlmock.AnyArg(), "usd", user.UserID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := user.ProcessStripePayment("tok_visa", "PersonalMonthlyUSD", ""); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if user.StripeCustomerID == legacy.ID || user.StripeCurrency != "usd" {
+		t.Errorf("have stripe customer %q currency %q want new usd customer", user.StripeCustomerID, user.StripeCurrency)
+	}
+	if len(legacy.Subs.Values) != 0 {
+		t.Errorf("have %d subscriptions on aud customer want 0", len(legacy.Subs.Values))
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestProcessStripePayment_newCustomerAfterTrial(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	provider := payments.NewFake(
+		&stripe.Plan{ID: "PersonalMonthly", Amount: 500, Currency: "aud", TrialPeriod: 30},
+		&stripe.Plan{ID: "PersonalMonthlyUSD", Amount: 399, Currency: "usd", TrialPeriod: 30},
+	)
+	legacy, err := provider.NewCustomer(nil, "tok_visa", "PersonalMonthly", "", true)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	trialStartedAt := time.Unix(legacy.Subs.Values[0].TrialStart, 0)
+	user := &User{
+		db: sqlx.NewDb(db, "sqlmock"), payments: provider, UserID: 1, Logger: logger,
+		StripeCustomerID: legacy.ID, StripeCurrency: "aud", TrialStartedAt: &trialStartedAt,
+	}
+
+	// The new customer in a different currency must not get a second trial.
+	mock.ExpectExec(`UPDATE users SET stripe_customer_id = \?, stripe_currency = \? WHERE ID = \?`).
+		WithArgs(sqlmock.AnyArg(), "usd", user.UserID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := user.ProcessStripePayment("tok_visa", "PersonalMonthlyUSD", ""); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	customer, err := user.StripeCustomer()
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	subs := user.StripeSubscriptions(customer)
+	if customer.ID == legacy.ID || len(subs) != 1 || subs[0].InTrial {
+		t.Errorf("have customer %q subscriptions %+v want new customer without trial", customer.ID, subs)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestProcessStripeCoupon(t *testing.T) {
+	provider := payments.NewFake(&stripe.Plan{ID: "PersonalMonthlyUSD", Amount: 500, Currency: "usd"})
+	provider.Coupons["EXPIRED"] = &stripe.Coupon{ID: "EXPIRED", Percent: 10, Valid: false}
+	provider.Coupons["HALF"] = &stripe.Coupon{ID: "HALF", Percent: 50, Duration: "forever", Valid: true}
+	customer, err := provider.NewCustomer(nil, "tok_visa", "PersonalMonthlyUSD", "", true)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	user := &User{payments: provider, UserID: 1, StripeCustomerID: customer.ID, Logger: logger}
+
+	if err := user.ProcessStripeCoupon("EXPIRED", "PersonalMonthlyUSD"); err == nil {
+		t.Error("expected error for invalid coupon")
+	}
+	if err := user.ProcessStripeCoupon("HALF", "PersonalMonthlyUSD"); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if customer.Discount == nil || customer.Discount.Coupon.ID != "HALF" {
+		t.Errorf("have discount %+v want coupon HALF", customer.Discount)
+	}
+}
+
+func TestStripeUpcomingInvoice(t *testing.T) {
+	provider := payments.NewFake(&stripe.Plan{ID: "PersonalMonthlyUSD", Amount: 500, Currency: "usd"})
+	customer, err := provider.NewCustomer(nil, "tok_visa", "PersonalMonthlyUSD", "", true)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	user := &User{payments: provider, UserID: 1, StripeCustomerID: customer.ID, Logger: logger}
+
+	invoice, err := user.StripeUpcomingInvoice()
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if want := "$USD 5.00"; invoice == nil || invoice.AmountDisplay != want {
+		t.Errorf("have invoice %+v want amount %q", invoice, want)
+	}
+
+	if err := user.CancelStripeSubscription(customer.Subs.Values[0].ID, true); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	invoice, err = user.StripeUpcomingInvoice()
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if invoice != nil {
+		t.Errorf("have invoice %+v after cancelling want nil", invoice)
+	}
+}
+
+func TestEnableInstallation_organisationQuota(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	provider := payments.NewFake(&stripe.Plan{
+		ID: "PersonalMonthlyUSD", Name: "Personal", Amount: 500, Currency: "usd",
+		Meta: map[string]string{payments.OrganisationsMeta: "0", payments.BuildsPerDayMeta: "10"},
+	})
+	customer, err := provider.NewCustomer(nil, "tok_visa", "PersonalMonthlyUSD", "", true)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	user := &User{db: sqlx.NewDb(db, "sqlmock"), payments: provider, catalogue: loadCatalogue(t, provider), UserID: 1, GitHubID: 2, StripeCustomerID: customer.ID, Logger: logger}
+
+	expectDunning(mock, "dunning", "user_id", user.UserID, "")
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM gh_installations WHERE user_id = \? AND \(account_id IS NULL OR account_id != \?\) AND installation_id != \?`).
+		WithArgs(user.UserID, user.GitHubID, 10).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+
+	err = user.EnableInstallation(10, 3)
+	qerr, ok := err.(*QuotaError)
+	if !ok {
+		t.Fatalf("have err %v, want *QuotaError", err)
+	}
+	if want := (QuotaError{Plan: "Personal", Limit: 0}); *qerr != want {
+		t.Errorf("have %+v want %+v", *qerr, want)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestRecordInstallationAccounts(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	user := &User{db: sqlx.NewDb(db, "sqlmock"), UserID: 1, GitHubID: 2, Logger: logger}
+
+	mock.ExpectExec(`UPDATE gh_installations SET account_id = \? WHERE user_id = \? AND installation_id = \? AND account_id IS NULL`).
+		WithArgs(3, user.UserID, 10).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := user.RecordInstallationAccounts(map[int]int{10: 3}); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestStripeInvoices(t *testing.T) {
+	provider := payments.NewFake(&stripe.Plan{ID: "PersonalMonthlyUSD", Amount: 500, Currency: "usd"})
+	customer, err := provider.NewCustomer(nil, "tok_visa", "PersonalMonthlyUSD", "", true)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	provider.PastInvoices[customer.ID] = []*stripe.Invoice{
+		{ID: "in_3", Amount: 500, Currency: "usd", Date: 3, Start: 2, End: 3, HostedInvoiceURL: "https://example.com/in_3"},
+		{ID: "in_2", Amount: 500, Currency: "usd", Date: 2, Paid: true},
+		{ID: "in_1", Amount: 500, Currency: "usd", Date: 1, Forgive: true},
+	}
+	user := &User{payments: provider, UserID: 1, StripeCustomerID: customer.ID, Logger: logger}
+
+	invoices, more, err := user.StripeInvoices("", 2)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if !more || len(invoices) != 2 {
+		t.Fatalf("have %d invoices more %v, want 2 invoices and more", len(invoices), more)
+	}
+	want := Invoice{
+		ID:            "in_3",
+		AmountDisplay: "$USD 5.00",
+		DueDate:       time.Unix(3, 0),
+		Status:        InvoiceOpen,
+		PeriodStart:   time.Unix(2, 0),
+		PeriodEnd:     time.Unix(3, 0),
+		URL:           "https://example.com/in_3",
+	}
+	if !reflect.DeepEqual(invoices[0], want) {
+		t.Errorf("\nhave %+v\nwant %+v", invoices[0], want)
+	}
+	if invoices[1].Status != InvoicePaid {
+		t.Errorf("have status %q want %q", invoices[1].Status, InvoicePaid)
+	}
+
+	invoices, more, err = user.StripeInvoices("in_2", 2)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if more || len(invoices) != 1 || invoices[0].Status != InvoiceVoid {
+		t.Errorf("have invoices %+v more %v, want single void invoice", invoices, more)
+	}
+
+	all, err := user.AllStripeInvoices()
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if len(all) != 3 {
+		t.Errorf("have %d invoices want 3", len(all))
+	}
+}
+
+func TestWriteInvoicesCSV(t *testing.T) {
+	invoices := []Invoice{
+		{
+			ID:            "in_1",
+			AmountDisplay: "$USD 5.00",
+			DueDate:       time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC),
+			Status:        InvoicePaid,
+			PeriodStart:   time.Date(2017, 2, 1, 0, 0, 0, 0, time.UTC),
+			PeriodEnd:     time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC),
+			URL:           "https://example.com/in_1",
+		},
+		{ID: "in_0", AmountDisplay: "$USD 0.00", DueDate: time.Date(2017, 2, 1, 0, 0, 0, 0, time.UTC), Status: InvoiceVoid},
+	}
+
+	var buf bytes.Buffer
+	if err := WriteInvoicesCSV(&buf, invoices); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	want := `Invoice,Date,Period Start,Period End,Amount,Status,URL
+in_1,2017-03-01,2017-02-01,2017-03-01,$USD 5.00,paid,https://example.com/in_1
+in_0,2017-02-01,,,$USD 0.00,void,
+`
+	if have := buf.String(); have != want {
+		t.Errorf("\nhave %q\nwant %q", have, want)
+	}
+}
+
+func TestCard_ExpiresWithin(t *testing.T) {
+	card := &Card{ExpMonth: time.March, ExpYear: 2017}
+	tests := []struct {
+		now  time.Time
+		want bool
+	}{
+		{time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC), false},
+		{time.Date(2017, 2, 28, 0, 0, 0, 0, time.UTC), false},
+		{time.Date(2017, 3, 5, 0, 0, 0, 0, time.UTC), true},
+		{time.Date(2017, 3, 31, 0, 0, 0, 0, time.UTC), true},
+		{time.Date(2017, 4, 1, 0, 0, 0, 0, time.UTC), true},
+	}
+	for _, test := range tests {
+		if have := card.ExpiresWithin(test.now, 30*24*time.Hour); have != test.want {
+			t.Errorf("now %v: have %v want %v", test.now, have, test.want)
+		}
+	}
+}
+
+func TestUpdateStripeCard(t *testing.T) {
+	provider := payments.NewFake(&stripe.Plan{ID: "PersonalMonthlyUSD", Amount: 500, Currency: "usd"})
+	provider.Cards["tok_old"] = &stripe.Card{Brand: "Visa", LastFour: "4242", Month: 1, Year: 2017}
+	provider.Cards["tok_new"] = &stripe.Card{Brand: "MasterCard", LastFour: "4444", Month: 12, Year: 2020}
+	customer, err := provider.NewCustomer(nil, "tok_old", "PersonalMonthlyUSD", "", true)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	user := &User{payments: provider, UserID: 1, StripeCustomerID: customer.ID, Logger: logger}
+
+	want := &Card{Brand: "Visa", LastFour: "4242", ExpMonth: time.January, ExpYear: 2017}
+	if have := user.StripeDefaultCard(customer); !reflect.DeepEqual(have, want) {
+		t.Errorf("have %+v want %+v", have, want)
+	}
+
+	if err := user.UpdateStripeCard("tok_unknown"); err == nil {
+		t.Error("expected error for unknown token")
+	}
+	if err := user.UpdateStripeCard("tok_new"); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	want = &Card{Brand: "MasterCard", LastFour: "4444", ExpMonth: time.December, ExpYear: 2020}
+	if have := user.StripeDefaultCard(customer); !reflect.DeepEqual(have, want) {
+		t.Errorf("have %+v want %+v", have, want)
+	}
+	if have := len(customer.Subs.Values); have != 1 {
+		t.Errorf("have %d subscriptions want 1", have)
+	}
+}
+
+func TestProcessStripePayment_trial(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	now := time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC)
+	provider := payments.NewFake(&stripe.Plan{ID: "PersonalMonthlyUSD", Amount: 500, Currency: "usd", TrialPeriod: 30})
+	provider.Now = func() time.Time { return now }
+	user := &User{db: sqlx.NewDb(db, "sqlmock"), payments: provider, UserID: 20, Logger: logger}
+
+	mock.ExpectExec(`UPDATE users SET stripe_customer_id = \?, stripe_currency = \? WHERE ID = \?`).
+		WithArgs(sqlmock.AnyArg(), "usd", user.UserID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`UPDATE users SET trial_started_at = \?, trial_ends_at = \? WHERE id = \?`).
+		WithArgs(now, now.AddDate(0, 0, 30), user.UserID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := user.ProcessStripePayment("tok_visa", "PersonalMonthlyUSD", ""); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if user.TrialEndsAt == nil || !user.TrialEndsAt.Equal(now.AddDate(0, 0, 30)) {
+		t.Errorf("have trial ends at %v want %v", user.TrialEndsAt, now.AddDate(0, 0, 30))
+	}
+
+	customer, err := user.StripeCustomer()
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	subs := user.StripeSubscriptions(customer)
+	if len(subs) != 1 || !subs[0].InTrial || !subs[0].TrialEndsAt.Equal(now.AddDate(0, 0, 30)) {
+		t.Errorf("have subscriptions %+v want single subscription in trial", subs)
+	}
+
+	// Resubscribing after cancelling does not start another trial
+	if err := user.CancelStripeSubscription(subs[0].ID, false); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := user.ProcessStripePayment("", "PersonalMonthlyUSD", ""); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	subs = user.StripeSubscriptions(customer)
+	if len(subs) != 1 || subs[0].InTrial || !subs[0].TrialEndsAt.IsZero() {
+		t.Errorf("have subscriptions %+v want single subscription without trial", subs)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestSendTrialReminder(t *testing.T) {
+	user := &User{UserID: 1, Email: "user@example.com", Logger: logger}
+	sub := &stripe.Sub{
+		Plan:     &stripe.Plan{Name: "Personal", Amount: 399, Currency: "usd", Interval: stripe.Month},
+		TrialEnd: time.Date(2017, 3, 31, 0, 0, 0, 0, time.UTC).Unix(),
+	}
+
+	notifier := &mockNotifier{}
+	if err := user.SendTrialReminder(notifier, sub); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if len(notifier.sent) != 1 {
+		t.Fatalf("have %d notifications want 1", len(notifier.sent))
+	}
+	sent := notifier.sent[0]
+	if sent.to != user.Email || !strings.Contains(sent.body, "ends on 31 March 2017") || !strings.Contains(sent.body, "$USD 3.99 per month") {
+		t.Errorf("unexpected notification: %+v", sent)
+	}
+}
+
+func TestSendUninstallNotice(t *testing.T) {
+	user := &User{UserID: 1, Email: "user@example.com", Logger: logger}
+
+	notifier := &mockNotifier{}
+	if err := user.SendUninstallNotice(notifier, "gopherci"); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if len(notifier.sent) != 1 {
+		t.Fatalf("have %d notifications want 1", len(notifier.sent))
+	}
+	sent := notifier.sent[0]
+	if sent.to != user.Email || !strings.Contains(sent.body, "uninstalled from gopherci") {
+		t.Errorf("unexpected notification: %+v", sent)
+	}
+}
+
+func TestStripeDiscount(t *testing.T) {
+	end := time.Now().Add(24 * time.Hour).Unix()
+	tests := []struct {
+		coupon stripe.Coupon
+		want   string
+	}{
+		{stripe.Coupon{ID: "HALF", Percent: 50, Duration: coupon.Forever}, "50% off forever"},
+		{stripe.Coupon{ID: "FIVE", Amount: 500, Currency: "usd", Duration: coupon.Once}, "$5.00 USD off the next invoice"},
+		{stripe.Coupon{ID: "YEN", Amount: 1000, Currency: "jpy", Duration: coupon.Repeating, DurationPeriod: 3}, "¥1,000 JPY off for 3 months"},
+	}
+	for _, test := range tests {
+		c := test.coupon
+		customer := &stripe.Customer{Discount: &stripe.Discount{Coupon: &c, End: end}}
+		discount := (&User{}).StripeDiscount(customer)
+		if discount == nil {
+			t.Errorf("coupon %v: have nil discount", c.ID)
+			continue
+		}
+		if discount.Description != test.want {
+			t.Errorf("coupon %v: have description %q want %q", c.ID, discount.Description, test.want)
+		}
+	}
+}
+
+func TestRemoveInstallation(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`DELETE FROM gh_installations WHERE installation_id = \?`).
+		WithArgs(100).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectQueueChange(mock, 100, false)
+	mock.ExpectCommit()
+
+	um := NewUserManager(logger, sqlx.NewDb(db, "sqlmock"), nil, nil, "", "")
+	if err := um.RemoveInstallation(100); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
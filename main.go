@@ -4,13 +4,20 @@ import (
 	"database/sql"
 	"fmt"
 	"html/template"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/bradleyfalzon/gopherci-web/internal/commands"
+	"github.com/bradleyfalzon/gopherci-web/internal/githubapp"
 	"github.com/bradleyfalzon/gopherci-web/internal/gopherci"
+	"github.com/bradleyfalzon/gopherci-web/internal/notify"
+	"github.com/bradleyfalzon/gopherci-web/internal/payments"
 	"github.com/bradleyfalzon/gopherci-web/internal/users"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
@@ -21,13 +28,26 @@ import (
 )
 
 var (
-	db        *sql.DB
-	um        *users.UserManager
-	gciClient *gopherci.Client
-	templates *template.Template // templates contains all the html templates
-	logger    = logrus.New()
+	db            *sql.DB
+	um            *users.UserManager
+	gciClient     *gopherci.Client
+	stripeWebhook *payments.WebhookVerifier
+	stripeEvents  *payments.EventStore
+	catalogue     payments.Catalogue // catalogue contains all stripe plans
+	githubApp     *githubapp.App     // githubApp is nil if the GitHub App is not configured
+	githubWebhook *githubapp.WebhookVerifier
+	notifier      notify.Notifier
+	templates     *template.Template // templates contains all the html templates
+	logger        = logrus.New()
+	// installationChanges wakes applyInstallationChanges after an
+	// installation is enabled or disabled.
+	installationChanges = make(chan struct{}, 1)
 )
 
+// installationChangesInterval is how often pending installation changes are
+// applied to GopherCI, failed changes are retried with a backoff.
+const installationChangesInterval = 30 * time.Second
+
 func main() {
 
 	_ = godotenv.Load() // .env is not critical
@@ -50,14 +70,88 @@ func main() {
 	}
 	dbx := sqlx.NewDb(db, os.Getenv("DB_DRIVER"))
 
-	// Check commands
-	cmd := commands.NewCommand()
+	// GopherCI client
+	// TODO strict mode
+	logger.Printf("Connecting to GopherCI DB %q db name: %q, username: %q, host: %q, port: %q",
+		os.Getenv("GCI_DB_DRIVER"), os.Getenv("GCI_DB_DATABASE"), os.Getenv("GCI_DB_USERNAME"), os.Getenv("GCI_DB_HOST"), os.Getenv("GCI_DB_PORT"),
+	)
+	dsn = fmt.Sprintf(`%s:%s@tcp(%s:%s)/%s?charset=utf8&collation=utf8_unicode_ci&timeout=6s&time_zone='%%2B00:00'&parseTime=true`,
+		os.Getenv("GCI_DB_USERNAME"), os.Getenv("GCI_DB_PASSWORD"), os.Getenv("GCI_DB_HOST"), os.Getenv("GCI_DB_PORT"), os.Getenv("GCI_DB_DATABASE"),
+	)
+	gciDB, err := sql.Open(os.Getenv("GCI_DB_DRIVER"), dsn)
+	if err != nil {
+		logger.WithError(err).Fatal("could not connect to GopherCI db")
+	}
+	gciDBx := sqlx.NewDb(gciDB, os.Getenv("GCI_DB_DRIVER"))
+	gciClient = gopherci.New(gciDBx)
+
+	// UserManager
+	switch {
+	case os.Getenv("GITHUB_OAUTH_CLIENT_ID") == "":
+		logger.Fatal("GITHUB_OAUTH_CLIENT_ID is not set")
+	case os.Getenv("GITHUB_OAUTH_CLIENT_SECRET") == "":
+		logger.Fatal("GITHUB_OAUTH_CLIENT_SECRET is not set")
+	}
+	provider := payments.NewStripe(payments.NewStripeAPI(os.Getenv("STRIPE_SECRET_KEY"), logger.WithField("pkg", "stripe"), 2))
+
+	// Plans and prices are managed in stripe, restart after changing plans
+	if catalogue, err = payments.LoadCatalogue(logger.WithField("pkg", "payments"), provider); err != nil {
+		logger.WithError(err).Fatal("could not load plan catalogue")
+	}
+
+	um = users.NewUserManager(logger.WithField("pkg", "users"), dbx, provider, catalogue, os.Getenv("GITHUB_OAUTH_CLIENT_ID"), os.Getenv("GITHUB_OAUTH_CLIENT_SECRET"))
+
+	stripeEvents = payments.NewEventStore(dbx)
+
+	// GitHub App, optional, used to describe installations users no longer
+	// have access to
+	if os.Getenv("GITHUB_APP_ID") != "" {
+		appID, err := strconv.Atoi(os.Getenv("GITHUB_APP_ID"))
+		if err != nil {
+			logger.WithError(err).Fatal("invalid GITHUB_APP_ID")
+		}
+		privateKey, err := ioutil.ReadFile(os.Getenv("GITHUB_APP_PRIVATE_KEY_FILE"))
+		if err != nil {
+			logger.WithError(err).Fatal("could not read GITHUB_APP_PRIVATE_KEY_FILE")
+		}
+		if githubApp, err = githubapp.New(appID, privateKey); err != nil {
+			logger.WithError(err).Fatal("could not initialise GitHub App")
+		}
+	}
+
+	// Notifications, logged instead of emailed if no SMTP server is set
+	notifier = notify.NewLog(logger.WithField("pkg", "notify"))
+	if os.Getenv("SMTP_ADDR") != "" {
+		notifier = notify.NewSMTP(os.Getenv("SMTP_ADDR"), os.Getenv("SMTP_FROM"), os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"))
+	}
+	dunningPolicy, err := users.ParseDunningPolicy(os.Getenv("DUNNING_REMINDER_DAYS"), os.Getenv("DUNNING_GRACE_DAYS"))
+	if err != nil {
+		logger.WithError(err).Fatal("could not parse dunning policy")
+	}
+
+	billingCurrency := strings.ToLower(os.Getenv("BILLING_CURRENCY"))
+	if billingCurrency == "" {
+		billingCurrency = payments.DefaultCurrency
+	}
+
+	// Check commands, which list every stripe customer so only log errors
+	cmd := commands.NewCommand(payments.NewStripeAPI(os.Getenv("STRIPE_SECRET_KEY"), logger.WithField("pkg", "commands"), 1))
 	if len(os.Args) > 1 {
 		switch os.Args[1] {
 		case "billing:check":
-			cmd.BillingCheck(os.Getenv("STRIPE_SECRET_KEY"))
+			cmd.BillingCheck(um, gciClient, os.Args[2:])
+		case "billing:currency":
+			cmd.BillingCurrency(um, billingCurrency)
+		case "builds:enforce":
+			cmd.BuildsEnforce(um, gciClient)
+		case "dunning:process":
+			cmd.DunningProcess(um, gciClient, notifier, dunningPolicy)
+		case "installations:reconcile":
+			cmd.InstallationsReconcile(um, gciClient, os.Args[2:])
 		case "migrate:rollback":
 			cmd.Migrate(db, os.Getenv("DB_DRIVER"), migrate.Down)
+		case "webhooks:replay":
+			cmd.WebhooksReplay(stripeEvents, processStripeEvent, os.Args[2:])
 		default:
 			logger.Fatalf("Unknown command %q", os.Args[1])
 		}
@@ -72,20 +166,19 @@ func main() {
 		logger.WithError(err).Fatal("could not parse html templates")
 	}
 
-	// GopherCI client
-	// TODO strict mode
-	logger.Printf("Connecting to GopherCI DB %q db name: %q, username: %q, host: %q, port: %q",
-		os.Getenv("GCI_DB_DRIVER"), os.Getenv("GCI_DB_DATABASE"), os.Getenv("GCI_DB_USERNAME"), os.Getenv("GCI_DB_HOST"), os.Getenv("GCI_DB_PORT"),
-	)
-	dsn = fmt.Sprintf(`%s:%s@tcp(%s:%s)/%s?charset=utf8&collation=utf8_unicode_ci&timeout=6s&time_zone='%%2B00:00'&parseTime=true`,
-		os.Getenv("GCI_DB_USERNAME"), os.Getenv("GCI_DB_PASSWORD"), os.Getenv("GCI_DB_HOST"), os.Getenv("GCI_DB_PORT"), os.Getenv("GCI_DB_DATABASE"),
-	)
-	gciDB, err := sql.Open(os.Getenv("GCI_DB_DRIVER"), dsn)
-	if err != nil {
-		logger.WithError(err).Fatal("could not connect to GopherCI db")
+	// Stripe webhook secrets, multiple comma separated secrets are accepted
+	// while rolling the secret.
+	if os.Getenv("STRIPE_WEBHOOK_SECRET") == "" {
+		logger.Fatal("STRIPE_WEBHOOK_SECRET is not set")
 	}
-	gciDBx := sqlx.NewDb(gciDB, os.Getenv("GCI_DB_DRIVER"))
-	gciClient = gopherci.New(gciDBx)
+	stripeWebhook = payments.NewWebhookVerifier(payments.DefaultTolerance, strings.Split(os.Getenv("STRIPE_WEBHOOK_SECRET"), ",")...)
+
+	// GitHub App webhook secrets, comma separated like the stripe secrets,
+	// all GitHub events are rejected if not set.
+	if os.Getenv("GITHUB_WEBHOOK_SECRET") == "" {
+		logger.Warn("GITHUB_WEBHOOK_SECRET is not set, rejecting all github events")
+	}
+	githubWebhook = githubapp.NewWebhookVerifier(strings.Split(os.Getenv("GITHUB_WEBHOOK_SECRET"), ",")...)
 
 	r := chi.NewRouter()
 	r.Use(middleware.RealIP) // Blindly accept XFF header, ensure LB overwrites it
@@ -100,29 +193,70 @@ func main() {
 	r.Get("/", homeHandler)
 	r.Get("/logout", logoutHandler)
 	r.Post("/stripe/event", stripeEventHandler)
+	r.Post("/github/event", githubEventHandler)
 	r.Route("/console", func(r chi.Router) {
 		r.Use(MustBeUserMiddleware)
 		r.Get("/", consoleIndexHandler)
 		r.Post("/install-state", consoleInstallStateHandler)
+		r.Post("/install-transfer", consoleInstallTransferHandler)
+		r.Get("/install/:installationID/repositories", consoleInstallReposHandler)
+		r.Post("/install/:installationID/repositories", consoleInstallReposProcessHandler)
+		r.Get("/install/:installationID/repositories/:repositoryID/tools", consoleRepoToolsHandler)
+		r.Post("/install/:installationID/repositories/:repositoryID/tools", consoleRepoToolsProcessHandler)
 		r.Route("/billing", func(r chi.Router) {
 			r.Get("/", consoleBillingHandler)
+			r.Get("/invoices.csv", consoleBillingInvoicesCSVHandler)
 			r.Post("/process/:planID", consoleBillingProcessHandler)
+			r.Get("/change/:planID", consoleBillingChangeHandler)
+			r.Post("/change/:planID", consoleBillingChangeProcessHandler)
+			r.Get("/payment-method", consoleBillingPaymentMethodHandler)
+			r.Post("/payment-method", consoleBillingPaymentMethodProcessHandler)
+			r.Get("/coupon", consoleBillingCouponPreviewHandler)
 			r.Post("/coupon", consoleBillingCouponHandler)
 			r.Post("/cancel", consoleBillingCancelHandler)
 		})
+		r.Route("/org/:login/billing", func(r chi.Router) {
+			r.Get("/", consoleOrgBillingHandler)
+			r.Post("/process/:planID", consoleOrgBillingProcessHandler)
+			r.Post("/cancel", consoleOrgBillingCancelHandler)
+		})
 	})
 
-	// UserManager
-	switch {
-	case os.Getenv("GITHUB_OAUTH_CLIENT_ID") == "":
-		logger.Fatal("GITHUB_OAUTH_CLIENT_ID is not set")
-	case os.Getenv("GITHUB_OAUTH_CLIENT_SECRET") == "":
-		logger.Fatal("GITHUB_OAUTH_CLIENT_SECRET is not set")
-	}
-	um = users.NewUserManager(logger.WithField("pkg", "users"), dbx, os.Getenv("GITHUB_OAUTH_CLIENT_ID"), os.Getenv("GITHUB_OAUTH_CLIENT_SECRET"), os.Getenv("STRIPE_SECRET_KEY"))
 	r.Get("/gh/login", um.OAuthLoginHandler)
 	r.Get("/gh/callback", um.OAuthCallbackHandler)
 
+	go applyInstallationChanges()
+
 	logger.Println("Listening on", listen)
 	logger.Fatal(http.ListenAndServe(listen, r))
 }
+
+// applyInstallationChanges applies installation changes to GopherCI every
+// installationChangesInterval, or when woken by installationChanges.
+func applyInstallationChanges() {
+	ticker := time.NewTicker(installationChangesInterval)
+	defer ticker.Stop()
+	for {
+		applied, err := um.ApplyInstallationChanges(gciClient, time.Now())
+		if err != nil {
+			logger.WithError(err).Error("could not apply installation changes")
+		}
+		if applied > 0 {
+			logger.Infof("applied %d installation changes", applied)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-installationChanges:
+		}
+	}
+}
+
+// wakeInstallationChanges wakes applyInstallationChanges after a change is
+// queued, so the change isn't pending until its next run.
+func wakeInstallationChanges() {
+	select {
+	case installationChanges <- struct{}{}:
+	default:
+	}
+}
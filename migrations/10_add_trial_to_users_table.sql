@@ -0,0 +1,7 @@
+-- +migrate Up
+ALTER TABLE users ADD COLUMN trial_started_at TIMESTAMP NULL DEFAULT NULL AFTER stripe_customer_id;
+ALTER TABLE users ADD COLUMN trial_ends_at TIMESTAMP NULL DEFAULT NULL AFTER trial_started_at;
+
+-- +migrate Down
+ALTER TABLE users DROP COLUMN trial_ends_at;
+ALTER TABLE users DROP COLUMN trial_started_at;
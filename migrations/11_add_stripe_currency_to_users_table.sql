@@ -0,0 +1,5 @@
+-- +migrate Up
+ALTER TABLE users ADD COLUMN stripe_currency CHAR(3) NOT NULL DEFAULT "" AFTER stripe_customer_id;
+
+-- +migrate Down
+ALTER TABLE users DROP COLUMN stripe_currency;
@@ -0,0 +1,24 @@
+-- +migrate Up
+CREATE TABLE billing_accounts (
+    id INT UNSIGNED AUTO_INCREMENT,
+    github_id INT UNSIGNED NOT NULL,
+    login VARCHAR(255) NOT NULL,
+    stripe_customer_id VARCHAR(32) NOT NULL DEFAULT "",
+    stripe_currency CHAR(3) NOT NULL DEFAULT "",
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (id),
+    UNIQUE KEY `github_id` (`github_id`)
+) ENGINE=innodb;
+
+ALTER TABLE gh_installations
+    MODIFY COLUMN user_id INT UNSIGNED NULL DEFAULT NULL,
+    ADD COLUMN billing_account_id INT UNSIGNED NULL DEFAULT NULL AFTER user_id,
+    ADD CONSTRAINT gh_installations_billing_account_id_fk FOREIGN KEY (billing_account_id) REFERENCES billing_accounts (id) ON DELETE CASCADE;
+
+-- +migrate Down
+DELETE FROM gh_installations WHERE user_id IS NULL;
+ALTER TABLE gh_installations
+    DROP FOREIGN KEY gh_installations_billing_account_id_fk,
+    DROP COLUMN billing_account_id,
+    MODIFY COLUMN user_id INT UNSIGNED NOT NULL;
+DROP TABLE billing_accounts;
@@ -0,0 +1,15 @@
+-- +migrate Up
+CREATE TABLE installation_transfers (
+    id INT UNSIGNED AUTO_INCREMENT,
+    installation_id INT UNSIGNED NOT NULL,
+    from_user_id INT UNSIGNED NOT NULL,
+    to_user_id INT UNSIGNED NOT NULL,
+    by_user_id INT UNSIGNED NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (id),
+    KEY `from_user_id` (`from_user_id`),
+    KEY `to_user_id` (`to_user_id`)
+) ENGINE=innodb;
+
+-- +migrate Down
+DROP TABLE installation_transfers;
@@ -0,0 +1,18 @@
+-- +migrate Up
+CREATE TABLE installation_changes (
+    id INT UNSIGNED AUTO_INCREMENT,
+    installation_id INT UNSIGNED NOT NULL,
+    enable BOOLEAN NOT NULL,
+    attempts INT UNSIGNED NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    claimed_until TIMESTAMP NULL DEFAULT NULL,
+    applied_at TIMESTAMP NULL DEFAULT NULL,
+    `error` TEXT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (id),
+    KEY `installation_id` (`installation_id`),
+    KEY `pending` (`applied_at`, `next_attempt_at`)
+) ENGINE=innodb;
+
+-- +migrate Down
+DROP TABLE installation_changes;
@@ -0,0 +1,5 @@
+-- +migrate Up
+ALTER TABLE gh_installations ADD COLUMN throttled_at TIMESTAMP NULL DEFAULT NULL AFTER account_id;
+
+-- +migrate Down
+ALTER TABLE gh_installations DROP COLUMN throttled_at;
@@ -0,0 +1,16 @@
+-- +migrate Up
+ALTER TABLE billing_accounts ADD COLUMN email VARCHAR(255) NOT NULL DEFAULT "" AFTER login;
+
+CREATE TABLE account_dunning (
+    billing_account_id INT UNSIGNED NOT NULL,
+    state VARCHAR(32) NOT NULL,
+    past_due_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    reminders_sent INT UNSIGNED NOT NULL DEFAULT 0,
+    disabled_at TIMESTAMP NULL DEFAULT NULL,
+    PRIMARY KEY (billing_account_id),
+    FOREIGN KEY (billing_account_id) REFERENCES billing_accounts (id) ON DELETE CASCADE
+) ENGINE=innodb;
+
+-- +migrate Down
+DROP TABLE `account_dunning`;
+ALTER TABLE billing_accounts DROP COLUMN email;
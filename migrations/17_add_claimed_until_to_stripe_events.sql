@@ -0,0 +1,5 @@
+-- +migrate Up
+ALTER TABLE stripe_events ADD COLUMN claimed_until TIMESTAMP NULL DEFAULT NULL AFTER received_at;
+
+-- +migrate Down
+ALTER TABLE stripe_events DROP COLUMN claimed_until;
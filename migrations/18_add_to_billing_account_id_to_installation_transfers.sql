@@ -0,0 +1,10 @@
+-- +migrate Up
+ALTER TABLE installation_transfers
+    MODIFY COLUMN to_user_id INT UNSIGNED NULL DEFAULT NULL,
+    ADD COLUMN to_billing_account_id INT UNSIGNED NULL DEFAULT NULL AFTER to_user_id;
+
+-- +migrate Down
+DELETE FROM installation_transfers WHERE to_user_id IS NULL;
+ALTER TABLE installation_transfers
+    DROP COLUMN to_billing_account_id,
+    MODIFY COLUMN to_user_id INT UNSIGNED NOT NULL;
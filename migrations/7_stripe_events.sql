@@ -0,0 +1,13 @@
+-- +migrate Up
+CREATE TABLE stripe_events (
+    id VARCHAR(255) NOT NULL,
+    type VARCHAR(255) NOT NULL,
+    payload LONGTEXT NOT NULL,
+    received_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    processed_at TIMESTAMP NULL DEFAULT NULL,
+    `error` TEXT NULL,
+    PRIMARY KEY (id)
+) ENGINE=innodb;
+
+-- +migrate Down
+DROP TABLE `stripe_events`;
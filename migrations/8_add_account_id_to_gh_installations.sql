@@ -0,0 +1,5 @@
+-- +migrate Up
+ALTER TABLE gh_installations ADD COLUMN account_id INT UNSIGNED NULL DEFAULT NULL AFTER installation_id;
+
+-- +migrate Down
+ALTER TABLE gh_installations DROP COLUMN account_id;
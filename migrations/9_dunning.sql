@@ -0,0 +1,13 @@
+-- +migrate Up
+CREATE TABLE dunning (
+    user_id INT UNSIGNED NOT NULL,
+    state VARCHAR(32) NOT NULL,
+    past_due_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    reminders_sent INT UNSIGNED NOT NULL DEFAULT 0,
+    disabled_at TIMESTAMP NULL DEFAULT NULL,
+    PRIMARY KEY (user_id),
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+) ENGINE=innodb;
+
+-- +migrate Down
+DROP TABLE `dunning`;